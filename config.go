@@ -11,9 +11,11 @@ import (
 
 // Config holds the configuration
 type Config struct {
-	Cassandra item.Cassandra
-	Elastic   item.Elastic
-	Port      int
+	Cassandra   item.Cassandra
+	Elastic     item.Elastic
+	Disk        item.Disk
+	Replication item.Replication
+	Port        int
 }
 
 // ReadFileConfig reads configuration from file
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -20,4 +21,6 @@ func TestReadFileConfig(t *testing.T) {
 	require.Equal(1, c.Elastic.Shards)
 	require.Equal(0, c.Elastic.Replicas)
 	require.Equal("items_http", c.Elastic.Index)
+	require.Equal(time.Second, c.Replication.Interval)
+	require.Equal(time.Minute, c.Replication.MaxBackoff)
 }
@@ -0,0 +1,266 @@
+package item
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Clause is a structured search condition, exactly one of its members must be set
+type Clause struct {
+	Term   *TermClause   `json:"term,omitempty"`
+	Prefix *PrefixClause `json:"prefix,omitempty"`
+	Range  *RangeClause  `json:"range,omitempty"`
+	Exists *ExistsClause `json:"exists,omitempty"`
+	Bool   *BoolClause   `json:"bool,omitempty"`
+}
+
+// TermClause matches items with exactly the given value in a field
+type TermClause struct {
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
+}
+
+// PrefixClause matches items with a field value starting with the given string
+type PrefixClause struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+// RangeClause matches items with a field value within the given bounds, which are all numbers or all strings
+type RangeClause struct {
+	Field string      `json:"field"`
+	Gt    interface{} `json:"gt,omitempty"`
+	Gte   interface{} `json:"gte,omitempty"`
+	Lt    interface{} `json:"lt,omitempty"`
+	Lte   interface{} `json:"lte,omitempty"`
+}
+
+// ExistsClause matches items that have a value for a field
+type ExistsClause struct {
+	Field string `json:"field"`
+}
+
+// BoolClause combines clauses: all of must, at least one of should if there are some, and none of mustNot
+type BoolClause struct {
+	Must    []Clause `json:"must,omitempty"`
+	Should  []Clause `json:"should,omitempty"`
+	MustNot []Clause `json:"mustNot,omitempty"`
+}
+
+// itemFields maps the names of the item fields in clauses to their search field
+// Any other field is an attribute of the contents, nested attributes are separated by dots
+// An attribute with the same name as an item field can be used with a "contents." prefix
+var itemFields = map[string]string{
+	"id":        "item.id",
+	"type":      "item.type",
+	"name":      "item.name",
+	"namespace": "item.ns",
+}
+
+// searchField gives the search field for a clause field
+func searchField(field string) string {
+	if f, ok := itemFields[field]; ok {
+		return f
+	}
+	return strings.TrimPrefix(field, "contents.")
+}
+
+// isItemField is true if the search field is one of the item fields and not an attribute
+func isItemField(field string) bool {
+	return strings.HasPrefix(field, "item.")
+}
+
+// Validate checks that the clause and all its sub clauses are well formed
+func (c Clause) Validate() error {
+	set := 0
+	for _, ok := range []bool{c.Term != nil, c.Prefix != nil, c.Range != nil, c.Exists != nil, c.Bool != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return NewQueryValidationError("a clause must have exactly one of term, prefix, range, exists or bool")
+	}
+	switch {
+	case c.Term != nil:
+		if err := validateField("term", c.Term.Field); err != nil {
+			return err
+		}
+		if !isScalar(c.Term.Value) {
+			return NewQueryValidationError(fmt.Sprintf("term value for %s must be a string, a number or a boolean", c.Term.Field))
+		}
+	case c.Prefix != nil:
+		if err := validateField("prefix", c.Prefix.Field); err != nil {
+			return err
+		}
+		if len(c.Prefix.Value) == 0 {
+			return NewQueryValidationError(fmt.Sprintf("prefix value for %s cannot be empty", c.Prefix.Field))
+		}
+	case c.Range != nil:
+		return c.Range.validate()
+	case c.Exists != nil:
+		return validateField("exists", c.Exists.Field)
+	case c.Bool != nil:
+		if len(c.Bool.Must)+len(c.Bool.Should)+len(c.Bool.MustNot) == 0 {
+			return NewQueryValidationError("bool needs at least one clause")
+		}
+		for _, cs := range [][]Clause{c.Bool.Must, c.Bool.Should, c.Bool.MustNot} {
+			for _, sub := range cs {
+				if err := sub.Validate(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateField(clause string, field string) error {
+	if len(searchField(field)) == 0 {
+		return NewQueryValidationError(fmt.Sprintf("%s needs a field", clause))
+	}
+	return nil
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, float64, bool:
+		return true
+	}
+	return false
+}
+
+func (r *RangeClause) validate() error {
+	if err := validateField("range", r.Field); err != nil {
+		return err
+	}
+	bounds := r.bounds()
+	if len(bounds) == 0 {
+		return NewQueryValidationError(fmt.Sprintf("range on %s needs at least one of gt, gte, lt or lte", r.Field))
+	}
+	var numbers, strs int
+	for _, b := range bounds {
+		switch b.(type) {
+		case float64:
+			numbers++
+		case string:
+			strs++
+		default:
+			return NewQueryValidationError(fmt.Sprintf("range bounds for %s must be numbers or strings", r.Field))
+		}
+	}
+	if numbers > 0 && strs > 0 {
+		return NewQueryValidationError(fmt.Sprintf("range bounds for %s cannot mix numbers and strings", r.Field))
+	}
+	return nil
+}
+
+func (r *RangeClause) bounds() []interface{} {
+	var bounds []interface{}
+	for _, b := range []interface{}{r.Gt, r.Gte, r.Lt, r.Lte} {
+		if b != nil {
+			bounds = append(bounds, b)
+		}
+	}
+	return bounds
+}
+
+// isTextRange is true when the bounds are strings, so that values are compared as strings
+func (r *RangeClause) isTextRange() bool {
+	_, ok := r.bounds()[0].(string)
+	return ok
+}
+
+// scalarString gives the string form of a content value, the one used by the stores that match items themselves
+func scalarString(v interface{}) string {
+	switch tv := v.(type) {
+	case string:
+		return tv
+	case float64:
+		return strconv.FormatFloat(tv, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", tv)
+	}
+}
+
+// fieldValues gives the values of a search field for an item
+func fieldValues(item Item, field string) []string {
+	switch field {
+	case "item.id":
+		return []string{IDToString(item.ID)}
+	case "item.type":
+		return []string{item.Type}
+	case "item.name":
+		return []string{item.Name}
+	case "item.ns":
+		return AllNamespaces(item.ID)
+	default:
+		return contentValues(item.Contents, "", nil)[field]
+	}
+}
+
+// clauseMatcher compiles a validated clause for the stores that match items themselves
+func clauseMatcher(c Clause) matcher {
+	switch {
+	case c.Term != nil:
+		value := scalarString(c.Term.Value)
+		return valuesMatcher{searchField(c.Term.Field), func(v string) bool { return v == value }}
+	case c.Prefix != nil:
+		prefix := c.Prefix.Value
+		return valuesMatcher{searchField(c.Prefix.Field), func(v string) bool { return strings.HasPrefix(v, prefix) }}
+	case c.Range != nil:
+		return valuesMatcher{searchField(c.Range.Field), rangeMatch(c.Range)}
+	case c.Exists != nil:
+		return existsMatcher{searchField(c.Exists.Field)}
+	default:
+		var m andMatcher
+		for _, sub := range c.Bool.Must {
+			m = append(m, clauseMatcher(sub))
+		}
+		if len(c.Bool.Should) > 0 {
+			var should orMatcher
+			for _, sub := range c.Bool.Should {
+				should = append(should, clauseMatcher(sub))
+			}
+			m = append(m, should)
+		}
+		for _, sub := range c.Bool.MustNot {
+			m = append(m, notMatcher{clauseMatcher(sub)})
+		}
+		return m
+	}
+}
+
+// valuesMatcher matches items with at least one value of a field accepted by a test
+type valuesMatcher struct {
+	field string
+	test  func(string) bool
+}
+
+func (m valuesMatcher) match(item Item) bool {
+	for _, v := range fieldValues(item, m.field) {
+		if m.test(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeMatch tests values against the bounds of a range, values that are not numbers never match a numeric range
+func rangeMatch(r *RangeClause) func(string) bool {
+	if r.isTextRange() {
+		return func(v string) bool {
+			return (r.Gt == nil || v > r.Gt.(string)) && (r.Gte == nil || v >= r.Gte.(string)) &&
+				(r.Lt == nil || v < r.Lt.(string)) && (r.Lte == nil || v <= r.Lte.(string))
+		}
+	}
+	return func(s string) bool {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return false
+		}
+		return (r.Gt == nil || v > r.Gt.(float64)) && (r.Gte == nil || v >= r.Gte.(float64)) &&
+			(r.Lt == nil || v < r.Lt.(float64)) && (r.Lte == nil || v <= r.Lte.(float64))
+	}
+}
@@ -2,6 +2,11 @@ package item
 
 import (
 	"encoding/json"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/gocql/gocql"
@@ -18,6 +23,11 @@ type Cassandra struct {
 // CqlStore is a store using Cassandra
 type CqlStore struct {
 	session *gocql.Session
+	// journal adds an outbox entry with every change of an item
+	journal bool
+	// stop interrupts the background tasks, done waits for them
+	stop chan struct{}
+	done sync.WaitGroup
 }
 
 // NewCqlStore creates a new Cassandra Store
@@ -50,17 +60,232 @@ func NewCqlStore(config Cassandra) (*CqlStore, error) {
 	if err != nil {
 		return nil, NewStoreCreationError(err)
 	}
-	err = session.Query("create table if not exists items ( id text, updated uuid, status text, type text, name text, contents text,primary key (id, updated)) WITH CLUSTERING ORDER BY (updated DESC)").
-		Exec()
+	store, err := openCqlStore(session, config.Keyspace)
 	if err != nil {
+		session.Close()
 		return nil, NewStoreCreationError(err)
 	}
-	return &CqlStore{session}, nil
+	return store, nil
+}
+
+// openCqlStore creates the tables that do not exist yet, migrates the ones of previous versions and starts filling
+// the index tables if they were not filled yet
+func openCqlStore(session *gocql.Session, keyspace string) (*CqlStore, error) {
+	err := session.Query("create table if not exists items ( id text, updated uuid, status text, type text, name text, contents text, current_version uuid static, current_status text static, primary key (id, updated)) WITH CLUSTERING ORDER BY (updated DESC)").
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	// the outbox is partitioned by minute and the partitions are listed in order in the buckets table, spread over
+	// a few shards so that writes do not all go to one partition
+	// acknowledged entries are deleted, and a drained partition is removed from the buckets table so that it is not
+	// read again
+	// tombstones are only kept for an hour, entries being short lived
+	err = session.Query("create table if not exists replication_outbox ( bucket bigint, seq timeuuid, id text, primary key (bucket, seq)) WITH CLUSTERING ORDER BY (seq ASC) AND gc_grace_seconds = 3600").
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	err = session.Query("create table if not exists replication_outbox_buckets ( shard int, bucket bigint, primary key (shard, bucket)) WITH CLUSTERING ORDER BY (bucket ASC) AND gc_grace_seconds = 3600").
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	// items are listed through index tables partitioned by parent and by ancestor
+	// index rows are deleted with the items, the ones left by failures are skipped and removed when listing
+	err = session.Query("create table if not exists item_children ( parent text, id text, primary key (parent, id))").
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	err = session.Query("create table if not exists item_descendants ( ancestor text, id text, primary key (ancestor, id))").
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	// the subtree of an item keeps the rows of deleted items, so that a subtree can be restored as it was
+	err = session.Query("create table if not exists item_subtree ( ancestor text, id text, primary key (ancestor, id))").
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	// the state of the index tables, so that filling them is only done once and resumes where it stopped
+	err = session.Query("create table if not exists item_index_state ( name text, done boolean, position text, primary key (name))").
+		Exec()
+	if err != nil {
+		return nil, err
+	}
+	// tables created before conditional writes existed do not have the current version columns
+	// errors are ignored since they mean the columns are already there
+	session.Query("alter table items add current_version uuid static").Exec()
+	session.Query("alter table items add current_status text static").Exec()
+	session.Query("alter table item_index_state add position text").Exec()
+	store := &CqlStore{session: session, stop: make(chan struct{})}
+	if err = store.migrateOutbox(keyspace); err != nil {
+		return nil, err
+	}
+	var done bool
+	var position string
+	err = session.Query("select done, position from item_index_state where name = ?", cqlIndexBackfill).Scan(&done, &position)
+	if err != nil && err != gocql.ErrNotFound {
+		return nil, err
+	}
+	if !done {
+		store.done.Add(1)
+		go store.backfillIndex(position)
+	}
+	return store, nil
+}
+
+// cqlIndexBackfill is the name of the state recording that the index tables were filled from the items table
+const cqlIndexBackfill = "backfill"
+
+// backfillIndex fills the index tables from the items table when they were created on an existing store, in the
+// background, and records how far it went after each batch and when it is complete
+// An interrupted backfill resumes after the last item of the last batch it wrote, in token order
+func (s *CqlStore) backfillIndex(position string) {
+	defer s.done.Done()
+	// rows are sorted by descending update time, so the first row of each partition is the current version
+	query := s.session.Query("select id, updated, status from items per partition limit 1")
+	if len(position) > 0 {
+		log.Printf("Filling the index tables from the items table, after %s", position)
+		query = s.session.Query("select id, updated, status from items where token(id) > token(?) per partition limit 1", position)
+	} else {
+		log.Printf("Filling the index tables from the items table")
+	}
+	iter := query.Iter()
+	var k, status string
+	var updated gocql.UUID
+	var err error
+	batch := s.session.NewBatch(gocql.UnloggedBatch)
+	count := 0
+	for err == nil && iter.Scan(&k, &updated, &status) {
+		select {
+		case <-s.stop:
+			iter.Close()
+			return
+		default:
+		}
+		id := StringToID(k)
+		if status == "ALIVE" {
+			indexQueries(batch, id, updated)
+		} else {
+			// the subtree keeps the deleted items, the other rows written before they were deleted are removed
+			subtreeQueries(batch, id)
+			unindexQueries(batch, id, updated)
+		}
+		count++
+		if count%cqlBatchSize == 0 {
+			err = s.execute(batch)
+			if err == nil {
+				err = s.backfillState(false, k)
+			}
+			batch = s.session.NewBatch(gocql.UnloggedBatch)
+		}
+	}
+	if cerr := iter.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = s.execute(batch)
+	}
+	if err == nil {
+		err = s.backfillState(true, "")
+	}
+	if err != nil {
+		log.Printf("Could not fill the index tables, it will resume on the next start: %v", err)
+		return
+	}
+	log.Printf("Filled the index tables with %d items", count)
+}
+
+// backfillState records whether the index tables are filled, and if not the last item they were filled with
+func (s *CqlStore) backfillState(done bool, position string) error {
+	return s.session.Query("insert into item_index_state (name, done, position) values (?,?,?)", cqlIndexBackfill, done, position).Exec()
+}
+
+// cqlTimestamp gives the write time of the version of an item, in microseconds like Cassandra timestamps
+func cqlTimestamp(version gocql.UUID) int64 {
+	return version.Time().UnixNano() / int64(time.Microsecond)
+}
+
+// indexQueries adds the rows listing an item under its parent and its ancestors to a batch
+// The rows are written at the time of the version of the item, so that they stay deleted if the item was deleted
+// by a more recent version, and are written again if the item is written again after being deleted
+func indexQueries(batch *gocql.Batch, id ID, version gocql.UUID) {
+	if len(id) < 2 || len(id)%2 != 0 {
+		return
+	}
+	k := IDToString(id)
+	ts := cqlTimestamp(version)
+	batch.Query("insert into item_children (parent, id) values (?,?) using timestamp ?", IDToString(ParentID(id)), k, ts)
+	for i := 2; i < len(id); i += 2 {
+		batch.Query("insert into item_descendants (ancestor, id) values (?,?) using timestamp ?", IDToString(id[:i]), k, ts)
+	}
+	subtreeQueries(batch, id)
+}
+
+// subtreeQueries adds the rows listing an item in the subtrees of its ancestors to a batch, they are never deleted
+func subtreeQueries(batch *gocql.Batch, id ID) {
+	if len(id) < 2 || len(id)%2 != 0 {
+		return
+	}
+	k := IDToString(id)
+	for i := 2; i < len(id); i += 2 {
+		batch.Query("insert into item_subtree (ancestor, id) values (?,?)", IDToString(id[:i]), k)
+	}
+}
+
+// unindexQueries adds the deletion of the rows listing an item under its parent and its ancestors to a batch, at
+// the time of the version deleting the item
+func unindexQueries(batch *gocql.Batch, id ID, version gocql.UUID) {
+	unindexQueriesAt(batch, id, cqlTimestamp(version))
+}
+
+// unindexQueriesAt adds the deletion of the rows listing an item written before the given Cassandra timestamp
+func unindexQueriesAt(batch *gocql.Batch, id ID, ts int64) {
+	if len(id) < 2 || len(id)%2 != 0 {
+		return
+	}
+	k := IDToString(id)
+	batch.Query("delete from item_children using timestamp ? where parent = ? and id = ?", ts, IDToString(ParentID(id)), k)
+	for i := 2; i < len(id); i += 2 {
+		batch.Query("delete from item_descendants using timestamp ? where ancestor = ? and id = ?", ts, IDToString(id[:i]), k)
+	}
+}
+
+// index adds the items to the index tables, once the items are written
+func (s *CqlStore) index(ids []ID, versions []gocql.UUID) error {
+	batch := s.session.NewBatch(gocql.UnloggedBatch)
+	for i, id := range ids {
+		indexQueries(batch, id, versions[i])
+	}
+	return s.execute(batch)
+}
+
+// unindex removes an item deleted at the given version from the index tables
+func (s *CqlStore) unindex(id ID, version gocql.UUID) error {
+	batch := s.session.NewBatch(gocql.UnloggedBatch)
+	unindexQueries(batch, id, version)
+	return s.execute(batch)
+}
+
+// execute runs a batch unless it is empty
+func (s *CqlStore) execute(batch *gocql.Batch) error {
+	if batch.Size() == 0 {
+		return nil
+	}
+	if err := s.session.ExecuteBatch(batch); err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
 }
 
 //Close the store
 func (s *CqlStore) Close() error {
 	if s.session != nil {
+		close(s.stop)
+		s.done.Wait()
 		s.session.Close()
 		s.session = nil
 	}
@@ -68,25 +293,458 @@ func (s *CqlStore) Close() error {
 }
 
 // Write stores an item in the store
+// Like all the changes of the current version of an item, it is a conditional update, since Cassandra cannot mix
+// conditional and plain updates of the same columns
 func (s *CqlStore) Write(item Item) error {
-	if item.IsEmpty() {
-		return NewEmptyItemError()
+	return s.writeItem(item, "")
+}
+
+// Journal makes the store add an outbox entry with every change of an item, before and after conditional changes
+// and in the same logged batch as atomic changes
+func (s *CqlStore) Journal() {
+	s.journal = true
+}
+
+// journalQuery adds the outbox entry of a changed item to a batch, if the changes are journaled
+func (s *CqlStore) journalQuery(batch *gocql.Batch, id ID) {
+	if s.journal {
+		outboxQueries(batch, gocql.TimeUUID(), id)
 	}
+}
+
+// cqlBatchSize is the maximum number of items written in one Cassandra batch
+const cqlBatchSize = 50
+
+// WriteBatch writes items one by one, since the conditional update of the current version of an item cannot be
+// batched with other partitions
+func (s *CqlStore) WriteBatch(items []Item) []error {
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = s.writeItem(item, "")
+	}
+	return errs
+}
+
+// WriteAll writes all items in one logged batch, so that Cassandra applies all of them or none
+func (s *CqlStore) WriteAll(items []Item) error {
+	return s.ChangeAll(items, nil)
+}
+
+// ChangeAll writes all items and deletes the others in one logged batch, so that Cassandra applies all of them or none
+// The current versions cannot be in a batch spanning partitions, they are set afterwards by conditional updates
+func (s *CqlStore) ChangeAll(items []Item, deleted []ID) error {
 	if s.session == nil {
 		return NewStoreClosedError()
 	}
+	batch := s.session.NewBatch(gocql.LoggedBatch)
+	var ids []ID
+	var versions []gocql.UUID
+	var statuses []string
+	for _, item := range items {
+		if item.IsEmpty() {
+			return NewEmptyItemError()
+		}
+		b, err := json.Marshal(item.Contents)
+		if err != nil {
+			return NewItemMarshallError(err)
+		}
+		updated := gocql.TimeUUID()
+		batch.Query("insert into items (id, updated, status, type, name, contents) values(?,?,?,?,?,?)",
+			IDToString(item.ID), updated, "ALIVE", item.Type, item.Name, string(b))
+		indexQueries(batch, item.ID, updated)
+		s.journalQuery(batch, item.ID)
+		ids, versions, statuses = append(ids, item.ID), append(versions, updated), append(statuses, "ALIVE")
+	}
+	for _, id := range deleted {
+		updated := gocql.TimeUUID()
+		batch.Query("insert into items (id, updated, status) values(?,?,?)", IDToString(id), updated, "DELETED")
+		unindexQueries(batch, id, updated)
+		s.journalQuery(batch, id)
+		ids, versions, statuses = append(ids, id), append(versions, updated), append(statuses, "DELETED")
+	}
+	err := s.session.ExecuteBatch(batch)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	for i, id := range ids {
+		if err = s.advanceCurrent(id, versions[i], statuses[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advanceCurrent makes a version written outside of a conditional batch the current version of an item, unless a
+// more recent version is already current
+func (s *CqlStore) advanceCurrent(id ID, updated gocql.UUID, status string) error {
+	for attempt := 0; attempt < cqlCasAttempts; attempt++ {
+		var current gocql.UUID
+		err := s.session.Query("select current_version from items where id = ? limit 1", IDToString(id)).Scan(&current)
+		if err != nil && err != gocql.ErrNotFound {
+			return errors.Wrap(err, 0)
+		}
+		condition := "if current_version = ?"
+		conditionValues := []interface{}{current}
+		if current == (gocql.UUID{}) {
+			condition = "if current_version = null"
+			conditionValues = nil
+		} else if !current.Time().Before(updated.Time()) {
+			return nil
+		}
+		applied, err := s.session.Query("update items set current_version = ?, current_status = ? where id = ? "+condition,
+			append([]interface{}{updated, status, IDToString(id)}, conditionValues...)...).
+			MapScanCAS(make(map[string]interface{}))
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		if applied {
+			return nil
+		}
+	}
+	return NewVersionConflictError(id, updated.String())
+}
+
+// WriteIf stores an item in the store if its current version is the given one
+func (s *CqlStore) WriteIf(item Item, version string) error {
+	return s.writeItem(item, version)
+}
+
+// writeItem stores an item in a conditional batch, expecting the given version or any state if it is empty
+// The index rows cannot be in the conditional batch, they are written once the item is
+func (s *CqlStore) writeItem(item Item, version string) error {
+	if item.IsEmpty() {
+		return NewEmptyItemError()
+	}
 	b, err := json.Marshal(item.Contents)
 	if err != nil {
 		return NewItemMarshallError(err)
 	}
-	err = s.session.Query("insert into items (id, updated, status, type, name, contents) values(?,now(),?,?,?,?)",
-		IDToString(item.ID), "ALIVE", item.Type, item.Name, string(b)).Exec()
+	updated := gocql.TimeUUID()
+	err = s.writeIf(item.ID, updated, version, "ALIVE", "insert into items (id, updated, status, type, name, contents) values(?,?,?,?,?,?)",
+		"ALIVE", item.Type, item.Name, string(b))
+	if err != nil {
+		return err
+	}
+	return s.index([]ID{item.ID}, []gocql.UUID{updated})
+}
+
+// DeleteIf marks an item as deleted if its current version is the given one
+func (s *CqlStore) DeleteIf(id ID, version string) error {
+	if version == NoVersion {
+		return NewVersionConflictError(id, version)
+	}
+	return s.deleteItem(id, version)
+}
+
+// deleteItem marks an item as deleted in a conditional batch, expecting the given version or any state if it is empty
+func (s *CqlStore) deleteItem(id ID, version string) error {
+	updated := gocql.TimeUUID()
+	err := s.writeIf(id, updated, version, "DELETED", "insert into items (id, updated, status) values(?,?,?)", "DELETED")
+	if err != nil {
+		return err
+	}
+	// the index rows cannot be in the conditional batch, rows left by a failure are removed when listing
+	if err = s.unindex(id, updated); err != nil {
+		log.Printf("Could not remove %s from the index tables: %v", IDToString(id), err)
+	}
+	return nil
+}
+
+// cqlCasAttempts is the number of times a conditional update is tried when other writes change the item in between
+const cqlCasAttempts = 3
+
+// casCondition gives the condition on the current status and version of an item expected by a conditional batch
+// An empty version accepts any state
+func casCondition(id ID, version string) (string, []interface{}, error) {
+	switch version {
+	case "":
+		return "if current_status in (?,?)", []interface{}{"ALIVE", "DELETED"}, nil
+	case NoVersion:
+		return "if current_status = ?", []interface{}{"DELETED"}, nil
+	case AnyVersion:
+		return "if current_status = ?", []interface{}{"ALIVE"}, nil
+	}
+	expected, err := gocql.ParseUUID(version)
+	if err != nil {
+		return "", nil, NewVersionConflictError(id, version)
+	}
+	return "if current_status = ? and current_version = ?", []interface{}{"ALIVE", expected}, nil
+}
+
+// writeIf inserts a new version and updates the current version in a conditional batch on the item partition
+func (s *CqlStore) writeIf(id ID, updated gocql.UUID, version string, status string, insert string, values ...interface{}) error {
+	if s.session == nil {
+		return NewStoreClosedError()
+	}
+	condition, conditionValues, err := casCondition(id, version)
+	if err != nil {
+		return err
+	}
+	// a conditional batch cannot span partitions, so the outbox entry is added before the change, in case the process
+	// stops right after it, and again after it, in case the first entry is replicated before the change is applied
+	if s.journal {
+		if err := s.Enqueue(id); err != nil {
+			return err
+		}
+	}
+	var applied bool
+	for attempt := 0; attempt < cqlCasAttempts; attempt++ {
+		var previous map[string]interface{}
+		applied, previous, err = s.casBatch(id, updated, status, condition, conditionValues, insert, values)
+		if currentStatus, _ := previous["current_status"].(string); err != nil || applied || len(currentStatus) > 0 {
+			break
+		}
+		// items written before conditional writes existed have no current version yet, nor items that never existed,
+		// the update is tried again in case another write sets it in between
+		var st Status
+		if st, err = ReadStatus(s, id); err != nil || !isExpectedVersion(st, version) {
+			break
+		}
+		applied, _, err = s.casBatch(id, updated, status, "if current_status = null", nil, insert, values)
+		if err != nil || applied {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	if !applied {
+		return NewVersionConflictError(id, version)
+	}
+	if s.journal {
+		if err = s.Enqueue(id); err != nil {
+			// the change is written, only a replication of the first entry before the change could miss it
+			log.Printf("Could not journal the change of %s: %v", IDToString(id), err)
+		}
+	}
+	return nil
+}
+
+func (s *CqlStore) casBatch(id ID, updated gocql.UUID, status string, condition string, conditionValues []interface{}, insert string, values []interface{}) (bool, map[string]interface{}, error) {
+	batch := s.session.NewBatch(gocql.LoggedBatch)
+	batch.Query(insert, append([]interface{}{IDToString(id), updated}, values...)...)
+	batch.Query("update items set current_version = ?, current_status = ? where id = ? "+condition,
+		append([]interface{}{updated, status, IDToString(id)}, conditionValues...)...)
+	previous := make(map[string]interface{})
+	applied, iter, err := s.session.MapExecuteBatchCAS(batch, previous)
+	if iter != nil {
+		iter.Close()
+	}
+	return applied, previous, err
+}
+
+// outboxBucketSize is the time span of the entries of one partition of the outbox table
+const outboxBucketSize = time.Minute
+
+// outboxShards is the number of partitions of the buckets table
+const outboxShards = 8
+
+// outboxSkew is how late entries may be written after the time of their sequence, a partition of the outbox table
+// is only removed from the buckets table once that time is over
+const outboxSkew = 5 * time.Minute
+
+// outboxBucket returns the partition of an outbox entry, from the time of its sequence
+func outboxBucket(seq gocql.UUID) int64 {
+	return seq.Time().UnixNano() / int64(outboxBucketSize)
+}
+
+// outboxShard returns the partition of the buckets table listing the partition of an entry of the given item
+func outboxShard(id ID) int {
+	h := fnv.New32a()
+	h.Write([]byte(IDToString(id)))
+	return int(h.Sum32() % outboxShards)
+}
+
+// outboxShardList lists all the partitions of the buckets table
+func outboxShardList() []int {
+	shards := make([]int, outboxShards)
+	for i := range shards {
+		shards[i] = i
+	}
+	return shards
+}
+
+// outboxQueries adds an outbox entry and its partition to a batch
+func outboxQueries(batch *gocql.Batch, seq gocql.UUID, id ID) {
+	bucket := outboxBucket(seq)
+	batch.Query("insert into replication_outbox (bucket, seq, id) values (?,?,?)", bucket, seq, IDToString(id))
+	batch.Query("insert into replication_outbox_buckets (shard, bucket) values (?,?)", outboxShard(id), bucket)
+}
+
+// migrateOutbox moves the entries of the single partition outbox table of previous versions to the bucketed one
+func (s *CqlStore) migrateOutbox(keyspace string) error {
+	ks, err := s.session.KeyspaceMetadata(keyspace)
+	if err != nil {
+		return err
+	}
+	if _, ok := ks.Tables["outbox"]; !ok {
+		return nil
+	}
+	iter := s.session.Query("select seq, id from outbox where bucket = 0").Iter()
+	var seq gocql.UUID
+	var id string
+	for iter.Scan(&seq, &id) {
+		batch := s.session.NewBatch(gocql.LoggedBatch)
+		outboxQueries(batch, seq, StringToID(id))
+		if err = s.session.ExecuteBatch(batch); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return err
+	}
+	return s.session.Query("drop table if exists outbox").Exec()
+}
+
+// Enqueue adds an entry for the given item to the outbox table
+func (s *CqlStore) Enqueue(id ID) error {
+	if s.session == nil {
+		return NewStoreClosedError()
+	}
+	batch := s.session.NewBatch(gocql.LoggedBatch)
+	outboxQueries(batch, gocql.TimeUUID(), id)
+	err := s.session.ExecuteBatch(batch)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
+
+// outboxBuckets returns the partitions of the outbox table that may have entries, oldest first
+func (s *CqlStore) outboxBuckets() ([]int64, error) {
+	iter := s.session.Query("select bucket from replication_outbox_buckets where shard in ?", outboxShardList()).Iter()
+	seen := make(map[int64]bool)
+	var buckets []int64
+	var bucket int64
+	for iter.Scan(&bucket) {
+		if !seen[bucket] {
+			seen[bucket] = true
+			buckets = append(buckets, bucket)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	return buckets, nil
+}
+
+// Pending returns the oldest entries of the outbox table after the given sequence
+func (s *CqlStore) Pending(after string, limit int) ([]OutboxEntry, error) {
+	entries := []OutboxEntry{}
+	if s.session == nil {
+		return entries, NewStoreClosedError()
+	}
+	var afterSeq gocql.UUID
+	var afterBucket int64
+	if len(after) > 0 {
+		var err error
+		afterSeq, err = gocql.ParseUUID(after)
+		if err != nil {
+			return entries, errors.Wrap(err, 0)
+		}
+		afterBucket = outboxBucket(afterSeq)
+	}
+	buckets, err := s.outboxBuckets()
+	if err != nil {
+		return entries, err
+	}
+	for _, bucket := range buckets {
+		if bucket < afterBucket {
+			continue
+		}
+		query := s.session.Query("select seq, id from replication_outbox where bucket = ? limit ?", bucket, limit-len(entries))
+		if len(after) > 0 && bucket == afterBucket {
+			query = s.session.Query("select seq, id from replication_outbox where bucket = ? and seq > ? limit ?",
+				bucket, afterSeq, limit-len(entries))
+		}
+		iter := query.Iter()
+		var seq gocql.UUID
+		var id string
+		for iter.Scan(&seq, &id) {
+			entries = append(entries, OutboxEntry{StringToID(id), seq.String(), seq.Time()})
+		}
+		if err := iter.Close(); err != nil {
+			return entries, errors.Wrap(err, 0)
+		}
+		if len(entries) == limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// Ack removes replicated entries from the outbox table
+func (s *CqlStore) Ack(entries []OutboxEntry) error {
+	if s.session == nil {
+		return NewStoreClosedError()
+	}
+	batch := s.session.NewBatch(gocql.UnloggedBatch)
+	buckets := make(map[int64]bool)
+	for _, e := range entries {
+		seq, err := gocql.ParseUUID(e.Seq)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		bucket := outboxBucket(seq)
+		batch.Query("delete from replication_outbox where bucket = ? and seq = ?", bucket, seq)
+		buckets[bucket] = true
+	}
+	err := s.session.ExecuteBatch(batch)
 	if err != nil {
 		return errors.Wrap(err, 0)
 	}
+	return s.dropOutboxBuckets(buckets)
+}
+
+// dropOutboxBuckets removes the past partitions of the outbox table that have no entry left from the buckets table
+// Their entries are deleted one by one when acknowledged, the partition itself is not deleted so that an entry
+// written late is not hidden, and it is only removed from the buckets table once entries cannot be written late
+// anymore, a late entry listing it again otherwise
+func (s *CqlStore) dropOutboxBuckets(buckets map[int64]bool) error {
+	last := time.Now().Add(-outboxSkew).UnixNano() / int64(outboxBucketSize)
+	for bucket := range buckets {
+		if bucket >= last {
+			continue
+		}
+		var seq gocql.UUID
+		err := s.session.Query("select seq from replication_outbox where bucket = ? limit 1", bucket).Scan(&seq)
+		if err == nil {
+			continue
+		}
+		if err != gocql.ErrNotFound {
+			return errors.Wrap(err, 0)
+		}
+		err = s.session.Query("delete from replication_outbox_buckets where shard in ? and bucket = ?", outboxShardList(), bucket).Exec()
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
 	return nil
 }
 
+// Size returns the number of entries in the outbox table
+func (s *CqlStore) Size() (int, error) {
+	if s.session == nil {
+		return 0, NewStoreClosedError()
+	}
+	buckets, err := s.outboxBuckets()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, bucket := range buckets {
+		var count int
+		err := s.session.Query("select count(*) from replication_outbox where bucket = ?", bucket).Scan(&count)
+		if err != nil {
+			return 0, errors.Wrap(err, 0)
+		}
+		total += count
+	}
+	return total, nil
+}
+
 // Read reads the latest version of an item
 func (s *CqlStore) Read(id ID) (Item, error) {
 	var item Item
@@ -105,11 +763,28 @@ func (s *CqlStore) History(id ID, limit int) ([]Status, error) {
 	if s.session == nil {
 		return []Status{}, NewStoreClosedError()
 	}
+	return s.statuses(id, s.session.Query("select updated, status, type, name, contents from items where id=? order by updated desc limit ?", IDToString(id), limit))
+}
+
+// ReadAt reads the version of an item that was current at the given time
+func (s *CqlStore) ReadAt(id ID, at time.Time) (Status, error) {
+	if s.session == nil {
+		return Status{}, NewStoreClosedError()
+	}
+	sts, err := s.statuses(id, s.session.Query("select updated, status, type, name, contents from items where id=? and updated <= ? order by updated desc limit 1", IDToString(id), gocql.MaxTimeUUID(at)))
+	if err != nil || len(sts) == 0 {
+		return Status{}, err
+	}
+	return sts[0], nil
+}
+
+func (s *CqlStore) statuses(id ID, query *gocql.Query) ([]Status, error) {
 	var items []Status
 	var errors []string
-	iter := s.session.Query("select status, type, name, contents from items where id=? order by updated desc limit ?", IDToString(id), limit).Iter()
+	iter := query.Iter()
+	var updated gocql.UUID
 	var status, ttype, name, contents string
-	for iter.Scan(&status, &ttype, &name, &contents) {
+	for iter.Scan(&updated, &status, &ttype, &name, &contents) {
 		var cnts map[string]interface{}
 		var err error
 		if len(contents) > 0 {
@@ -118,7 +793,7 @@ func (s *CqlStore) History(id ID, limit int) ([]Status, error) {
 		if err != nil {
 			errors = append(errors, NewItemUnmarshallError(err).Error())
 		} else {
-			items = append(items, Status{Item{id, ttype, name, cnts}, status})
+			items = append(items, Status{Item{id, ttype, name, cnts}, status, updated.String(), updated.Time()})
 		}
 
 	}
@@ -128,15 +803,193 @@ func (s *CqlStore) History(id ID, limit int) ([]Status, error) {
 	return items, NewMultipleItemErrors(errors)
 }
 
+// ScanIDs sends the IDs of all the items in the store, including deleted ones
+// This is a full table scan
+func (s *CqlStore) ScanIDs(idChannel chan ID, errorChannel chan error) {
+	defer close(idChannel)
+	if s.session == nil {
+		errorChannel <- NewStoreClosedError()
+		return
+	}
+	iter := s.session.Query("select distinct id from items").Iter()
+	var id string
+	for iter.Scan(&id) {
+		idChannel <- StringToID(id)
+	}
+	if err := iter.Close(); err != nil {
+		errorChannel <- NewStoreInternalError(err)
+	}
+}
+
+// ScanItems sends the current version of all the items that are not deleted, reading the whole items table
+func (s *CqlStore) ScanItems(itemChannel chan Item, errorChannel chan error) {
+	scanItems(s, itemChannel, errorChannel)
+}
+
+// ScanStatuses sends the current status of all the items that are not deleted, reading the whole items table
+func (s *CqlStore) ScanStatuses(statusChannel chan Status, errorChannel chan error) {
+	defer close(statusChannel)
+	if s.session == nil {
+		errorChannel <- NewStoreClosedError()
+		return
+	}
+	// rows are sorted by descending update time, so the first row of each partition is the current version
+	iter := s.session.Query("select id, updated, status, type, name, contents from items per partition limit 1").Iter()
+	var errors []string
+	var id, status, ttype, name, contents string
+	var updated gocql.UUID
+	for iter.Scan(&id, &updated, &status, &ttype, &name, &contents) {
+		if status != "ALIVE" {
+			continue
+		}
+		var cnts map[string]interface{}
+		if len(contents) > 0 {
+			if err := json.Unmarshal([]byte(contents), &cnts); err != nil {
+				errors = append(errors, NewItemUnmarshallError(err).Error())
+				continue
+			}
+		}
+		statusChannel <- Status{Item{StringToID(id), ttype, name, cnts}, status, updated.String(), updated.Time()}
+	}
+	if err := iter.Close(); err != nil {
+		errors = append(errors, NewStoreInternalError(err).Error())
+	}
+	if err := NewMultipleItemErrors(errors); err != nil {
+		errorChannel <- err
+	}
+}
+
+// Children returns a page of the current items directly under the given item
+func (s *CqlStore) Children(id ID, cursor string, limit int) ([]Item, string, error) {
+	return s.list("select id from item_children where parent = ? and id > ? limit ?", id, cursor, limit)
+}
+
+// Descendants returns a page of the current items in the namespace of the given item
+func (s *CqlStore) Descendants(id ID, cursor string, limit int) ([]Item, string, error) {
+	return s.list("select id from item_descendants where ancestor = ? and id > ? limit ?", id, cursor, limit)
+}
+
+// SubtreeIDs returns the IDs of all the items ever stored under the given item, from the subtree index
+func (s *CqlStore) SubtreeIDs(id ID) ([]ID, error) {
+	if s.session == nil {
+		return nil, NewStoreClosedError()
+	}
+	iter := s.session.Query("select id from item_subtree where ancestor = ?", IDToString(id)).Iter()
+	var ids []ID
+	var k string
+	for iter.Scan(&k) {
+		ids = append(ids, StringToID(k))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, NewStoreInternalError(err)
+	}
+	return ids, nil
+}
+
+// list reads the IDs from an index table page by page, skipping the deleted items, until the page of items is full
+func (s *CqlStore) list(query string, id ID, cursor string, limit int) ([]Item, string, error) {
+	items := []Item{}
+	if s.session == nil {
+		return items, "", NewStoreClosedError()
+	}
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return items, "", err
+	}
+	for {
+		iter := s.session.Query(query, IDToString(id), after, limit).Iter()
+		var ids []string
+		var k string
+		for iter.Scan(&k) {
+			ids = append(ids, k)
+		}
+		if err = iter.Close(); err != nil {
+			return items, "", NewStoreInternalError(err)
+		}
+		sts, err := s.latestStatuses(ids)
+		if err != nil {
+			return items, "", err
+		}
+		for _, k := range ids {
+			st, ok := sts[k]
+			if !ok {
+				s.unindexOrphan(StringToID(k))
+				continue
+			}
+			if st.Status != "ALIVE" {
+				s.unindexDeleted(st)
+				continue
+			}
+			items = append(items, st.Item)
+			if len(items) == limit {
+				return items, encodeCursor(st.Item.ID), nil
+			}
+		}
+		if len(ids) < limit {
+			return items, "", nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// latestStatuses reads the latest version of the given items in one query, by ID, items without history being missing
+func (s *CqlStore) latestStatuses(ids []string) (map[string]Status, error) {
+	sts := make(map[string]Status)
+	if len(ids) == 0 {
+		return sts, nil
+	}
+	var errors []string
+	iter := s.session.Query("select id, updated, status, type, name, contents from items where id in ? per partition limit 1", ids).Iter()
+	var updated gocql.UUID
+	var k, status, ttype, name, contents string
+	for iter.Scan(&k, &updated, &status, &ttype, &name, &contents) {
+		var cnts map[string]interface{}
+		var err error
+		if len(contents) > 0 {
+			err = json.Unmarshal([]byte(contents), &cnts)
+		}
+		if err != nil {
+			errors = append(errors, NewItemUnmarshallError(err).Error())
+		} else {
+			sts[k] = Status{Item{StringToID(k), ttype, name, cnts}, status, updated.String(), updated.Time()}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		errors = append(errors, NewStoreInternalError(err).Error())
+	}
+	return sts, NewMultipleItemErrors(errors)
+}
+
+// unindexDeleted removes the rows of a deleted item that are still in the index tables, like when removing them
+// failed after a conditional delete
+func (s *CqlStore) unindexDeleted(st Status) {
+	version, err := gocql.ParseUUID(st.Version)
+	if err == nil {
+		err = s.unindex(st.Item.ID, version)
+	}
+	if err != nil {
+		log.Printf("Could not remove %s from the index tables: %v", IDToString(st.Item.ID), err)
+	}
+}
+
+// cqlOrphanAge is how old index rows of items that have no history must be to be removed, so that the rows of items
+// being written in a batch are kept
+const cqlOrphanAge = time.Minute
+
+// unindexOrphan removes the rows of an item that has no history from the index tables, like when writing the item
+// failed after its rows were written by a previous version of the store
+func (s *CqlStore) unindexOrphan(id ID) {
+	batch := s.session.NewBatch(gocql.UnloggedBatch)
+	unindexQueriesAt(batch, id, time.Now().Add(-cqlOrphanAge).UnixNano()/int64(time.Microsecond))
+	if err := s.execute(batch); err != nil {
+		log.Printf("Could not remove %s from the index tables: %v", IDToString(id), err)
+	}
+}
+
 // Delete marks an item as deleted
 func (s *CqlStore) Delete(id ID) error {
 	if s.session == nil {
 		return NewStoreClosedError()
 	}
-	err := s.session.Query("insert into items (id, updated, status) values(?,now(),?)",
-		IDToString(id), "DELETED").Exec()
-	if err != nil {
-		return errors.Wrap(err, 0)
-	}
-	return nil
+	return s.deleteItem(id, "")
 }
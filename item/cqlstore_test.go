@@ -1,8 +1,11 @@
 package item
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/stretchr/testify/require"
 )
 
@@ -27,3 +30,200 @@ func TestCqlStore(t *testing.T) {
 func TestCqlStoreErrors(t *testing.T) {
 	DoTestStoreErrors(getCqlStore(t), t)
 }
+
+func TestCqlStoreReadAt(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestTimeTravelStore(store, store, t)
+}
+
+func TestCqlStoreConditional(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestConditionalStore(store, store, t)
+}
+
+func TestCqlStoreWriteBatch(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestWriteBatch(store, t)
+}
+
+func TestCqlStoreAtomic(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestAtomicStore(store, store, t)
+}
+
+func TestCqlStoreOutbox(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestOutboxStore(store, t)
+}
+
+func TestCqlStoreOutboxBuckets(t *testing.T) {
+	require := require.New(t)
+	store := getCqlStore(t)
+	defer store.Close()
+	// entries of different items are listed in different shards
+	shards := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		shards[outboxShard([]string{"Team", fmt.Sprintf("Bucket%d", i)})] = true
+	}
+	require.True(len(shards) > 1)
+
+	// a drained old partition is not listed anymore, an entry written late lists it again
+	id := []string{"Team", "Bucket1"}
+	at := time.Now().Add(-time.Hour)
+	write := func(seq gocql.UUID) {
+		batch := store.session.NewBatch(gocql.LoggedBatch)
+		outboxQueries(batch, seq, id)
+		require.NoError(store.session.ExecuteBatch(batch))
+	}
+	pending := func(seq gocql.UUID) bool {
+		entries, err := store.Pending("", 1000)
+		require.NoError(err)
+		for _, e := range entries {
+			if e.Seq == seq.String() {
+				return true
+			}
+		}
+		return false
+	}
+	seq1 := gocql.UUIDFromTime(at)
+	write(seq1)
+	require.True(pending(seq1))
+	require.NoError(store.Ack([]OutboxEntry{{id, seq1.String(), seq1.Time()}}))
+	buckets, err := store.outboxBuckets()
+	require.NoError(err)
+	require.NotContains(buckets, outboxBucket(seq1))
+	seq2 := gocql.UUIDFromTime(at)
+	write(seq2)
+	require.True(pending(seq2))
+	require.NoError(store.Ack([]OutboxEntry{{id, seq2.String(), seq2.Time()}}))
+}
+
+func TestCqlStoreScanItems(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestScanItems(store, store, t)
+}
+
+func TestCqlStoreList(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestListStore(store, store, t)
+}
+
+func TestCqlStoreSubtreeAt(t *testing.T) {
+	store := getCqlStore(t)
+	defer store.Close()
+	DoTestSubtreeAt(store, store, t)
+}
+
+func TestCqlStoreUnindex(t *testing.T) {
+	require := require.New(t)
+	store := getCqlStore(t)
+	defer store.Close()
+	child1 := Item{[]string{"Team", "Unindex1", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{}}
+	child2 := Item{[]string{"Team", "Unindex1", "Member", "Member2"}, "Member", "Member2", map[string]interface{}{}}
+	require.NoError(store.Write(child1))
+	require.NoError(store.Write(child2))
+	countRows := func() int {
+		var count int
+		require.NoError(store.session.Query("select count(*) from item_children where parent = ?", "Team/Unindex1").Scan(&count))
+		return count
+	}
+	require.Equal(2, countRows())
+	require.NoError(store.Delete(child1.ID))
+	require.Equal(1, countRows())
+	require.NoError(store.DeleteIf(child2.ID, AnyVersion))
+	require.Equal(0, countRows())
+	// written again after being deleted
+	require.NoError(store.Write(child1))
+	require.Equal(1, countRows())
+	require.NoError(store.Delete(child1.ID))
+}
+
+func TestCqlStoreCurrentVersion(t *testing.T) {
+	require := require.New(t)
+	store := getCqlStore(t)
+	defer store.Close()
+	item1 := Item{[]string{"Team", "Current1"}, "Team", "Current1", map[string]interface{}{"field1": "value1"}}
+	// plain and atomic writes change the current version checked by conditional writes
+	for _, write := range []func(Item) error{store.Write, func(it Item) error { return store.WriteAll([]Item{it}) }} {
+		require.NoError(write(item1))
+		st1, err := ReadStatus(store, item1.ID)
+		require.NoError(err)
+		require.NoError(write(item1))
+		require.True(IsVersionConflict(store.WriteIf(item1, st1.Version)))
+		st2, err := ReadStatus(store, item1.ID)
+		require.NoError(err)
+		require.NoError(store.WriteIf(item1, st2.Version))
+	}
+	require.NoError(store.Delete(item1.ID))
+	require.True(IsVersionConflict(store.WriteIf(item1, AnyVersion)))
+	require.NoError(store.WriteIf(item1, NoVersion))
+	require.NoError(store.ChangeAll(nil, []ID{item1.ID}))
+	require.True(IsVersionConflict(store.DeleteIf(item1.ID, AnyVersion)))
+}
+
+func TestCqlStoreOrphanIndex(t *testing.T) {
+	require := require.New(t)
+	store := getCqlStore(t)
+	defer store.Close()
+	old := time.Now().Add(-time.Hour).UnixNano() / int64(time.Microsecond)
+	require.NoError(store.session.Query("insert into item_children (parent, id) values (?,?) using timestamp ?",
+		"Team/Orphan1", "Team/Orphan1/Member/Member1", old).Exec())
+	children, _, err := store.Children([]string{"Team", "Orphan1"}, "", 10)
+	require.NoError(err)
+	require.Empty(children)
+	var count int
+	require.NoError(store.session.Query("select count(*) from item_children where parent = ?", "Team/Orphan1").Scan(&count))
+	require.Equal(0, count)
+}
+
+func TestCqlStoreBackfill(t *testing.T) {
+	require := require.New(t)
+	store := getCqlStore(t)
+	child := Item{[]string{"Team", "Backfill1", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{}}
+	require.NoError(store.Write(child))
+	defer store.Delete(child.ID)
+	require.NoError(store.session.Query("delete from item_children where parent = ?", "Team/Backfill1").Exec())
+	require.NoError(store.session.Query("delete from item_index_state where name = ?", cqlIndexBackfill).Exec())
+	require.NoError(store.Close())
+
+	store = getCqlStore(t)
+	defer store.Close()
+	require.Eventually(func() bool {
+		var done bool
+		store.session.Query("select done from item_index_state where name = ?", cqlIndexBackfill).Scan(&done)
+		return done
+	}, time.Minute, 10*time.Millisecond)
+	items, _, err := store.Children([]string{"Team", "Backfill1"}, "", 10)
+	require.NoError(err)
+	require.Equal([]Item{child}, items)
+}
+
+func TestCqlStoreBackfillResume(t *testing.T) {
+	require := require.New(t)
+	store := getCqlStore(t)
+	child := Item{[]string{"Team", "Resume1", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{}}
+	require.NoError(store.Write(child))
+	require.NoError(store.session.Query("delete from item_children where parent = ?", "Team/Resume1").Exec())
+	// the backfill stopped after the item, it is not indexed again
+	require.NoError(store.backfillState(false, IDToString(child.ID)))
+	require.NoError(store.Close())
+
+	store = getCqlStore(t)
+	defer store.Close()
+	defer store.Delete(child.ID)
+	require.Eventually(func() bool {
+		var done bool
+		store.session.Query("select done from item_index_state where name = ?", cqlIndexBackfill).Scan(&done)
+		return done
+	}, time.Minute, 10*time.Millisecond)
+	items, _, err := store.Children([]string{"Team", "Resume1"}, "", 10)
+	require.NoError(err)
+	require.Empty(items)
+}
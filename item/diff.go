@@ -0,0 +1,109 @@
+package item
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change is a difference on one field between two versions of an item
+// The path is "name", "type" or "contents" followed by the keys inside the contents
+type Change struct {
+	Path []string    `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Diff lists the fields added, removed and changed between two versions of an item
+type Diff struct {
+	ID      ID       `json:"id"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Added   []Change `json:"added"`
+	Removed []Change `json:"removed"`
+	Changed []Change `json:"changed"`
+}
+
+// DiffItems compares two items, going down into nested maps inside the contents
+func DiffItems(from Item, to Item) Diff {
+	d := Diff{ID: to.ID, Added: []Change{}, Removed: []Change{}, Changed: []Change{}}
+	if len(d.ID) == 0 {
+		d.ID = from.ID
+	}
+	d.diffValue([]string{"name"}, from.Name, to.Name, len(from.Name) > 0, len(to.Name) > 0)
+	d.diffValue([]string{"type"}, from.Type, to.Type, len(from.Type) > 0, len(to.Type) > 0)
+	d.diffMaps([]string{"contents"}, from.Contents, to.Contents)
+	for _, cs := range [][]Change{d.Added, d.Removed, d.Changed} {
+		sort.Slice(cs, func(i, j int) bool {
+			return strings.Join(cs[i].Path, "/") < strings.Join(cs[j].Path, "/")
+		})
+	}
+	return d
+}
+
+func (d *Diff) diffMaps(path []string, from map[string]interface{}, to map[string]interface{}) {
+	for k, v := range from {
+		v2, ok := to[k]
+		d.diffValue(append(path[:len(path):len(path)], k), v, v2, true, ok)
+	}
+	for k, v := range to {
+		if _, ok := from[k]; !ok {
+			d.diffValue(append(path[:len(path):len(path)], k), nil, v, false, true)
+		}
+	}
+}
+
+func (d *Diff) diffValue(path []string, from interface{}, to interface{}, inFrom bool, inTo bool) {
+	switch {
+	case inFrom && !inTo:
+		d.Removed = append(d.Removed, Change{Path: path, Old: from})
+	case !inFrom && inTo:
+		d.Added = append(d.Added, Change{Path: path, New: to})
+	case inFrom && inTo:
+		m1, ok1 := from.(map[string]interface{})
+		m2, ok2 := to.(map[string]interface{})
+		if ok1 && ok2 {
+			d.diffMaps(path, m1, m2)
+		} else if !reflect.DeepEqual(from, to) {
+			d.Changed = append(d.Changed, Change{Path: path, Old: from, New: to})
+		}
+	}
+}
+
+// DiffVersions compares two versions of an item from its history
+// If to is empty, the from version is compared with the current version
+// A deleted version is compared as an empty item
+func DiffVersions(hs HistoryStore, id ID, from string, to string) (Diff, error) {
+	sts, err := hs.History(id, MaxHistory)
+	if err != nil {
+		return Diff{}, err
+	}
+	if len(to) == 0 && len(sts) > 0 {
+		to = sts[0].Version
+	}
+	var stFrom, stTo *Status
+	for i := range sts {
+		if sts[i].Version == from {
+			stFrom = &sts[i]
+		}
+		if sts[i].Version == to {
+			stTo = &sts[i]
+		}
+	}
+	if stFrom == nil {
+		return Diff{}, NewVersionNotFoundError(id, from)
+	}
+	if stTo == nil {
+		return Diff{}, NewVersionNotFoundError(id, to)
+	}
+	d := DiffItems(aliveItem(*stFrom), aliveItem(*stTo))
+	d.ID, d.From, d.To = id, from, to
+	return d, nil
+}
+
+func aliveItem(st Status) Item {
+	if st.Status == "ALIVE" {
+		return st.Item
+	}
+	return Item{}
+}
@@ -0,0 +1,74 @@
+package item
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffItems(t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{
+		"field1": "value1",
+		"field2": "value2",
+		"nested": map[string]interface{}{"a": 1, "b": "x"},
+	}}
+	item2 := Item{[]string{"Team", "Team1"}, "Team", "Team One", map[string]interface{}{
+		"field1": "value1",
+		"field3": true,
+		"nested": map[string]interface{}{"a": 2, "c": "y"},
+	}}
+	d := DiffItems(item1, item2)
+	require.Equal(item1.ID, d.ID)
+	require.Equal([]Change{
+		{Path: []string{"contents", "field3"}, New: true},
+		{Path: []string{"contents", "nested", "c"}, New: "y"},
+	}, d.Added)
+	require.Equal([]Change{
+		{Path: []string{"contents", "field2"}, Old: "value2"},
+		{Path: []string{"contents", "nested", "b"}, Old: "x"},
+	}, d.Removed)
+	require.Equal([]Change{
+		{Path: []string{"contents", "nested", "a"}, Old: 1, New: 2},
+		{Path: []string{"name"}, Old: "Team1", New: "Team One"},
+	}, d.Changed)
+
+	d = DiffItems(item1, item1)
+	require.Empty(d.Added)
+	require.Empty(d.Removed)
+	require.Empty(d.Changed)
+
+	d = DiffItems(item1, Item{})
+	require.Empty(d.Added)
+	require.Equal(5, len(d.Removed))
+	require.Empty(d.Changed)
+}
+
+func TestDiffVersions(t *testing.T) {
+	require := require.New(t)
+	store := NewLocalStore()
+	defer store.Close()
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value2"}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Write(item2))
+	require.NoError(store.Delete(item1.ID))
+	sts, err := store.History(item1.ID, 3)
+	require.NoError(err)
+
+	d, err := DiffVersions(store, item1.ID, sts[2].Version, sts[1].Version)
+	require.NoError(err)
+	require.Equal(sts[2].Version, d.From)
+	require.Equal(sts[1].Version, d.To)
+	require.Equal([]Change{{Path: []string{"contents", "field1"}, Old: "value1", New: "value2"}}, d.Changed)
+
+	d, err = DiffVersions(store, item1.ID, sts[1].Version, "")
+	require.NoError(err)
+	require.Equal(sts[0].Version, d.To)
+	require.Equal(3, len(d.Removed))
+
+	_, err = DiffVersions(store, item1.ID, "unknown", "")
+	require.True(IsVersionNotFound(err))
+	_, err = DiffVersions(store, item1.ID, sts[1].Version, "unknown")
+	require.True(IsVersionNotFound(err))
+}
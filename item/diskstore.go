@@ -0,0 +1,518 @@
+package item
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Disk configuration for the embedded store
+type Disk struct {
+	Path string
+	Sync bool
+}
+
+const diskLogFile = "items.log"
+const diskIndexFile = "items.idx"
+
+// diskIndexInterval is the number of records appended between two saves of the index, so that opening the store
+// after a crash only replays the end of the log
+const diskIndexInterval = 1000
+
+// diskRecord is one line of the log: a version of an item
+type diskRecord struct {
+	ID       ID                     `json:"id"`
+	Version  string                 `json:"version"`
+	Updated  time.Time              `json:"updated"`
+	Status   string                 `json:"status"`
+	Type     string                 `json:"type"`
+	Name     string                 `json:"name"`
+	Contents map[string]interface{} `json:"contents"`
+	// Batch is set on the first record of an atomic write to the number of records written together
+	Batch int `json:"batch,omitempty"`
+}
+
+func (r diskRecord) status() Status {
+	return Status{Item{r.ID, r.Type, r.Name, r.Contents}, r.Status, r.Version, r.Updated}
+}
+
+// diskIndex is the content of the index file: the offsets of all versions of each item
+type diskIndex struct {
+	Size    int64              `json:"size"`
+	Offsets map[string][]int64 `json:"offsets"`
+}
+
+// DiskStore is an embedded store keeping all versions of items in an append-only log on local disk
+type DiskStore struct {
+	mux     sync.RWMutex
+	config  Disk
+	log     *os.File
+	size    int64
+	offsets map[string][]int64
+	current map[string]Status
+	// unindexed is the number of records appended since the index was last saved
+	unindexed int
+}
+
+// NewDiskStore opens or creates a disk store in the configured directory
+func NewDiskStore(config Disk) (*DiskStore, error) {
+	err := os.MkdirAll(config.Path, 0755)
+	if err != nil {
+		return nil, NewStoreCreationError(err)
+	}
+	f, err := os.OpenFile(filepath.Join(config.Path, diskLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, NewStoreCreationError(err)
+	}
+	s := &DiskStore{config: config, log: f, current: make(map[string]Status)}
+	err = s.load()
+	if err != nil {
+		f.Close()
+		return nil, NewStoreCreationError(err)
+	}
+	return s, nil
+}
+
+// load reads the index file if it is usable and replays the log entries written after it
+func (s *DiskStore) load() error {
+	fi, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	idx := diskIndex{Offsets: make(map[string][]int64)}
+	b, err := ioutil.ReadFile(filepath.Join(s.config.Path, diskIndexFile))
+	if err == nil {
+		err = json.Unmarshal(b, &idx)
+	}
+	if err != nil || idx.Size > fi.Size() || idx.Offsets == nil {
+		// missing or unusable index, rebuild it from the whole log
+		idx = diskIndex{Offsets: make(map[string][]int64)}
+	}
+	s.offsets = idx.Offsets
+	s.size = idx.Size
+	for k, offs := range s.offsets {
+		rec, err := s.readRecord(offs[len(offs)-1])
+		if err != nil {
+			return err
+		}
+		s.setCurrent(k, rec)
+	}
+	replayed, err := s.replay()
+	if err != nil || replayed == 0 {
+		return err
+	}
+	// save what was replayed, so that the next opening does not replay it again
+	if err := s.writeIndex(); err != nil {
+		log.Printf("Could not save the index of %s: %v", s.config.Path, err)
+	}
+	return nil
+}
+
+// replay reads the log from the current size and returns the number of records read
+// A partially written last record or batch is truncated, but a record that cannot be read in the middle of the log
+// is an error, since the records after it would be lost
+func (s *DiskStore) replay() (int, error) {
+	r := bufio.NewReader(io.NewSectionReader(s.log, s.size, 1<<62))
+	var replayed int
+	for {
+		offset := s.size
+		rec, line, err := readLogLine(r, offset)
+		if err != nil {
+			return replayed, err
+		}
+		if line == nil {
+			break
+		}
+		recs := []diskRecord{rec}
+		lines := [][]byte{line}
+		for len(recs) < rec.Batch && line != nil {
+			offset += int64(len(line))
+			var rec2 diskRecord
+			rec2, line, err = readLogLine(r, offset)
+			if err != nil {
+				return replayed, err
+			}
+			if line != nil {
+				recs = append(recs, rec2)
+				lines = append(lines, line)
+			}
+		}
+		if len(recs) < rec.Batch {
+			break
+		}
+		for i, rec := range recs {
+			k := IDToString(rec.ID)
+			s.offsets[k] = append(s.offsets[k], s.size)
+			s.setCurrent(k, rec)
+			s.size += int64(len(lines[i]))
+		}
+		replayed += len(recs)
+	}
+	return replayed, s.log.Truncate(s.size)
+}
+
+// readLogLine reads the next record of the log, the returned line is nil at the end of the log or on a torn last
+// record, and an error is returned if a record that is followed by others cannot be read
+func readLogLine(r *bufio.Reader, offset int64) (diskRecord, []byte, error) {
+	var rec diskRecord
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF {
+		return rec, nil, nil
+	}
+	if err != nil {
+		return rec, nil, err
+	}
+	if err = json.Unmarshal(line, &rec); err != nil {
+		if _, perr := r.Peek(1); perr == io.EOF {
+			return rec, nil, nil
+		}
+		return rec, nil, NewItemUnmarshallError(fmt.Errorf("corrupted record at offset %d of %s: %v", offset, diskLogFile, err))
+	}
+	return rec, line, nil
+}
+
+func (s *DiskStore) setCurrent(k string, rec diskRecord) {
+	if rec.Status == "ALIVE" {
+		s.current[k] = rec.status()
+	} else {
+		delete(s.current, k)
+	}
+}
+
+func (s *DiskStore) readRecord(offset int64) (diskRecord, error) {
+	var rec diskRecord
+	r := bufio.NewReader(io.NewSectionReader(s.log, offset, s.size-offset))
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(line, &rec)
+	return rec, err
+}
+
+// append writes a record at the end of the log and updates the in-memory state
+func (s *DiskStore) append(rec diskRecord) error {
+	return s.appendAll([]diskRecord{rec})
+}
+
+// appendAll writes records at the end of the log in one write, marking them as a batch if there are several
+func (s *DiskStore) appendAll(recs []diskRecord) error {
+	if s.log == nil {
+		return NewStoreClosedError()
+	}
+	var buf []byte
+	lengths := make([]int64, len(recs))
+	for i := range recs {
+		rec := &recs[i]
+		rec.Version, rec.Updated = newVersion()
+		if i == 0 && len(recs) > 1 {
+			rec.Batch = len(recs)
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return NewItemMarshallError(err)
+		}
+		// read back the contents so that the current version looks exactly like what a reload gives
+		var back diskRecord
+		err = json.Unmarshal(b, &back)
+		if err != nil {
+			return NewItemMarshallError(err)
+		}
+		*rec = back
+		buf = append(append(buf, b...), '\n')
+		lengths[i] = int64(len(b) + 1)
+	}
+	_, err := s.log.WriteAt(buf, s.size)
+	if err == nil && s.config.Sync {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		s.log.Truncate(s.size)
+		return NewStoreInternalError(err)
+	}
+	for i, rec := range recs {
+		k := IDToString(rec.ID)
+		s.offsets[k] = append(s.offsets[k], s.size)
+		s.setCurrent(k, rec)
+		s.size += lengths[i]
+	}
+	s.unindexed += len(recs)
+	if s.unindexed >= diskIndexInterval {
+		// the records are written, failing to save the index only means a longer replay
+		if err := s.writeIndex(); err != nil {
+			log.Printf("Could not save the index of %s: %v", s.config.Path, err)
+		}
+	}
+	return nil
+}
+
+// Read gets the latest version of an item, returning an empty Item if not present or deleted
+func (s *DiskStore) Read(id ID) (Item, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.log == nil {
+		return Item{}, NewStoreClosedError()
+	}
+	return s.current[IDToString(id)].Item, nil
+}
+
+// Write appends a new version of an item
+func (s *DiskStore) Write(item Item) error {
+	if item.IsEmpty() {
+		return NewEmptyItemError()
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.append(diskRecord{ID: item.ID, Status: "ALIVE", Type: item.Type, Name: item.Name, Contents: item.Contents})
+}
+
+// Delete marks an item as deleted
+func (s *DiskStore) Delete(id ID) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.append(diskRecord{ID: id, Status: "DELETED"})
+}
+
+// WriteAll appends new versions of all items in one write, a torn write is discarded as a whole when reopening
+func (s *DiskStore) WriteAll(items []Item) error {
+	return s.ChangeAll(items, nil)
+}
+
+// ChangeAll appends new versions of all items and deletions of the others in one write
+func (s *DiskStore) ChangeAll(items []Item, deleted []ID) error {
+	recs := make([]diskRecord, 0, len(items)+len(deleted))
+	for _, item := range items {
+		if item.IsEmpty() {
+			return NewEmptyItemError()
+		}
+		recs = append(recs, diskRecord{ID: item.ID, Status: "ALIVE", Type: item.Type, Name: item.Name, Contents: item.Contents})
+	}
+	for _, id := range deleted {
+		recs = append(recs, diskRecord{ID: id, Status: "DELETED"})
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.appendAll(recs)
+}
+
+// WriteIf appends a new version of an item if its current version is the given one
+func (s *DiskStore) WriteIf(item Item, version string) error {
+	if item.IsEmpty() {
+		return NewEmptyItemError()
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !isExpectedVersion(s.current[IDToString(item.ID)], version) {
+		return NewVersionConflictError(item.ID, version)
+	}
+	return s.append(diskRecord{ID: item.ID, Status: "ALIVE", Type: item.Type, Name: item.Name, Contents: item.Contents})
+}
+
+// DeleteIf marks an item as deleted if its current version is the given one
+func (s *DiskStore) DeleteIf(id ID, version string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if version == NoVersion || !isExpectedVersion(s.current[IDToString(id)], version) {
+		return NewVersionConflictError(id, version)
+	}
+	return s.append(diskRecord{ID: id, Status: "DELETED"})
+}
+
+// History reads the history of a given item, latest version first
+func (s *DiskStore) History(id ID, limit int) ([]Status, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.log == nil {
+		return []Status{}, NewStoreClosedError()
+	}
+	var items []Status
+	var errors []string
+	offs := s.offsets[IDToString(id)]
+	for i := len(offs) - 1; i >= 0 && len(items) < limit; i-- {
+		rec, err := s.readRecord(offs[i])
+		if err != nil {
+			errors = append(errors, NewItemUnmarshallError(err).Error())
+		} else {
+			items = append(items, rec.status())
+		}
+	}
+	return items, NewMultipleItemErrors(errors)
+}
+
+// ReadAt reads the version of an item that was current at the given time
+func (s *DiskStore) ReadAt(id ID, at time.Time) (Status, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if s.log == nil {
+		return Status{}, NewStoreClosedError()
+	}
+	offs := s.offsets[IDToString(id)]
+	for i := len(offs) - 1; i >= 0; i-- {
+		rec, err := s.readRecord(offs[i])
+		if err != nil {
+			return Status{}, NewItemUnmarshallError(err)
+		}
+		if !rec.Updated.After(at) {
+			return rec.status(), nil
+		}
+	}
+	return Status{}, nil
+}
+
+// currentStatuses gives the latest version of the items that are not deleted
+func (s *DiskStore) currentStatuses() []Status {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	sts := make([]Status, 0, len(s.current))
+	for _, st := range s.current {
+		sts = append(sts, st)
+	}
+	return sts
+}
+
+func (s *DiskStore) currentItems() []Item {
+	return statusItems(s.currentStatuses())
+}
+
+// Search the current versions of the items
+func (s *DiskStore) Search(query *Query) (SearchResult, error) {
+	if s.isClosed() {
+		return SearchResult{Scores: []Score{}, Facets: make(map[string]map[string]uint64)}, NewStoreClosedError()
+	}
+	return searchItems(s.currentStatuses(), query)
+}
+
+// Suggest items from the beginning of their name
+func (s *DiskStore) Suggest(prefix string, itemType string, namespace string, size int) ([]Suggestion, error) {
+	if s.isClosed() {
+		return []Suggestion{}, NewStoreClosedError()
+	}
+	return suggestItems(s.currentStatuses(), prefix, itemType, namespace, size)
+}
+
+// Scroll through all the current items matching the query
+func (s *DiskStore) Scroll(query string, scoreChannel chan Score, errorChannel chan error) {
+	if s.isClosed() {
+		// the error is sent before the channel is closed, readers stop when it is
+		defer close(scoreChannel)
+		errorChannel <- NewStoreClosedError()
+		return
+	}
+	scrollItems(s.currentStatuses(), query, scoreChannel, errorChannel)
+}
+
+// ScanIDs sends the IDs of all the items in the store, including deleted ones
+func (s *DiskStore) ScanIDs(idChannel chan ID, errorChannel chan error) {
+	defer close(idChannel)
+	s.mux.RLock()
+	if s.log == nil {
+		s.mux.RUnlock()
+		errorChannel <- NewStoreClosedError()
+		return
+	}
+	ids := make([]ID, 0, len(s.offsets))
+	for k := range s.offsets {
+		ids = append(ids, StringToID(k))
+	}
+	s.mux.RUnlock()
+	for _, id := range ids {
+		idChannel <- id
+	}
+}
+
+// ScanItems sends the current version of all the items that are not deleted
+func (s *DiskStore) ScanItems(itemChannel chan Item, errorChannel chan error) {
+	scanItems(s, itemChannel, errorChannel)
+}
+
+// ScanStatuses sends the current status of all the items that are not deleted
+func (s *DiskStore) ScanStatuses(statusChannel chan Status, errorChannel chan error) {
+	defer close(statusChannel)
+	if s.isClosed() {
+		errorChannel <- NewStoreClosedError()
+		return
+	}
+	for _, st := range s.currentStatuses() {
+		statusChannel <- st
+	}
+}
+
+// Children returns a page of the current items directly under the given item
+func (s *DiskStore) Children(id ID, cursor string, limit int) ([]Item, string, error) {
+	if s.isClosed() {
+		return []Item{}, "", NewStoreClosedError()
+	}
+	return listItems(s.currentItems(), id, false, cursor, limit)
+}
+
+// Descendants returns a page of the current items in the namespace of the given item
+func (s *DiskStore) Descendants(id ID, cursor string, limit int) ([]Item, string, error) {
+	if s.isClosed() {
+		return []Item{}, "", NewStoreClosedError()
+	}
+	return listItems(s.currentItems(), id, true, cursor, limit)
+}
+
+// SubtreeIDs returns the IDs of all the items ever stored under the given item
+func (s *DiskStore) SubtreeIDs(id ID) ([]ID, error) {
+	s.mux.RLock()
+	if s.log == nil {
+		s.mux.RUnlock()
+		return nil, NewStoreClosedError()
+	}
+	keys := make([]string, 0, len(s.offsets))
+	for k := range s.offsets {
+		keys = append(keys, k)
+	}
+	s.mux.RUnlock()
+	return subtreeIDs(keys, id), nil
+}
+
+func (s *DiskStore) isClosed() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.log == nil
+}
+
+// writeIndex saves the offsets so that the next opening does not need to read the whole log
+func (s *DiskStore) writeIndex() error {
+	b, err := json.Marshal(diskIndex{s.size, s.offsets})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.config.Path, diskIndexFile)
+	err = ioutil.WriteFile(path+".tmp", b, 0644)
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	s.unindexed = 0
+	return nil
+}
+
+// Close the store, saving the index
+func (s *DiskStore) Close() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	err := s.writeIndex()
+	if err2 := s.log.Close(); err == nil {
+		err = err2
+	}
+	s.log = nil
+	if err != nil {
+		return NewStoreCloseError(err)
+	}
+	return nil
+}
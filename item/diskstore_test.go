@@ -0,0 +1,301 @@
+package item
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func getDiskStore(t *testing.T) (*DiskStore, string) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "nsrep")
+	require.NoError(err)
+	store, err := NewDiskStore(Disk{Path: dir})
+	require.NoError(err)
+	require.NotNil(store)
+	return store, dir
+}
+
+func TestDiskStore(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestStore(store, t)
+}
+
+func TestDiskStoreErrors(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestStoreErrors(store, t)
+}
+
+func TestDiskStoreClosedDeleteTree(t *testing.T) {
+	require := require.New(t)
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	require.NoError(store.Write(Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{}}))
+	require.NoError(store.Close())
+	for i := 0; i < 100; i++ {
+		err := DeleteTree([]string{"Team", "Team1"}, []Store{store}, store)
+		require.Error(err)
+		require.Contains(err.Error(), "STORE_CLOSED")
+	}
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	require := require.New(t)
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value2"}}
+	item3 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Write(item3))
+	require.NoError(store.Close())
+
+	_, err := store.Read(item1.ID)
+	require.Error(err)
+
+	// reopen with the index, then add versions
+	store, err = NewDiskStore(Disk{Path: dir})
+	require.NoError(err)
+	it, err := store.Read(item1.ID)
+	require.NoError(err)
+	require.Equal(item1, it)
+	require.NoError(store.Write(item2))
+	require.NoError(store.Delete(item3.ID))
+	require.NoError(store.Close())
+
+	// reopen without the index
+	require.NoError(os.Remove(filepath.Join(dir, diskIndexFile)))
+	store, err = NewDiskStore(Disk{Path: dir})
+	require.NoError(err)
+	defer store.Close()
+	it, err = store.Read(item1.ID)
+	require.NoError(err)
+	require.Equal(item2, it)
+	it, err = store.Read(item3.ID)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+
+	sts, err := store.History(item1.ID, 10)
+	require.NoError(err)
+	require.Equal([]Status{{Item: item2, Status: "ALIVE"}, {Item: item1, Status: "ALIVE"}}, withoutVersions(sts))
+	require.NotEqual(sts[0].Version, sts[1].Version)
+	require.True(sts[0].Updated.After(sts[1].Updated))
+	sts2, err := store.History(item1.ID, 1)
+	require.NoError(err)
+	require.Equal(sts[:1], sts2)
+	sts, err = store.History(item3.ID, 10)
+	require.NoError(err)
+	require.Equal(2, len(sts))
+	require.Equal("DELETED", sts[0].Status)
+	require.Equal(item3, sts[1].Item)
+}
+
+func TestDiskStoreTruncatedLog(t *testing.T) {
+	require := require.New(t)
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Close())
+	require.NoError(os.Remove(filepath.Join(dir, diskIndexFile)))
+
+	f, err := os.OpenFile(filepath.Join(dir, diskLogFile), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(err)
+	_, err = f.WriteString(`{"id":["Team","Team2"],"sta`)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	store, err = NewDiskStore(Disk{Path: dir})
+	require.NoError(err)
+	defer store.Close()
+	it, err := store.Read(item1.ID)
+	require.NoError(err)
+	require.Equal(item1, it)
+	item2 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{}}
+	require.NoError(store.Write(item2))
+	sts, err := store.History(item2.ID, 10)
+	require.NoError(err)
+	require.Equal([]Status{{Item: item2, Status: "ALIVE"}}, withoutVersions(sts))
+}
+
+func TestDiskStoreCorruptedLog(t *testing.T) {
+	require := require.New(t)
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Close())
+	require.NoError(os.Remove(filepath.Join(dir, diskIndexFile)))
+
+	// a complete but unreadable last record is dropped like a torn one
+	f, err := os.OpenFile(filepath.Join(dir, diskLogFile), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(err)
+	_, err = f.WriteString("{\"id\":[\"Team\",\"Team2\"],\"sta\n")
+	require.NoError(err)
+	require.NoError(f.Close())
+	store, err = NewDiskStore(Disk{Path: dir})
+	require.NoError(err)
+	item2 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{}}
+	require.NoError(store.Write(item2))
+	require.NoError(store.Close())
+	require.NoError(os.Remove(filepath.Join(dir, diskIndexFile)))
+
+	// an unreadable record followed by others is reported instead of losing the records after it
+	b, err := ioutil.ReadFile(filepath.Join(dir, diskLogFile))
+	require.NoError(err)
+	b[1] = '!'
+	require.NoError(ioutil.WriteFile(filepath.Join(dir, diskLogFile), b, 0644))
+	_, err = NewDiskStore(Disk{Path: dir})
+	require.Error(err)
+	require.Contains(err.Error(), "offset 0")
+}
+
+func TestDiskStoreIndexInterval(t *testing.T) {
+	require := require.New(t)
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	for i := 0; i < diskIndexInterval; i++ {
+		require.NoError(store.Write(Item{[]string{"Team", fmt.Sprintf("Team%d", i)}, "Team", "Team", map[string]interface{}{}}))
+	}
+	// the index is saved without closing the store, so that a crash does not replay the whole log
+	b, err := ioutil.ReadFile(filepath.Join(dir, diskIndexFile))
+	require.NoError(err)
+	var idx diskIndex
+	require.NoError(json.Unmarshal(b, &idx))
+	require.Equal(diskIndexInterval, len(idx.Offsets))
+	require.Equal(store.size, idx.Size)
+}
+
+func TestDiskStoreSearch(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestSearchStore(store, store, t)
+}
+
+func TestDiskStoreReadAt(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestTimeTravelStore(store, store, t)
+}
+
+func TestDiskStoreConditional(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestConditionalStore(store, store, t)
+}
+
+func TestDiskStoreAtomic(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestAtomicStore(store, store, t)
+}
+
+func TestDiskStoreTruncatedBatch(t *testing.T) {
+	require := require.New(t)
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{}}
+	item3 := Item{[]string{"Team", "Team2", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.WriteAll([]Item{item2, item3}))
+	require.NoError(store.Close())
+	require.NoError(os.Remove(filepath.Join(dir, diskIndexFile)))
+
+	// a complete batch is replayed
+	store, err := NewDiskStore(Disk{Path: dir})
+	require.NoError(err)
+	it, err := store.Read(item3.ID)
+	require.NoError(err)
+	require.Equal(item3, it)
+	require.NoError(store.Close())
+	require.NoError(os.Remove(filepath.Join(dir, diskIndexFile)))
+
+	// lose the end of the last record of the batch
+	fi, err := os.Stat(filepath.Join(dir, diskLogFile))
+	require.NoError(err)
+	require.NoError(os.Truncate(filepath.Join(dir, diskLogFile), fi.Size()-10))
+
+	store, err = NewDiskStore(Disk{Path: dir})
+	require.NoError(err)
+	defer store.Close()
+	it, err = store.Read(item1.ID)
+	require.NoError(err)
+	require.Equal(item1, it)
+	for _, id := range []ID{item2.ID, item3.ID} {
+		it, err = store.Read(id)
+		require.NoError(err)
+		require.True(it.IsEmpty())
+	}
+}
+
+func TestDiskStoreScanItems(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestScanItems(store, store, t)
+}
+
+func TestDiskStoreList(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestListStore(store, store, t)
+}
+
+func TestDiskStoreSubtreeAt(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestSubtreeAt(store, store, t)
+}
+
+func TestDiskStoreClauseSearch(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestClauseSearch(store, store, t)
+}
+
+func TestDiskStoreSortSearch(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestSortSearch(store, store, t)
+}
+
+func TestDiskStoreSearchCursor(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestSearchCursor(store, store, t)
+}
+
+func TestDiskStoreFacetSizes(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestFacetSizes(store, store, t)
+	DoTestAttributeFacets(store, store, t)
+}
+
+func TestDiskStoreSuggest(t *testing.T) {
+	store, dir := getDiskStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	DoTestSuggestStore(store, store, t)
+}
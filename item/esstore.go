@@ -3,9 +3,13 @@ package item
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/olivere/elastic"
@@ -17,16 +21,32 @@ type Elastic struct {
 	Shards   int
 	Replicas int
 	Index    string
+	// Analyzer analyzes names and string attributes: an Elastic analyzer like english, standard if empty,
+	// or prefix to also find words from their first letters
+	Analyzer string
+	// MinGram and MaxGram are the shortest and longest beginnings of words indexed by the prefix analyzer
+	MinGram int
+	MaxGram int
 }
 
 // EsStore is the elastic store handle
+// The configured index name is an alias to the actual index, so that the index can be rebuilt without downtime
 type EsStore struct {
 	client *elastic.Client
 	index  string
+	conf   Elastic
+	mux    sync.RWMutex
+	// building is the index being rebuilt, that also receives all writes
+	building string
+	// attributes are the mappings of the attributes of the model, used when an index is created
+	attributes map[string]interface{}
 }
 
 // NewElasticStore creates a new elastic store
 func NewElasticStore(conf Elastic) (*EsStore, error) {
+	if err := validateAnalysis(conf); err != nil {
+		return nil, NewStoreCreationError(err)
+	}
 	ctx := context.Background()
 	args := make([]elastic.ClientOptionFunc, 0)
 	if len(conf.URL) > 0 {
@@ -43,37 +63,146 @@ func NewElasticStore(conf Elastic) (*EsStore, error) {
 		return nil, errors.Wrap(err, 0)
 	}
 	if !ex {
-		js := map[string]interface{}{
-			"settings": map[string]interface{}{
-				"number_of_shards":   conf.Shards,
-				"number_of_replicas": conf.Replicas,
-			},
-			"mappings": map[string]interface{}{
-				"doc": map[string]interface{}{
-					"properties": map[string]interface{}{
-						"item.id": map[string]interface{}{
-							"type": "keyword",
-						},
-						"item.ns": map[string]interface{}{
-							"type": "keyword",
-						},
-						"item.type": map[string]interface{}{
-							"type": "keyword",
-						},
-						"item.name": map[string]interface{}{
-							"type": "keyword",
+		js := indexBody(conf, nil)
+		js["aliases"] = map[string]interface{}{
+			conf.Index: map[string]interface{}{},
+		}
+		_, err := client.CreateIndex(newIndexName(conf.Index)).BodyJson(js).Do(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+	} else if err := upgradeNameMapping(client, conf); err != nil {
+		return nil, err
+	}
+	return &EsStore{client: client, index: conf.Index, conf: conf}, nil
+}
+
+// upgradeNameMapping adds the analyzed text sub field of the names to the indices created before names were analyzed,
+// and updates their documents in the background so that their names are indexed in it
+// The analysis settings of an existing index cannot change, so names are analyzed with the standard analyzer when the
+// prefix analyzer is configured, until the index is rebuilt
+func upgradeNameMapping(client *elastic.Client, conf Elastic) error {
+	ctx := context.Background()
+	current, err := client.GetMapping().Index(conf.Index).Type("doc").Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	for index, mapping := range current {
+		if hasNameText(mapping) {
+			continue
+		}
+		nameConf := conf
+		if conf.Analyzer == PrefixAnalyzer {
+			log.Printf("Index %s has no prefix analyzer, reindex to search names by prefix", index)
+			nameConf = Elastic{}
+		}
+		_, err = client.PutMapping().Index(index).Type("doc").
+			BodyJson(map[string]interface{}{"properties": map[string]interface{}{"item.name": esNameMapping(nameConf)}}).
+			Do(ctx)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		task, err := client.UpdateByQuery(index).Type("doc").ProceedOnVersionConflict().DoAsync(ctx)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		log.Printf("Indexing the names of the documents of %s as text in task %s", index, task.TaskId)
+	}
+	return nil
+}
+
+// hasNameText returns true if the mapping of an index has the analyzed text sub field of the names
+// Fields with dots in their names are mapped as objects
+func hasNameText(mapping interface{}) bool {
+	m, _ := mapping.(map[string]interface{})
+	mappings, _ := m["mappings"].(map[string]interface{})
+	doc, _ := mappings["doc"].(map[string]interface{})
+	properties, _ := doc["properties"].(map[string]interface{})
+	it, _ := properties["item"].(map[string]interface{})
+	itemProperties, _ := it["properties"].(map[string]interface{})
+	name, _ := itemProperties["name"].(map[string]interface{})
+	fields, _ := name["fields"].(map[string]interface{})
+	_, ok := fields["text"]
+	return ok
+}
+
+// newIndexName generates the name of a new index behind the given alias
+func newIndexName(alias string) string {
+	return fmt.Sprintf("%s_%d", alias, time.Now().UnixNano())
+}
+
+// esDeletedVersionsRetention is how long the version of a deleted document is kept
+const esDeletedVersionsRetention = "10m"
+
+// indexBody gives the settings and mappings of a new index, with the given mappings of the attributes
+func indexBody(conf Elastic, attributes map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{
+		"item.id": map[string]interface{}{
+			"type": "keyword",
+		},
+		"item.ns": map[string]interface{}{
+			"type": "keyword",
+		},
+		"item.type": map[string]interface{}{
+			"type": "keyword",
+		},
+		"item.name": esNameMapping(conf),
+		"item.updated": map[string]interface{}{
+			"type": "date",
+		},
+	}
+	for name, mapping := range attributes {
+		properties[name] = mapping
+	}
+	settings := map[string]interface{}{
+		"number_of_shards":   conf.Shards,
+		"number_of_replicas": conf.Replicas,
+		// versions of deleted documents are kept long enough for the copies read before the deletion to be rejected
+		"gc_deletes": esDeletedVersionsRetention,
+	}
+	if analysis := esAnalysis(conf); analysis != nil {
+		settings["analysis"] = analysis
+	}
+	return map[string]interface{}{
+		"settings": settings,
+		"mappings": map[string]interface{}{
+			"doc": map[string]interface{}{
+				"properties": properties,
+				// strings that are not in the model yet, or nested in objects, are analyzed the same way
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"strings": map[string]interface{}{
+							"match_mapping_type": "string",
+							"mapping":            esStringMapping(conf),
 						},
 					},
 				},
 			},
-		}
+		},
+	}
+}
 
-		_, err := client.CreateIndex(conf.Index).BodyJson(js).Do(ctx)
-		if err != nil {
-			return nil, errors.Wrap(err, 0)
-		}
+func (es *EsStore) buildingIndex() string {
+	es.mux.RLock()
+	defer es.mux.RUnlock()
+	return es.building
+}
+
+// startBuilding records the index being rebuilt, only one index can be rebuilt at a time
+func (es *EsStore) startBuilding(index string) bool {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	if len(es.building) > 0 {
+		return false
 	}
-	return &EsStore{client, conf.Index}, nil
+	es.building = index
+	return true
+}
+
+func (es *EsStore) stopBuilding() {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	es.building = ""
 }
 
 // Close closes the store
@@ -109,16 +238,128 @@ func (es *EsStore) Write(item Item) error {
 	if es.client == nil {
 		return NewStoreClosedError()
 	}
-	body := toES(item)
+	body := toES(Status{Item: item, Status: "ALIVE"})
 	_, err := es.client.Index().Index(es.index).Type("doc").Id(IDToString(item.ID)).BodyJson(body).Refresh("true").
 		Do(context.Background())
 	if err != nil {
 		return err
 	}
+	if building := es.buildingIndex(); len(building) > 0 {
+		_, err = es.client.Index().Index(building).Type("doc").Id(IDToString(item.ID)).BodyJson(body).
+			Do(context.Background())
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+	return nil
+}
+
+// Apply indexes or deletes an item as in the given status, unless the index has a more recent status of the item
+// The time the status was written is the external version of the document, statuses without one are applied as is
+func (es *EsStore) Apply(id ID, st Status) error {
+	if st.Updated.IsZero() {
+		if st.Status == "ALIVE" {
+			return es.Write(st.Item)
+		}
+		return es.Delete(id)
+	}
+	if es.client == nil {
+		return NewStoreClosedError()
+	}
+	indices := []string{es.index}
+	if building := es.buildingIndex(); len(building) > 0 {
+		indices = append(indices, building)
+	}
+	ctx := context.Background()
+	version := st.Updated.UnixNano()
+	for i, index := range indices {
+		var err error
+		if st.Status == "ALIVE" {
+			service := es.client.Index().Index(index).Type("doc").Id(IDToString(id)).BodyJson(toES(st)).
+				VersionType("external").Version(version)
+			if i == 0 {
+				service = service.Refresh("true")
+			}
+			_, err = service.Do(ctx)
+		} else {
+			// deleting a missing document still records its version
+			_, err = es.client.Delete().Index(index).Type("doc").Id(IDToString(id)).
+				VersionType("external").Version(version).Do(ctx)
+		}
+		// a conflict means that the index already has this status or a more recent one
+		if err != nil && !elastic.IsConflict(err) && !elastic.IsNotFound(err) {
+			return errors.Wrap(err, 0)
+		}
+	}
 	return nil
 }
 
-func toES(item Item) map[string]interface{} {
+// WriteBatch indexes items with one bulk request and a single refresh
+func (es *EsStore) WriteBatch(items []Item) []error {
+	sts := make([]Status, len(items))
+	for i, item := range items {
+		sts[i] = Status{Item: item, Status: "ALIVE"}
+	}
+	errs := es.writeBatch(es.index, sts, "true")
+	if building := es.buildingIndex(); len(building) > 0 {
+		for i, err := range es.writeBatch(building, sts, "false") {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+// writeBatch indexes the items of the statuses with one bulk request
+// Statuses with an update time are indexed with it as external version, like in Apply
+func (es *EsStore) writeBatch(index string, sts []Status, refresh string) []error {
+	errs := make([]error, len(sts))
+	if es.client == nil {
+		for i := range sts {
+			errs[i] = NewStoreClosedError()
+		}
+		return errs
+	}
+	bulk := es.client.Bulk().Index(index).Type("doc").Refresh(refresh)
+	var idx []int
+	for i, st := range sts {
+		if st.Item.IsEmpty() {
+			errs[i] = NewEmptyItemError()
+			continue
+		}
+		request := elastic.NewBulkIndexRequest().Id(IDToString(st.Item.ID)).Doc(toES(st))
+		if !st.Updated.IsZero() {
+			request = request.VersionType("external").Version(st.Updated.UnixNano())
+		}
+		bulk.Add(request)
+		idx = append(idx, i)
+	}
+	if len(idx) == 0 {
+		return errs
+	}
+	resp, err := bulk.Do(context.Background())
+	if err != nil {
+		for _, i := range idx {
+			errs[i] = errors.Wrap(err, 0)
+		}
+		return errs
+	}
+	// the response items are in the same order as the requests
+	// a conflict means that the index already has this version of the item or a more recent one
+	for j, ri := range resp.Items {
+		for _, r := range ri {
+			if r.Error != nil && r.Status != http.StatusConflict && j < len(idx) {
+				errs[idx[j]] = NewItemIndexError(r.Error.Reason)
+			}
+		}
+	}
+	return errs
+}
+
+// toES gives the document of an item, with the time it was written in the primary store if the status has it
+func toES(st Status) map[string]interface{} {
+	item := st.Item
 	body := make(map[string]interface{})
 	for k, v := range item.Contents {
 		body[k] = v
@@ -128,6 +369,12 @@ func toES(item Item) map[string]interface{} {
 	body["item.id"] = IDToString(item.ID)
 	body["item.ns"] = AllNamespaces(item.ID)
 	body["item.idlength"] = len(item.ID)
+	updated := st.Updated
+	if updated.IsZero() {
+		// the time the item is indexed, close to the time it was written
+		updated = time.Now()
+	}
+	body["item.updated"] = updated.UTC()
 	return body
 }
 
@@ -159,20 +406,265 @@ func (es *EsStore) Delete(id ID) error {
 	if err != nil && !strings.Contains(err.Error(), "404") {
 		return errors.Wrap(err, 0)
 	}
+	if building := es.buildingIndex(); len(building) > 0 {
+		_, err = es.client.Delete().Index(building).Type("doc").Id(IDToString(id)).Do(context.Background())
+		if err != nil && !strings.Contains(err.Error(), "404") {
+			return errors.Wrap(err, 0)
+		}
+	}
 	return nil
 }
 
-func addAggregation(searchSource *elastic.SearchSource, facet Facet) *elastic.SearchSource {
-	switch facet {
-	case FacetName:
-		return searchSource.Aggregation("item.name", elastic.NewTermsAggregation().Field("item.name"))
-	case FacetType:
-		return searchSource.Aggregation("item.type", elastic.NewTermsAggregation().Field("item.type"))
-	case FacetNamespace:
-		return searchSource.Aggregation("item.ns", elastic.NewTermsAggregation().Field("item.ns"))
+// esReindexBatch is the number of items sent in one bulk request when reindexing
+const esReindexBatch = 500
+
+// Reindex builds a new index from all the items of the source store, and points the alias to it
+// Writes done while the index is built go to both indices, items are indexed with the time they were written as
+// version so that the scanned copies do not overwrite the changes replicated in the meantime
+// The new index is only used if all items could be indexed, otherwise it is deleted
+func (es *EsStore) Reindex(source ScanStore) (ReindexReport, error) {
+	start := time.Now()
+	report := ReindexReport{Previous: []string{}, Failures: []string{}}
+	if es.client == nil {
+		return report, NewStoreClosedError()
+	}
+	ctx := context.Background()
+	index := newIndexName(es.index)
+	if !es.startBuilding(index) {
+		return report, NewReindexError("another reindex is running")
+	}
+	defer es.stopBuilding()
+	es.mux.RLock()
+	body := indexBody(es.conf, es.attributes)
+	es.mux.RUnlock()
+	_, err := es.client.CreateIndex(index).BodyJson(body).Do(ctx)
+	if err != nil {
+		return report, errors.Wrap(err, 0)
+	}
+	report.Index = index
+
+	statusC := make(chan Status)
+	errorC := make(chan error, 1)
+	go source.ScanStatuses(statusC, errorC)
+	batch := make([]Status, 0, esReindexBatch)
+	for st := range statusC {
+		report.Scanned++
+		batch = append(batch, st)
+		if len(batch) == esReindexBatch {
+			es.reindexBatch(index, batch, &report)
+			batch = batch[:0]
+		}
+	}
+	es.reindexBatch(index, batch, &report)
+	select {
+	case err = <-errorC:
 	default:
+	}
+	if err == nil && report.Failed > 0 {
+		err = NewReindexError(fmt.Sprintf("%d items could not be indexed", report.Failed))
+	}
+	if err == nil {
+		_, err = es.client.Refresh(index).Do(ctx)
+	}
+	if err == nil {
+		report.Previous, err = es.swapAlias(index)
+	}
+	report.Took = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	if err != nil {
+		if _, derr := es.client.DeleteIndex(index).Do(ctx); derr != nil {
+			log.Printf("Could not delete index %s: %v", index, derr)
+		}
+		return report, err
+	}
+	return report, nil
+}
+
+// UpdateMapping maps the attributes of the model that are not mapped yet, in the current index and the one being
+// rebuilt if any, and remembers the mappings for the indices created later
+// Attributes already mapped with another type, for example by dynamic mapping, keep their mapping until a reindex
+// If some of their values cannot be indexed with that type, a mapping conflict error tells that a reindex is needed
+func (es *EsStore) UpdateMapping(model *Model) error {
+	if es.client == nil {
+		return NewStoreClosedError()
+	}
+	attributes := esAttributeMappings(model, esStringMapping(es.conf))
+	es.mux.Lock()
+	es.attributes = attributes
+	building := es.building
+	es.mux.Unlock()
+	indices := []string{es.index}
+	if len(building) > 0 {
+		indices = append(indices, building)
+	}
+	ctx := context.Background()
+	current, err := es.client.GetMapping().Index(indices...).Type("doc").Do(ctx)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	var conflict error
+	for index, mapping := range current {
+		mapped := mappedProperties(mapping)
+		missing := make(map[string]interface{})
+		for name, m := range attributes {
+			if _, ok := mapped[name]; !ok {
+				missing[name] = m
+			}
+		}
+		if conflicts := esMappingConflicts(mapped, attributes); len(conflicts) > 0 && conflict == nil {
+			conflict = NewMappingConflictError(index, conflicts)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		_, err = es.client.PutMapping().Index(index).Type("doc").
+			BodyJson(map[string]interface{}{"properties": missing}).Do(ctx)
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+	}
+	return conflict
+}
+
+// mappedProperties gives the type of the top level fields in the mapping of an index
+func mappedProperties(mapping interface{}) map[string]interface{} {
+	mapped := make(map[string]interface{})
+	m, _ := mapping.(map[string]interface{})
+	mappings, _ := m["mappings"].(map[string]interface{})
+	doc, _ := mappings["doc"].(map[string]interface{})
+	properties, _ := doc["properties"].(map[string]interface{})
+	for name, p := range properties {
+		pm, _ := p.(map[string]interface{})
+		mapped[name] = pm["type"]
+	}
+	return mapped
+}
+
+func (es *EsStore) reindexBatch(index string, sts []Status, report *ReindexReport) {
+	if len(sts) == 0 {
+		return
+	}
+	for i, err := range es.writeBatch(index, sts, "false") {
+		if err == nil {
+			report.Indexed++
+			continue
+		}
+		report.Failed++
+		if len(report.Failures) < maxReportedFailures {
+			report.Failures = append(report.Failures, fmt.Sprintf("%s: %s", IDToString(sts[i].Item.ID), err.Error()))
+		}
+	}
+}
+
+// swapAlias points the alias to the new index and deletes the indices it pointed to before
+func (es *EsStore) swapAlias(index string) ([]string, error) {
+	ctx := context.Background()
+	res, err := es.client.Aliases().Do(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+	previous := res.IndicesByAlias(es.index)
+	actions := []elastic.AliasAction{elastic.NewAliasAddAction(es.index).Index(index)}
+	if len(previous) > 0 {
+		actions = append(actions, elastic.NewAliasRemoveAction(es.index).Index(previous...))
+	} else if ex, err := es.client.IndexExists(es.index).Do(ctx); err == nil && ex {
+		// an index created before aliases were used has the name of the alias, it is removed in the same operation
+		actions = append(actions, elastic.NewAliasRemoveIndexAction(es.index))
+		return []string{es.index}, es.updateAliases(actions)
+	}
+	err = es.updateAliases(actions)
+	if err != nil {
+		return nil, err
+	}
+	if len(previous) > 0 {
+		if _, err := es.client.DeleteIndex(previous...).Do(ctx); err != nil {
+			log.Printf("Could not delete previous indices %v: %v", previous, err)
+		}
+	}
+	return previous, nil
+}
+
+func (es *EsStore) updateAliases(actions []elastic.AliasAction) error {
+	_, err := es.client.Alias().Action(actions...).Do(context.Background())
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+	return nil
+}
+
+func addAggregation(searchSource *elastic.SearchSource, facet Facet, size int) *elastic.SearchSource {
+	name := facet.Name()
+	if len(name) == 0 {
 		return searchSource
 	}
+	return searchSource.Aggregation(name, elastic.NewTermsAggregation().Field(name).Size(size))
+}
+
+// attributeAggregationPrefix starts the names of the aggregations of attribute facets, so that they cannot clash
+// with the other facets
+const attributeAggregationPrefix = "attribute:"
+
+func attributeAggregation(facet AttributeFacet) elastic.Aggregation {
+	switch facet.Kind {
+	case FacetKindTerms:
+		return elastic.NewTermsAggregation().Field(esField(facet.Attribute, facet.Text)).Size(facet.size())
+	case FacetKindRange:
+		agg := elastic.NewRangeAggregation().Field(facet.Attribute)
+		for _, r := range facet.Ranges {
+			agg = agg.AddRangeWithKey(r.key(), esBound(r.From), esBound(r.To))
+		}
+		return agg
+	default:
+		return elastic.NewHistogramAggregation().Field(facet.Attribute).Interval(facet.Interval).MinDocCount(1)
+	}
+}
+
+// esBound gives a range bound as elastic expects it, nil when there is none
+func esBound(b *float64) interface{} {
+	if b == nil {
+		return nil
+	}
+	return *b
+}
+
+// attributeBucketsFromES reads the buckets of the aggregation of an attribute facet
+func attributeBucketsFromES(facet AttributeFacet, fields map[string]interface{}) ([]Bucket, FacetInfo) {
+	buckets := []Bucket{}
+	byKey := make(map[string]uint64)
+	cnts, _ := fields["buckets"].([]interface{})
+	for _, y := range cnts {
+		bucket, ok := y.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		docCount, _ := bucket["doc_count"].(float64)
+		count := uint64(docCount)
+		key, ok := bucket["key_as_string"].(string)
+		if !ok {
+			key = scalarString(bucket["key"])
+		}
+		switch facet.Kind {
+		case FacetKindTerms:
+			buckets = append(buckets, Bucket{Key: key, Count: count})
+		case FacetKindRange:
+			byKey[key] = count
+		default:
+			from, ok := bucket["key"].(float64)
+			if !ok {
+				continue
+			}
+			b := histogramBucket(from, facet.Interval)
+			b.Count = count
+			buckets = append(buckets, b)
+		}
+	}
+	if facet.Kind == FacetKindRange {
+		// the buckets come back sorted by bounds, they are returned in the order of the ranges
+		for _, r := range facet.Ranges {
+			buckets = append(buckets, Bucket{Key: r.key(), From: r.From, To: r.To, Count: byKey[r.key()]})
+		}
+	}
+	other, _ := fields["sum_other_doc_count"].(float64)
+	return buckets, FacetInfo{Truncated: other > 0, Other: uint64(other)}
 }
 
 // Search inside Elastic
@@ -180,14 +672,43 @@ func (es *EsStore) Search(query *Query) (SearchResult, error) {
 	var items []Score
 	facetMap := make(map[string]map[string]uint64)
 	if es.client == nil {
-		return SearchResult{items, facetMap}, NewStoreClosedError()
+		return SearchResult{Scores: items, Facets: facetMap}, NewStoreClosedError()
 	}
 
+	if err := query.validatePage(); err != nil {
+		return SearchResult{Scores: items, Facets: facetMap}, err
+	}
+	eq, err := esQuery(query)
+	if err != nil {
+		return SearchResult{Scores: items, Facets: facetMap}, err
+	}
+	// one more hit is asked for to know if there is a next page
+	sorters := esSort(query.Sort)
 	q := elastic.NewSearchSource().
-		Query(elastic.NewQueryStringQuery(escapeQuery(query.QueryString))).
-		From(query.From).Size(query.Length)
+		Query(eq).
+		From(query.From).Size(query.Length + 1).
+		SortBy(sorters...)
+	if len(query.After) > 0 {
+		after, err := decodeSearchCursor(query.After)
+		if err != nil {
+			return SearchResult{Scores: items, Facets: facetMap}, err
+		}
+		if len(after) != len(sorters) {
+			return SearchResult{Scores: items, Facets: facetMap}, NewInvalidCursorError(query.After)
+		}
+		q = q.SearchAfter(after...)
+	}
 	for _, f := range query.Facets {
-		q = addAggregation(q, f)
+		q = addAggregation(q, f, query.FacetSize(f))
+	}
+	if query.Highlight {
+		q = q.Highlight(esHighlight())
+	}
+	if err := validateAttributeFacets(query.AttributeFacets); err != nil {
+		return SearchResult{Scores: items, Facets: facetMap}, err
+	}
+	for _, f := range query.AttributeFacets {
+		q = q.Aggregation(attributeAggregationPrefix+f.Attribute, attributeAggregation(f))
 	}
 
 	searchResult, err := es.client.Search(es.index).Type("doc").SearchSource(q).Pretty(true).
@@ -195,33 +716,105 @@ func (es *EsStore) Search(query *Query) (SearchResult, error) {
 	if err != nil {
 		e := err.(*elastic.Error)
 		log.Printf("Elastic failed with status %d and error %v.", e.Status, e.Details)
-		return SearchResult{items, facetMap}, err
+		return SearchResult{Scores: items, Facets: facetMap}, err
 	}
 	// log.Printf("Found %d hits ", searchResult.TotalHits())
 	var errors []string
-	for _, hit := range searchResult.Hits.Hits {
+	var next string
+	for i, hit := range searchResult.Hits.Hits {
+		if i == query.Length {
+			next = encodeSearchCursor(searchResult.Hits.Hits[i-1].Sort)
+			break
+		}
 		item, err := fromES(hit.Id, hit.Source)
 		if err != nil {
 			errors = append(errors, NewItemUnmarshallError(err).Error())
-		} else {
-			items = append(items, Score{item, *hit.Score})
+			continue
+		}
+		var sc float64
+		if hit.Score != nil {
+			sc = *hit.Score
+		}
+		items = append(items, Score{Item: item, Score: sc, Cursor: encodeSearchCursor(hit.Sort),
+			Highlights: highlightsFromES(hit.Highlight)})
+	}
+	facetInfo := make(map[string]FacetInfo)
+	var attributeFacets map[string][]Bucket
+	for _, f := range query.AttributeFacets {
+		if attributeFacets == nil {
+			attributeFacets = make(map[string][]Bucket)
+		}
+		var fields = make(map[string]interface{})
+		if value, ok := searchResult.Aggregations[attributeAggregationPrefix+f.Attribute]; ok {
+			json.Unmarshal(*value, &fields)
+		}
+		var info FacetInfo
+		attributeFacets[f.Attribute], info = attributeBucketsFromES(f, fields)
+		if f.Kind == FacetKindTerms {
+			facetInfo[f.Attribute] = info
 		}
 	}
 	for aggName, value := range searchResult.Aggregations {
+		if strings.HasPrefix(aggName, attributeAggregationPrefix) {
+			continue
+		}
 		var fields = make(map[string]interface{})
 		json.Unmarshal(*value, &fields)
 		//log.Printf("agg: %s", aggName)
-		cnts := fields["buckets"].([]interface{})
+		cnts, _ := fields["buckets"].([]interface{})
 		var values = make(map[string]uint64)
 		for _, y := range cnts {
-			bucket := y.(map[string]interface{})
+			bucket, ok := y.(map[string]interface{})
+			if !ok {
+				continue
+			}
 			//log.Printf("\t%v:%v", bucket["key"], bucket["doc_count"])
-			values[bucket["key"].(string)] = uint64(bucket["doc_count"].(float64))
+			count, _ := bucket["doc_count"].(float64)
+			values[scalarString(bucket["key"])] = uint64(count)
 		}
 		facetMap[aggName] = values
+		other, _ := fields["sum_other_doc_count"].(float64)
+		facetInfo[aggName] = FacetInfo{Truncated: other > 0, Other: uint64(other)}
 	}
 
-	return SearchResult{items, facetMap}, NewMultipleItemErrors(errors)
+	return SearchResult{Scores: items, Facets: facetMap, Next: next, Total: searchResult.TotalHits(),
+			Took: searchResult.TookInMillis, FacetInfo: facetInfo, AttributeFacets: attributeFacets},
+		NewMultipleItemErrors(errors)
+}
+
+// Suggest items from the beginning of their name, matching the analyzed name as a phrase whose last word is a prefix
+func (es *EsStore) Suggest(prefix string, itemType string, namespace string, size int) ([]Suggestion, error) {
+	suggestions := []Suggestion{}
+	if es.client == nil {
+		return suggestions, NewStoreClosedError()
+	}
+	size, err := validateSuggest(prefix, size)
+	if err != nil {
+		return suggestions, err
+	}
+	q := elastic.NewBoolQuery().Must(elastic.NewMatchPhrasePrefixQuery("item.name.text", strings.TrimSpace(prefix)))
+	if len(itemType) > 0 {
+		q = q.Filter(elastic.NewTermQuery("item.type", itemType))
+	}
+	if len(namespace) > 0 {
+		q = q.Filter(elastic.NewTermQuery("item.ns", namespace))
+	}
+	ss := elastic.NewSearchSource().Query(q).Size(size).
+		SortBy(elastic.NewFieldSort("item.name"), elastic.NewFieldSort("item.id"))
+	searchResult, err := es.client.Search(es.index).Type("doc").SearchSource(ss).Do(context.Background())
+	if err != nil {
+		return suggestions, errors.Wrap(err, 0)
+	}
+	var errs []string
+	for _, hit := range searchResult.Hits.Hits {
+		it, err := fromES(hit.Id, hit.Source)
+		if err != nil {
+			errs = append(errs, NewItemUnmarshallError(err).Error())
+			continue
+		}
+		suggestions = append(suggestions, Suggestion{it.ID, it.Name, it.Type})
+	}
+	return suggestions, NewMultipleItemErrors(errs)
 }
 
 // Scroll through elasticsearch result
@@ -229,6 +822,7 @@ func (es *EsStore) Scroll(query string, scoreChannel chan Score, errorChannel ch
 	defer close(scoreChannel)
 	if es.client == nil {
 		errorChannel <- NewStoreClosedError()
+		return
 	}
 	ctx := context.TODO()
 	svc := es.client.Scroll(es.index).Type("doc").
@@ -251,7 +845,7 @@ func (es *EsStore) Scroll(query string, scoreChannel chan Score, errorChannel ch
 			item, err := fromES(hit.Id, hit.Source)
 			if err == nil {
 				select {
-				case scoreChannel <- Score{item, sc}:
+				case scoreChannel <- Score{Item: item, Score: sc}:
 				case <-ctx.Done():
 					errorChannel <- ctx.Err()
 				}
@@ -266,6 +860,139 @@ func (es *EsStore) Scroll(query string, scoreChannel chan Score, errorChannel ch
 	}
 }
 
+// esHighlight asks for highlights on the name and all the attributes, only string fields having any
+func esHighlight() *elastic.Highlight {
+	return elastic.NewHighlight().Fields(elastic.NewHighlighterField("item.name.text"), elastic.NewHighlighterField("*"))
+}
+
+// highlightsFromES gives the highlights of a hit by field, named like in clauses: the name of the item and the
+// attributes, the keyword sub fields being merged into their attribute
+func highlightsFromES(highlight elastic.SearchHitHighlight) map[string][]string {
+	if len(highlight) == 0 {
+		return nil
+	}
+	highlights := make(map[string][]string)
+	for field, fragments := range highlight {
+		field = strings.TrimSuffix(field, ".keyword")
+		switch {
+		case field == "item.name" || field == "item.name.text":
+			field = "name"
+		case isItemField(field):
+			continue
+		case itemFields[field] != "":
+			field = "contents." + field
+		}
+		for _, f := range fragments {
+			if !containsString(highlights[field], f) {
+				highlights[field] = append(highlights[field], f)
+			}
+		}
+	}
+	if len(highlights) == 0 {
+		return nil
+	}
+	return highlights
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// esQuery translates the query string and the clause of a query into an Elastic query
+// Words without a field are searched in the analyzed name as well as in all the other fields
+func esQuery(query *Query) (elastic.Query, error) {
+	qs := elastic.NewQueryStringQuery(escapeQuery(query.QueryString)).Field("item.name.text").Field("*")
+	if query.Clause == nil {
+		return qs, nil
+	}
+	if err := query.Clause.Validate(); err != nil {
+		return nil, err
+	}
+	cq := esClause(*query.Clause)
+	if len(strings.TrimSpace(query.QueryString)) == 0 {
+		return cq, nil
+	}
+	return elastic.NewBoolQuery().Must(qs, cq), nil
+}
+
+// esClause translates a validated clause
+// Attributes are dynamically mapped, so string values are matched on their keyword sub field
+func esClause(c Clause) elastic.Query {
+	switch {
+	case c.Term != nil:
+		_, text := c.Term.Value.(string)
+		return elastic.NewTermQuery(esField(c.Term.Field, text), c.Term.Value)
+	case c.Prefix != nil:
+		return elastic.NewPrefixQuery(esField(c.Prefix.Field, true), c.Prefix.Value)
+	case c.Range != nil:
+		q := elastic.NewRangeQuery(esField(c.Range.Field, c.Range.isTextRange()))
+		if c.Range.Gt != nil {
+			q = q.Gt(c.Range.Gt)
+		}
+		if c.Range.Gte != nil {
+			q = q.Gte(c.Range.Gte)
+		}
+		if c.Range.Lt != nil {
+			q = q.Lt(c.Range.Lt)
+		}
+		if c.Range.Lte != nil {
+			q = q.Lte(c.Range.Lte)
+		}
+		return q
+	case c.Exists != nil:
+		return elastic.NewExistsQuery(searchField(c.Exists.Field))
+	default:
+		q := elastic.NewBoolQuery()
+		for _, sub := range c.Bool.Must {
+			q = q.Must(esClause(sub))
+		}
+		for _, sub := range c.Bool.Should {
+			q = q.Should(esClause(sub))
+		}
+		if len(c.Bool.Should) > 0 {
+			q = q.MinimumNumberShouldMatch(1)
+		}
+		for _, sub := range c.Bool.MustNot {
+			q = q.MustNot(esClause(sub))
+		}
+		return q
+	}
+}
+
+// esSort translates sorts, by relevance if there are none, adding the item ID to break ties
+func esSort(sorts []Sort) []elastic.Sorter {
+	if len(sorts) == 0 {
+		return []elastic.Sorter{elastic.NewScoreSort().Desc(), elastic.NewFieldSort("item.id").Asc()}
+	}
+	var sorters []elastic.Sorter
+	for _, s := range sorts {
+		if isItemField(s.Field) {
+			sorters = append(sorters, elastic.NewFieldSort(s.Field).Order(!s.Descending))
+			continue
+		}
+		field, unmapped := s.Field, "double"
+		if s.Text {
+			field, unmapped = s.Field+".keyword", "keyword"
+		}
+		sorters = append(sorters, elastic.NewFieldSort(field).Order(!s.Descending).Missing("_last").UnmappedType(unmapped))
+	}
+	return append(sorters, elastic.NewFieldSort("item.id").Asc())
+}
+
+// esField gives the Elastic field for a clause field
+func esField(field string, text bool) string {
+	f := searchField(field)
+	if text && !isItemField(f) {
+		return f + ".keyword"
+	}
+	return f
+}
+
 func escapeQuery(queryString string) string {
 	s := strings.Replace(queryString, "/", "\\/", -1)
 	return s
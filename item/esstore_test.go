@@ -1,7 +1,9 @@
 package item
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -26,6 +28,10 @@ func TestEsStoreErrors(t *testing.T) {
 	DoTestStoreErrors(getEsStore(t), t)
 }
 
+func TestEsStoreWriteBatch(t *testing.T) {
+	DoTestWriteBatch(getEsStore(t), t)
+}
+
 func TestEsStoreSearch(t *testing.T) {
 	store := getEsStore(t)
 	defer store.Close()
@@ -170,3 +176,344 @@ func TestFacets(t *testing.T) {
 	}
 	require.Equal(exp, facets)
 }
+
+func TestHighlight(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	require := require.New(t)
+
+	item1 := Item{[]string{"Organization", "Org1"}, "Organization", "Org1", map[string]interface{}{
+		"description": "the quick brown fox",
+		"size":        3.0,
+	}}
+	item2 := Item{[]string{"Organization", "Org2"}, "Organization", "Org2", map[string]interface{}{
+		"description": "a lazy dog",
+	}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Write(item2))
+	defer store.Delete(item1.ID)
+	defer store.Delete(item2.ID)
+
+	query := NewQuery("fox OR Org1")
+	query.Highlight = true
+	rs, err := store.Search(query)
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(map[string][]string{"name": {"<em>Org1</em>"}, "description": {"the quick brown <em>fox</em>"}},
+		rs.Scores[0].Highlights)
+
+	rs, err = store.Search(NewQuery("fox"))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Nil(rs.Scores[0].Highlights)
+}
+
+func TestAttributeBucketsFromES(t *testing.T) {
+	require := require.New(t)
+	ten := 10.0
+	buckets, _ := attributeBucketsFromES(AttributeFacet{Attribute: "price", Kind: FacetKindHistogram, Interval: 10},
+		map[string]interface{}{"buckets": []interface{}{
+			map[string]interface{}{"key": 0.0, "doc_count": 2.0},
+			map[string]interface{}{"key": "0-5", "doc_count": 1.0},
+			"unexpected"}})
+	require.Equal([]Bucket{{Key: "0", From: new(float64), To: &ten, Count: 2}}, buckets)
+	buckets, _ = attributeBucketsFromES(AttributeFacet{Attribute: "price", Kind: FacetKindTerms},
+		map[string]interface{}{"buckets": "unexpected"})
+	require.Empty(buckets)
+}
+
+func TestHighlightsFromES(t *testing.T) {
+	require := require.New(t)
+	require.Nil(highlightsFromES(nil))
+	require.Nil(highlightsFromES(map[string][]string{"item.type": {"<em>Team</em>"}}))
+	require.Equal(map[string][]string{"name": {"<em>Team1</em>"}, "description": {"a <em>big</em> team"},
+		"contents.type": {"<em>big</em>"}},
+		highlightsFromES(map[string][]string{"item.name": {"<em>Team1</em>"}, "item.id": {"<em>Team1</em>"},
+			"description": {"a <em>big</em> team"}, "description.keyword": {"a <em>big</em> team"},
+			"type.keyword": {"<em>big</em>"}}))
+}
+
+func TestEsStoreReindex(t *testing.T) {
+	require := require.New(t)
+	store := getEsStore(t)
+	defer store.Close()
+	source := NewLocalStore()
+	item1 := Item{[]string{"Team", "Reindex1"}, "Team", "Reindex1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Reindex2"}, "Team", "Reindex2", map[string]interface{}{"field1": "value2"}}
+	require.NoError(source.Write(item1))
+	require.NoError(source.Write(item2))
+	// only in the old index, gone after the reindex
+	item3 := Item{[]string{"Team", "Reindex3"}, "Team", "Reindex3", map[string]interface{}{}}
+	require.NoError(store.Write(item3))
+
+	report, err := store.Reindex(source)
+	require.NoError(err)
+	require.Equal(2, report.Scanned)
+	require.Equal(2, report.Indexed)
+	require.Equal(0, report.Failed)
+	require.NotEmpty(report.Index)
+	require.NotEmpty(report.Previous)
+
+	for _, it := range []Item{item1, item2} {
+		it2, err := store.Read(it.ID)
+		require.NoError(err)
+		require.Equal(it, it2)
+	}
+	it, err := store.Read(item3.ID)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+
+	report2, err := store.Reindex(source)
+	require.NoError(err)
+	require.Equal([]string{report.Index}, report2.Previous)
+	require.NoError(store.Delete(item1.ID))
+	require.NoError(store.Delete(item2.ID))
+}
+
+func TestEsStoreApply(t *testing.T) {
+	require := require.New(t)
+	store := getEsStore(t)
+	defer store.Close()
+	source := NewLocalStore()
+	item1 := Item{[]string{"Team", "Apply1"}, "Team", "Apply1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Apply1"}, "Team", "Apply1", map[string]interface{}{"field1": "value2"}}
+	require.NoError(source.Write(item1))
+	require.NoError(source.Write(item2))
+	require.NoError(source.Delete(item1.ID))
+	sts, err := source.History(item1.ID, 3)
+	require.NoError(err)
+
+	// an older status does not overwrite a more recent one
+	require.NoError(store.Apply(item1.ID, sts[1]))
+	require.NoError(store.Apply(item1.ID, sts[2]))
+	it, err := store.Read(item1.ID)
+	require.NoError(err)
+	require.Equal(item2, it)
+
+	// nor does it bring back a deleted item
+	require.NoError(store.Apply(item1.ID, sts[0]))
+	require.NoError(store.Apply(item1.ID, sts[1]))
+	it, err = store.Read(item1.ID)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+}
+
+func TestToES(t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	updated := time.Date(2020, 5, 1, 10, 0, 0, 0, time.Local)
+	body := toES(Status{Item: item1, Status: "ALIVE", Updated: updated})
+	require.Equal(updated.UTC(), body["item.updated"])
+	require.Equal("value1", body["field1"])
+	// without the time of the write, the time of indexing is used
+	before := time.Now()
+	body = toES(Status{Item: item1, Status: "ALIVE"})
+	require.False(body["item.updated"].(time.Time).Before(before.UTC()))
+}
+
+func TestEsStoreClauseSearch(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	DoTestClauseSearch(store, store, t)
+}
+
+func TestEsStoreSortSearch(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	DoTestSortSearch(store, store, t)
+}
+
+func TestEsStoreSearchCursor(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	DoTestSearchCursor(store, store, t)
+}
+
+func TestEsStoreFacetSizes(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	DoTestFacetSizes(store, store, t)
+	DoTestAttributeFacets(store, store, t)
+}
+
+func TestEsAttributeMappings(t *testing.T) {
+	require := require.New(t)
+	text := esStringMapping(Elastic{})
+	model := EmptyModel()
+	model.TypeAttributes = map[string]map[string]string{
+		"Team": {"name": "string", "size": "float64", "active": "bool", "code": "float64", "count": "int64",
+			"address": "map[string]interface {}"},
+		"Organization": {"code": "string", "count": "float64", "active": "bool", "created": "time.Time"},
+	}
+	require.Equal(map[string]interface{}{
+		"name":    text,
+		"size":    map[string]interface{}{"type": "double"},
+		"active":  map[string]interface{}{"type": "boolean"},
+		"code":    text,
+		"count":   map[string]interface{}{"type": "double"},
+		"created": map[string]interface{}{"type": "date"},
+	}, esAttributeMappings(model, text))
+}
+
+func TestEsStoreMapping(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	require := require.New(t)
+
+	item1 := Item{[]string{"Organization", "OrgM"}, "Organization", "OrgM", map[string]interface{}{"mappedCode": 12.0}}
+	item2 := Item{[]string{"Organization", "OrgM", "Team", "TeamM"}, "Team", "TeamM", map[string]interface{}{"mappedCode": "A12"}}
+	model := EmptyModel()
+	_, err := AddItem(item1, model)
+	require.NoError(err)
+	_, err = AddItem(item2, model)
+	require.NoError(err)
+	require.NoError(store.UpdateMapping(model))
+
+	require.NoError(store.Write(item1))
+	defer store.Delete(item1.ID)
+	require.NoError(store.Write(item2))
+	defer store.Delete(item2.ID)
+	rs, err := store.Search(NewClauseQuery(Clause{Prefix: &PrefixClause{"mappedCode", "A"}}))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(item2.ID, rs.Scores[0].Item.ID)
+}
+
+func TestEsMappingConflicts(t *testing.T) {
+	require := require.New(t)
+	text := esStringMapping(Elastic{})
+	mapped := map[string]interface{}{"code": "double", "count": "long", "name": "text", "active": "boolean"}
+	require.Empty(esMappingConflicts(mapped, map[string]interface{}{"count": map[string]interface{}{"type": "double"},
+		"name": map[string]interface{}{"type": "double"}, "other": text}))
+	require.Equal([]string{"active", "code"}, esMappingConflicts(mapped, map[string]interface{}{"code": text,
+		"active": map[string]interface{}{"type": "date"}}))
+}
+
+func TestEsStoreMappingConflict(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	require := require.New(t)
+
+	item1 := Item{[]string{"Organization", "OrgC"}, "Organization", "OrgC", map[string]interface{}{"conflictCode": 12.0}}
+	item2 := Item{[]string{"Organization", "OrgC", "Team", "TeamC"}, "Team", "TeamC", map[string]interface{}{"conflictCode": "A12"}}
+	source := NewLocalStore()
+	model := EmptyModel()
+	_, err := AddItem(item1, model)
+	require.NoError(err)
+	require.NoError(store.UpdateMapping(model))
+	require.NoError(source.Write(item1))
+	require.NoError(store.Write(item1))
+	defer store.Delete(item1.ID)
+
+	_, err = AddItem(item2, model)
+	require.NoError(err)
+	require.True(IsMappingConflict(store.UpdateMapping(model)))
+	require.NoError(source.Write(item2))
+	require.Error(store.Write(item2))
+	_, err = store.Reindex(source)
+	require.NoError(err)
+	require.NoError(store.UpdateMapping(model))
+	defer store.Delete(item2.ID)
+	for _, it := range []Item{item1, item2} {
+		rs, err := store.Search(NewClauseQuery(Clause{Term: &TermClause{"item.name", it.Name}}))
+		require.NoError(err)
+		require.Equal(1, len(rs.Scores))
+		require.Equal(it, rs.Scores[0].Item)
+	}
+}
+
+func TestEsAnalyzer(t *testing.T) {
+	require := require.New(t)
+	require.Nil(esAnalysis(Elastic{}))
+	require.Equal(map[string]interface{}{"type": "text", "analyzer": "english"}, esTextMapping(Elastic{Analyzer: "english"}))
+
+	conf := Elastic{Analyzer: PrefixAnalyzer, MinGram: 3}
+	analysis := esAnalysis(conf)
+	require.Equal(map[string]interface{}{"type": "edge_ngram", "min_gram": 3, "max_gram": defaultMaxGram},
+		analysis["filter"].(map[string]interface{})[esPrefixAnalyzer])
+	require.Equal(map[string]interface{}{"type": "keyword", "fields": map[string]interface{}{
+		"text": map[string]interface{}{"type": "text", "analyzer": esPrefixAnalyzer, "search_analyzer": "standard"}}},
+		esNameMapping(conf))
+
+	require.NoError(validateAnalysis(Elastic{Analyzer: PrefixAnalyzer, MinGram: 3, MaxGram: 3}))
+	require.NoError(validateAnalysis(Elastic{MinGram: 25}))
+	require.Error(validateAnalysis(Elastic{Analyzer: PrefixAnalyzer, MinGram: 25}))
+	require.Error(validateAnalysis(Elastic{Analyzer: PrefixAnalyzer, MinGram: 4, MaxGram: 3}))
+	_, err := NewElasticStore(Elastic{Analyzer: PrefixAnalyzer, MinGram: 25})
+	require.Error(err)
+}
+
+func TestHasNameText(t *testing.T) {
+	require := require.New(t)
+	mapping := func(name map[string]interface{}) interface{} {
+		return map[string]interface{}{"mappings": map[string]interface{}{"doc": map[string]interface{}{
+			"properties": map[string]interface{}{"item": map[string]interface{}{
+				"properties": map[string]interface{}{"name": name}}}}}}
+	}
+	require.False(hasNameText(nil))
+	require.False(hasNameText(mapping(map[string]interface{}{"type": "keyword"})))
+	require.True(hasNameText(mapping(esNameMapping(Elastic{}))))
+}
+
+func TestEsStoreNameUpgrade(t *testing.T) {
+	require := require.New(t)
+	conf := Elastic{URL: "http://55.0.0.2:9200", Shards: 1, Replicas: 0, Index: "items_upgrade_test"}
+	store, err := NewElasticStore(conf)
+	require.NoError(err)
+	ctx := context.Background()
+	res, err := store.client.Aliases().Do(ctx)
+	require.NoError(err)
+	_, err = store.client.DeleteIndex(res.IndicesByAlias(conf.Index)...).Do(ctx)
+	require.NoError(err)
+	// an index created before names were analyzed
+	body := indexBody(conf, nil)
+	body["mappings"].(map[string]interface{})["doc"].(map[string]interface{})["properties"].(map[string]interface{})["item.name"] =
+		map[string]interface{}{"type": "keyword"}
+	body["aliases"] = map[string]interface{}{conf.Index: map[string]interface{}{}}
+	_, err = store.client.CreateIndex(newIndexName(conf.Index)).BodyJson(body).Do(ctx)
+	require.NoError(err)
+	item1 := Item{[]string{"Team", "Upgraded"}, "Team", "Team Upgraded", map[string]interface{}{}}
+	require.NoError(store.Write(item1))
+	store.Close()
+
+	store, err = NewElasticStore(conf)
+	require.NoError(err)
+	defer store.Close()
+	defer store.Delete(item1.ID)
+	var sugs []Suggestion
+	for i := 0; i < 10 && len(sugs) == 0; i++ {
+		time.Sleep(500 * time.Millisecond)
+		_, err = store.client.Refresh(conf.Index).Do(ctx)
+		require.NoError(err)
+		sugs, err = store.Suggest("upgr", "", "", 5)
+		require.NoError(err)
+	}
+	require.Equal(1, len(sugs))
+}
+
+func TestEsStoreNameSearch(t *testing.T) {
+	conf := Elastic{URL: "http://55.0.0.2:9200", Shards: 1, Replicas: 0, Index: "items_prefix_test", Analyzer: PrefixAnalyzer}
+	store, err := NewElasticStore(conf)
+	require := require.New(t)
+	require.NoError(err)
+	defer store.Close()
+
+	item1 := Item{[]string{"Team", "Alpha"}, "Team", "Team Alpha", map[string]interface{}{"motto": "Fortune favours the bold"}}
+	require.NoError(store.Write(item1))
+	defer store.Delete(item1.ID)
+	for _, q := range []string{"alpha", "Team", "alp", "fortu"} {
+		rs, err := store.Search(NewQuery(q))
+		require.NoError(err)
+		require.Equal(1, len(rs.Scores), q)
+		require.Equal(item1.ID, rs.Scores[0].Item.ID)
+	}
+	rs, err := store.Search(NewQuery(`item.name:"Team Alpha"`))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+}
+
+func TestEsStoreSuggest(t *testing.T) {
+	store := getEsStore(t)
+	defer store.Close()
+	DoTestSuggestStore(store, store, t)
+}
@@ -0,0 +1,297 @@
+package item
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of attribute facets
+const (
+	FacetKindTerms     = "terms"
+	FacetKindRange     = "range"
+	FacetKindHistogram = "histogram"
+)
+
+// AttributeFacet counts the values of an attribute of the contents
+type AttributeFacet struct {
+	Attribute string `json:"attribute"`
+	// Kind is terms for string and bool attributes, range or histogram for numbers
+	Kind string `json:"kind,omitempty"`
+	// Size is the number of values of a terms facet, DefaultFacetSize if not set
+	Size int `json:"size,omitempty"`
+	// Ranges are the buckets of a range facet
+	Ranges []FacetRange `json:"ranges,omitempty"`
+	// Interval is the width of the buckets of a histogram facet
+	Interval float64 `json:"interval,omitempty"`
+	// Text is true when the values are strings
+	Text bool `json:"-"`
+}
+
+// FacetRange is a range of numbers, From included and To excluded, one of them can be left out
+type FacetRange struct {
+	From *float64 `json:"from,omitempty"`
+	To   *float64 `json:"to,omitempty"`
+}
+
+// Bucket is a value of an attribute facet with the number of matching items
+// Range and histogram buckets have their boundaries, From included and To excluded
+type Bucket struct {
+	Key   string   `json:"key"`
+	From  *float64 `json:"from,omitempty"`
+	To    *float64 `json:"to,omitempty"`
+	Count uint64   `json:"count"`
+}
+
+// AddAttributeFacet adds a facet on an attribute to the query
+func (q *Query) AddAttributeFacet(facet AttributeFacet) *Query {
+	q.AttributeFacets = append(q.AttributeFacets, facet)
+	return q
+}
+
+// ResolveAttributeFacet checks a facet against the type of its attribute in the model
+// The kind defaults to terms for strings and booleans, to range or histogram for numbers depending on what is set
+func (model *Model) ResolveAttributeFacet(facet AttributeFacet) (AttributeFacet, error) {
+	facet.Attribute = strings.TrimPrefix(facet.Attribute, "contents.")
+	atype, ok := model.attributeType(facet.Attribute)
+	if !ok {
+		return facet, NewQueryValidationError(fmt.Sprintf("cannot facet on unknown attribute %s", facet.Attribute))
+	}
+	numeric := atype == "float64" || atype == "int64"
+	if len(facet.Kind) == 0 {
+		switch {
+		case !numeric:
+			facet.Kind = FacetKindTerms
+		case len(facet.Ranges) > 0:
+			facet.Kind = FacetKindRange
+		default:
+			facet.Kind = FacetKindHistogram
+		}
+	}
+	if numeric == (facet.Kind == FacetKindTerms) {
+		return facet, NewQueryValidationError(fmt.Sprintf("cannot use a %s facet on %s attribute %s", facet.Kind, atype,
+			facet.Attribute))
+	}
+	facet.Text = atype == "string"
+	return facet, facet.validate()
+}
+
+// ParseAttributeFacet reads a facet given as attribute, attribute:histogram:interval or
+// attribute:range:from-to,from-to where a missing bound is written *
+func ParseAttributeFacet(facetString string, model *Model) (AttributeFacet, error) {
+	parts := strings.SplitN(facetString, ":", 3)
+	facet := AttributeFacet{Attribute: parts[0]}
+	if len(parts) == 1 {
+		return model.ResolveAttributeFacet(facet)
+	}
+	if len(parts) != 3 {
+		return facet, NewQueryValidationError(fmt.Sprintf("cannot read facet %s", facetString))
+	}
+	facet.Kind = parts[1]
+	switch facet.Kind {
+	case FacetKindHistogram:
+		interval, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return facet, NewQueryValidationError(fmt.Sprintf("cannot read histogram interval %s", parts[2]))
+		}
+		facet.Interval = interval
+	case FacetKindRange:
+		for _, r := range strings.Split(parts[2], ",") {
+			fr, err := parseFacetRange(r)
+			if err != nil {
+				return facet, err
+			}
+			facet.Ranges = append(facet.Ranges, fr)
+		}
+	case FacetKindTerms:
+		size, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return facet, NewQueryValidationError(fmt.Sprintf("cannot read terms size %s", parts[2]))
+		}
+		facet.Size = size
+	}
+	return model.ResolveAttributeFacet(facet)
+}
+
+// parseFacetRange reads a range written from-to, negative numbers being allowed on both sides
+func parseFacetRange(rangeString string) (FacetRange, error) {
+	for i := 1; i < len(rangeString); i++ {
+		if rangeString[i] != '-' {
+			continue
+		}
+		from, errFrom := parseBound(rangeString[:i])
+		to, errTo := parseBound(rangeString[i+1:])
+		if errFrom == nil && errTo == nil {
+			return FacetRange{From: from, To: to}, nil
+		}
+	}
+	return FacetRange{}, NewQueryValidationError(fmt.Sprintf("cannot read range %s", rangeString))
+}
+
+func parseBound(s string) (*float64, error) {
+	if s == "*" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// validateAttributeFacets checks that all the facets are well formed and that each attribute has at most one facet,
+// since the results are keyed by attribute
+func validateAttributeFacets(facets []AttributeFacet) error {
+	seen := make(map[string]bool)
+	for _, f := range facets {
+		if err := f.validate(); err != nil {
+			return err
+		}
+		if seen[f.Attribute] {
+			return NewQueryValidationError(fmt.Sprintf("attribute %s cannot have more than one facet", f.Attribute))
+		}
+		seen[f.Attribute] = true
+	}
+	return nil
+}
+
+// validate checks that the facet is well formed, whatever the type of its attribute
+func (facet AttributeFacet) validate() error {
+	if len(facet.Attribute) == 0 {
+		return NewQueryValidationError("an attribute facet needs an attribute")
+	}
+	switch facet.Kind {
+	case FacetKindTerms:
+		if facet.Size < 0 {
+			return NewQueryValidationError(fmt.Sprintf("facet size for %s cannot be negative", facet.Attribute))
+		}
+	case FacetKindRange:
+		if len(facet.Ranges) == 0 {
+			return NewQueryValidationError(fmt.Sprintf("range facet on %s needs at least one range", facet.Attribute))
+		}
+		for _, r := range facet.Ranges {
+			if (r.From == nil && r.To == nil) || (r.From != nil && r.To != nil && *r.From >= *r.To) {
+				return NewQueryValidationError(fmt.Sprintf("invalid range %s for %s", r.key(), facet.Attribute))
+			}
+		}
+	case FacetKindHistogram:
+		if facet.Interval <= 0 {
+			return NewQueryValidationError(fmt.Sprintf("histogram facet on %s needs a positive interval",
+				facet.Attribute))
+		}
+	default:
+		return NewQueryValidationError(fmt.Sprintf("unknown facet kind %s", facet.Kind))
+	}
+	return nil
+}
+
+// size gives the number of values of a terms facet
+func (facet AttributeFacet) size() int {
+	if facet.Size > 0 {
+		return facet.Size
+	}
+	return DefaultFacetSize
+}
+
+// key names a range in the buckets, like from-to with * for a missing bound
+func (r FacetRange) key() string {
+	bound := func(b *float64) string {
+		if b == nil {
+			return "*"
+		}
+		return scalarString(*b)
+	}
+	return bound(r.From) + "-" + bound(r.To)
+}
+
+func (r FacetRange) contains(v float64) bool {
+	return (r.From == nil || v >= *r.From) && (r.To == nil || v < *r.To)
+}
+
+// histogramBucket gives the bucket of a value, its lower bound being a multiple of the interval
+func histogramBucket(v float64, interval float64) Bucket {
+	from := math.Floor(v/interval) * interval
+	to := from + interval
+	return Bucket{Key: scalarString(from), From: &from, To: &to}
+}
+
+// attributeBuckets computes an attribute facet over the matching items like the Elastic aggregations do: terms by
+// descending count then by value, ranges in the order they were given and non empty histogram buckets by value
+// An item is counted once in a bucket, even if several of its values fall into it
+func attributeBuckets(sts []Status, facet AttributeFacet) ([]Bucket, FacetInfo) {
+	counts := make(map[string]uint64)
+	byKey := make(map[string]Bucket)
+	for _, st := range sts {
+		seen := make(map[string]bool)
+		for _, b := range facet.valueBuckets(fieldValues(st.Item, facet.Attribute)) {
+			if !seen[b.Key] {
+				seen[b.Key] = true
+				counts[b.Key]++
+				byKey[b.Key] = b
+			}
+		}
+	}
+	var buckets []Bucket
+	info := FacetInfo{}
+	switch facet.Kind {
+	case FacetKindTerms:
+		counts, info = topCounts(counts, facet.size())
+		for k := range counts {
+			buckets = append(buckets, byKey[k])
+		}
+	case FacetKindRange:
+		for _, r := range facet.Ranges {
+			buckets = append(buckets, Bucket{Key: r.key(), From: r.From, To: r.To})
+		}
+	default:
+		for _, b := range byKey {
+			buckets = append(buckets, b)
+		}
+	}
+	for i := range buckets {
+		buckets[i].Count = counts[buckets[i].Key]
+	}
+	switch facet.Kind {
+	case FacetKindTerms:
+		sort.Slice(buckets, func(i, j int) bool {
+			if buckets[i].Count != buckets[j].Count {
+				return buckets[i].Count > buckets[j].Count
+			}
+			return buckets[i].Key < buckets[j].Key
+		})
+	case FacetKindHistogram:
+		sort.Slice(buckets, func(i, j int) bool { return *buckets[i].From < *buckets[j].From })
+	}
+	if buckets == nil {
+		buckets = []Bucket{}
+	}
+	return buckets, info
+}
+
+// valueBuckets gives the buckets the values of an item fall into, values that are not numbers being ignored by range
+// and histogram facets
+func (facet AttributeFacet) valueBuckets(values []string) []Bucket {
+	var buckets []Bucket
+	for _, v := range values {
+		if facet.Kind == FacetKindTerms {
+			buckets = append(buckets, Bucket{Key: v})
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		if facet.Kind == FacetKindHistogram {
+			buckets = append(buckets, histogramBucket(n, facet.Interval))
+			continue
+		}
+		for _, r := range facet.Ranges {
+			if r.contains(n) {
+				buckets = append(buckets, Bucket{Key: r.key()})
+			}
+		}
+	}
+	return buckets
+}
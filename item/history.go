@@ -0,0 +1,111 @@
+package item
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxHistory is the maximum number of versions read when looking for a given version of an item
+const MaxHistory = 10000
+
+// ScanStore can go through all the items it stores
+// ScanIDs lists the IDs of all the items it ever stored, including deleted ones
+// ScanItems lists the current version of all the items that are not deleted
+// ScanStatuses lists the same versions with the time they were written
+// All close the channel when done, and send at most one error
+type ScanStore interface {
+	ScanIDs(idChannel chan ID, errorChannel chan error)
+	ScanItems(itemChannel chan Item, errorChannel chan error)
+	ScanStatuses(statusChannel chan Status, errorChannel chan error)
+}
+
+// scanItems sends the items of the statuses scanned from a store
+func scanItems(store ScanStore, itemChannel chan Item, errorChannel chan error) {
+	defer close(itemChannel)
+	statusC := make(chan Status)
+	go store.ScanStatuses(statusC, errorChannel)
+	for st := range statusC {
+		itemChannel <- st.Item
+	}
+}
+
+// FindVersion looks for a given version of an item in its history
+// It also returns the version that replaced it, which is empty if the version is the current one
+func FindVersion(hs HistoryStore, id ID, version string) (Status, Status, error) {
+	sts, err := hs.History(id, MaxHistory)
+	if err != nil {
+		return Status{}, Status{}, err
+	}
+	for i, st := range sts {
+		if st.Version == version {
+			if i > 0 {
+				return st, sts[i-1], nil
+			}
+			return st, Status{}, nil
+		}
+	}
+	return Status{}, Status{}, NewVersionNotFoundError(id, version)
+}
+
+// SubtreeStore can list all the items it ever stored under an item, including deleted ones, without going through
+// all the items
+type SubtreeStore interface {
+	SubtreeIDs(id ID) ([]ID, error)
+}
+
+// subtreeIDs returns the keys of an in memory store that are under the given item
+func subtreeIDs(keys []string, id ID) []ID {
+	prefix := IDToString(id) + "/"
+	var ids []ID
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			ids = append(ids, StringToID(k))
+		}
+	}
+	return ids
+}
+
+// SubtreeAt returns all the children of an item that were alive at the given time, parents first
+// It also returns the IDs of the children that are alive now but were not at that time, children first
+func SubtreeAt(store SubtreeStore, tts TimeTravelStore, id ID, at time.Time) ([]Item, []ID, error) {
+	ids, err := store.SubtreeIDs(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	var items []Item
+	var added []ID
+	for _, cid := range ids {
+		st, err := tts.ReadAt(cid, at)
+		if err != nil {
+			return nil, nil, err
+		}
+		if st.Status == "ALIVE" {
+			items = append(items, st.Item)
+			continue
+		}
+		st, err = tts.ReadAt(cid, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if st.Status == "ALIVE" {
+			added = append(added, cid)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return parentFirst(items[i].ID, items[j].ID)
+	})
+	sort.Slice(added, func(i, j int) bool {
+		return parentFirst(added[j], added[i])
+	})
+	return items, added, nil
+}
+
+// parentFirst orders IDs by depth then by name
+func parentFirst(id1 ID, id2 ID) bool {
+	if len(id1) != len(id2) {
+		return len(id1) < len(id2)
+	}
+	return IDToString(id1) < IDToString(id2)
+}
@@ -0,0 +1,74 @@
+package item
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindVersion(t *testing.T) {
+	require := require.New(t)
+	store := NewLocalStore()
+	defer store.Close()
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value2"}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Write(item2))
+	sts, err := store.History(item1.ID, 2)
+	require.NoError(err)
+
+	st, next, err := FindVersion(store, item1.ID, sts[1].Version)
+	require.NoError(err)
+	require.Equal(sts[1], st)
+	require.Equal(sts[0], next)
+
+	st, next, err = FindVersion(store, item1.ID, sts[0].Version)
+	require.NoError(err)
+	require.Equal(sts[0], st)
+	require.Empty(next.Version)
+
+	_, _, err = FindVersion(store, item1.ID, "unknown")
+	require.True(IsVersionNotFound(err))
+}
+
+func TestSubtreeAt(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestSubtreeAt(store, store, t)
+}
+
+func DoTestSubtreeAt(store Store, tts TimeTravelStore, t *testing.T) {
+	require := require.New(t)
+	ss := store.(SubtreeStore)
+	team := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{}}
+	member1 := Item{[]string{"Team", "Team1", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{}}
+	member2 := Item{[]string{"Team", "Team1", "Member", "Member2"}, "Member", "Member2", map[string]interface{}{}}
+	member3 := Item{[]string{"Team", "Team1", "Member", "Member3"}, "Member", "Member3", map[string]interface{}{}}
+	role := Item{[]string{"Team", "Team1", "Member", "Member1", "Role", "Role1"}, "Role", "Role1", map[string]interface{}{}}
+	role3 := Item{[]string{"Team", "Team1", "Member", "Member3", "Role", "Role1"}, "Role", "Role1", map[string]interface{}{}}
+	other := Item{[]string{"Team", "Team2", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{}}
+	for _, it := range []Item{team, role, member2, member1, other} {
+		require.NoError(store.Write(it))
+	}
+	// left over by a previous run on a persistent store
+	require.NoError(store.Delete(role3.ID))
+	require.NoError(store.Delete(member3.ID))
+	time.Sleep(time.Millisecond)
+	at := time.Now()
+	time.Sleep(time.Millisecond)
+	require.NoError(store.Delete(member2.ID))
+	require.NoError(store.Write(member3))
+	require.NoError(store.Write(role3))
+
+	its, added, err := SubtreeAt(ss, tts, team.ID, at)
+	require.NoError(err)
+	require.Equal([]Item{member1, member2, role}, its)
+	// children first, so that deleting them in order never leaves an orphan
+	require.Equal([]ID{role3.ID, member3.ID}, added)
+
+	its, added, err = SubtreeAt(ss, tts, team.ID, time.Now())
+	require.NoError(err)
+	require.Equal([]Item{member1, member3, role, role3}, its)
+	require.Empty(added)
+}
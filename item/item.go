@@ -2,9 +2,12 @@ package item
 
 import (
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/gocql/gocql"
 )
 
 // ID is a list of string components
@@ -45,10 +48,48 @@ func (item *Item) Flatten() map[string]interface{} {
 	return body
 }
 
-// Status is a item + a status
+// Status is a version of an item: the item, its status, a version identifier and the time it was written
 type Status struct {
-	Item   Item
-	Status string
+	Item    Item      `json:"item"`
+	Status  string    `json:"status"`
+	Version string    `json:"version"`
+	Updated time.Time `json:"updated"`
+}
+
+// newVersion generates a new version identifier, a time based UUID like the ones Cassandra uses
+func newVersion() (string, time.Time) {
+	u := gocql.TimeUUID()
+	return u.String(), u.Time()
+}
+
+// ReadStatus reads the current version of an item, with its version metadata if the store keeps history
+// The returned status is empty if the item does not exist
+func ReadStatus(store Store, id ID) (Status, error) {
+	if hs, ok := store.(HistoryStore); ok {
+		sts, err := hs.History(id, 1)
+		if err != nil || len(sts) == 0 || sts[0].Status != "ALIVE" {
+			return Status{}, err
+		}
+		return sts[0], nil
+	}
+	it, err := store.Read(id)
+	if err != nil || it.IsEmpty() {
+		return Status{}, err
+	}
+	return Status{Item: it, Status: "ALIVE"}, nil
+}
+
+// latestStatus reads the latest status of an item, deleted or not, with the time it was written if the store keeps
+// history
+func latestStatus(store Store, id ID) (Status, error) {
+	if hs, ok := store.(HistoryStore); ok {
+		sts, err := hs.History(id, 1)
+		if err != nil || len(sts) == 0 {
+			return Status{}, err
+		}
+		return sts[0], nil
+	}
+	return ReadStatus(store, id)
 }
 
 // Facet is an enum of all the possible facets
@@ -67,11 +108,31 @@ type Query struct {
 	From        int
 	Length      int
 	Facets      []Facet
+	// Clause is an optional structured condition, items have to match both it and the query string
+	Clause *Clause
+	// Sort orders the results, by relevance if empty
+	Sort []Sort
+	// After is the cursor of the last result of the previous page, to page deeply instead of using From
+	After string
+	// FacetSizes limits the number of values returned for a facet, DefaultFacetSize if not set
+	FacetSizes map[Facet]int
+	// AttributeFacets are facets on attributes of the contents
+	AttributeFacets []AttributeFacet
+	// Highlight asks for the fragments of text that matched the query, only the Elastic store gives them
+	Highlight bool
 }
 
+// DefaultFacetSize is the number of values returned for a facet, the most frequent ones
+const DefaultFacetSize = 10
+
 // NewQuery builds a new query from the given string, returning the first 10 results
 func NewQuery(queryString string) *Query {
-	return &Query{queryString, 0, 10, make([]Facet, 0)}
+	return &Query{QueryString: queryString, Length: 10, Facets: make([]Facet, 0)}
+}
+
+// NewClauseQuery builds a new query from a structured clause, returning the first 10 results
+func NewClauseQuery(clause Clause) *Query {
+	return &Query{Length: 10, Facets: make([]Facet, 0), Clause: &clause}
 }
 
 // Page modifies the given query to add paging (from/length) information
@@ -81,6 +142,14 @@ func (q *Query) Page(from int, length int) *Query {
 	return q
 }
 
+// PageAfter modifies the given query to return the results following the given cursor
+func (q *Query) PageAfter(cursor string, length int) *Query {
+	q.From = 0
+	q.After = cursor
+	q.Length = length
+	return q
+}
+
 // AddFacet add a facet to the query
 func (q *Query) AddFacet(facet Facet) *Query {
 	q.Facets = append(q.Facets, facet)
@@ -93,16 +162,70 @@ func (q *Query) AddAllFacets() *Query {
 	return q
 }
 
+// SetFacetSize changes the number of values returned for a facet
+func (q *Query) SetFacetSize(facet Facet, size int) *Query {
+	if q.FacetSizes == nil {
+		q.FacetSizes = make(map[Facet]int)
+	}
+	q.FacetSizes[facet] = size
+	return q
+}
+
+// FacetSize gives the number of values returned for a facet
+func (q *Query) FacetSize(facet Facet) int {
+	if size, ok := q.FacetSizes[facet]; ok && size > 0 {
+		return size
+	}
+	return DefaultFacetSize
+}
+
+// Name gives the name of a facet in search results
+func (f Facet) Name() string {
+	name, _ := facetValues(f)
+	return name
+}
+
+// FacetByName gives the facet with the given name in search results
+func FacetByName(name string) (Facet, bool) {
+	for _, f := range []Facet{FacetName, FacetType, FacetNamespace} {
+		if f.Name() == name {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
 // Score is a item + a search score
 type Score struct {
 	Item  Item    `json:"item"`
 	Score float64 `json:"score"`
+	// Cursor can be given as the After of a query to get the results following this one
+	Cursor string `json:"cursor,omitempty"`
+	// Highlights are the fragments of text that matched the query, by field, when the query asked for them
+	Highlights map[string][]string `json:"highlights,omitempty"`
 }
 
 // SearchResult encapsulate the, ahem, search results
 type SearchResult struct {
 	Scores []Score                      `json:"scores"`
 	Facets map[string]map[string]uint64 `json:"facets"`
+	// Next is the cursor to get the following page, empty on the last page
+	Next string `json:"next,omitempty"`
+	// Total is the number of items matching the query
+	Total int64 `json:"total"`
+	// Took is the time the search took in milliseconds
+	Took int64 `json:"tookMillis"`
+	// FacetInfo tells for each facet if some values were left out
+	FacetInfo map[string]FacetInfo `json:"facetInfo"`
+	// AttributeFacets gives the buckets of each attribute facet, by attribute
+	AttributeFacets map[string][]Bucket `json:"attributeFacets,omitempty"`
+}
+
+// FacetInfo describes the values of a facet that are not returned because of its size
+type FacetInfo struct {
+	Truncated bool `json:"truncated"`
+	// Other is the sum of the counts of the values left out
+	Other uint64 `json:"other"`
 }
 
 // StoreError represents a store error
@@ -153,11 +276,88 @@ func NewMultipleItemErrors(errs []string) error {
 	return errors.New(StoreError{"ITEM_MULTIPLE", strings.Join(errs, "\n")})
 }
 
+// NewItemIndexError when the search engine refuses to index an item
+func NewItemIndexError(reason string) error {
+	return errors.New(StoreError{"ITEM_INDEX", reason})
+}
+
+// NewReindexError when an index could not be rebuilt
+func NewReindexError(reason string) error {
+	return errors.New(StoreError{"REINDEX", reason})
+}
+
+// NewMappingConflictError when attributes are already mapped in the index with types their values cannot be indexed as
+func NewMappingConflictError(index string, fields []string) error {
+	return errors.New(StoreError{"MAPPING_CONFLICT",
+		fmt.Sprintf("%s maps %s with another type than the model, reindex to map them again", index, strings.Join(fields, ", "))})
+}
+
+// IsMappingConflict returns true if the error comes from attributes that need a reindex to be mapped as the model says
+func IsMappingConflict(err error) bool {
+	return errorCode(err) == "MAPPING_CONFLICT"
+}
+
 // NewItemUnmarshallError when the item could not be unmarshalled properly from the store
 func NewItemUnmarshallError(err error) error {
 	return errors.New(StoreError{"ITEM_UNMARSHALL", err.Error()})
 }
 
+// NewVersionConflictError when a conditional write finds another version than the expected one
+func NewVersionConflictError(id ID, version string) error {
+	return errors.New(StoreError{"VERSION_CONFLICT", fmt.Sprintf("%s is not at version %s", IDToString(id), version)})
+}
+
+// IsVersionConflict returns true if the error is a version conflict from a conditional write
+func IsVersionConflict(err error) bool {
+	return errorCode(err) == "VERSION_CONFLICT"
+}
+
+// NewVersionNotFoundError when a version of an item cannot be found in its history
+func NewVersionNotFoundError(id ID, version string) error {
+	return errors.New(StoreError{"VERSION_NOT_FOUND", fmt.Sprintf("%s has no version %s", IDToString(id), version)})
+}
+
+// IsVersionNotFound returns true if the error is a version that could not be found
+func IsVersionNotFound(err error) bool {
+	return errorCode(err) == "VERSION_NOT_FOUND"
+}
+
+func errorCode(err error) string {
+	if e, ok := err.(*errors.Error); ok {
+		err = e.Err
+	}
+	if se, ok := err.(StoreError); ok {
+		return se.code
+	}
+	return ""
+}
+
+// NewInvalidCursorError when a pagination cursor was not returned by a previous listing
+func NewInvalidCursorError(cursor string) error {
+	return errors.New(StoreError{"INVALID_CURSOR", fmt.Sprintf("Invalid cursor %s", cursor)})
+}
+
+// IsInvalidCursor returns true if the error is a pagination cursor that cannot be decoded
+func IsInvalidCursor(err error) bool {
+	return errorCode(err) == "INVALID_CURSOR"
+}
+
+// NewQueryParseError when a query string cannot be understood
+func NewQueryParseError(query string, message string) error {
+	return errors.New(StoreError{"QUERY_PARSE", fmt.Sprintf("%s: %s", message, query)})
+}
+
+// NewQueryValidationError when a structured query is not well formed
+func NewQueryValidationError(message string) error {
+	return errors.New(StoreError{"QUERY_INVALID", message})
+}
+
+// IsInvalidQuery returns true if the error comes from a query that cannot be parsed or is not well formed
+func IsInvalidQuery(err error) bool {
+	code := errorCode(err)
+	return code == "QUERY_INVALID" || code == "QUERY_PARSE"
+}
+
 // Store defines the interface to manipulate items
 type Store interface {
 	Read(id ID) (Item, error)
@@ -171,6 +371,141 @@ type HistoryStore interface {
 	History(id ID, limit int) ([]Status, error)
 }
 
+// AnyVersion is the version to use in conditional writes to only require the item to exist
+const AnyVersion = "*"
+
+// NoVersion is the version to use in conditional writes to only create the item, if it does not exist or is deleted
+const NoVersion = "-"
+
+// ConditionalStore can write or delete an item only if its current version is the expected one
+// Both methods return a version conflict error if the item is deleted or at another version
+// WriteIf with NoVersion only creates the item, and fails if it exists; DeleteIf always fails with NoVersion
+type ConditionalStore interface {
+	WriteIf(item Item, version string) error
+	DeleteIf(id ID, version string) error
+}
+
+// NewConditionalWriteUnsupportedError when a version is given to a store that cannot write conditionally
+func NewConditionalWriteUnsupportedError() error {
+	return errors.New(StoreError{"CONDITIONAL_UNSUPPORTED", "the store does not support conditional writes"})
+}
+
+// IsConditionalWriteUnsupported returns true if the error comes from a version given to a store that cannot use it
+func IsConditionalWriteUnsupported(err error) bool {
+	return errorCode(err) == "CONDITIONAL_UNSUPPORTED"
+}
+
+// isExpectedVersion checks the current version of an item against the version expected by a conditional write
+// An empty version accepts any state, for stores that make unconditional writes through conditional ones
+func isExpectedVersion(current Status, version string) bool {
+	if len(version) == 0 {
+		return true
+	}
+	if version == NoVersion {
+		return current.Status != "ALIVE"
+	}
+	return current.Status == "ALIVE" && (version == AnyVersion || version == current.Version)
+}
+
+// BatchStore can write many items in one go
+// The returned slice has one error per item, nil if the item was written
+type BatchStore interface {
+	WriteBatch(items []Item) []error
+}
+
+// WriteBatch writes items with a single batch if the store supports it, one by one otherwise
+func WriteBatch(store Store, items []Item) []error {
+	if bs, ok := store.(BatchStore); ok {
+		return bs.WriteBatch(items)
+	}
+	errs := make([]error, len(items))
+	for i, it := range items {
+		errs[i] = store.Write(it)
+	}
+	return errs
+}
+
+// AtomicStore can write several items so that either all of them or none of them are stored
+type AtomicStore interface {
+	WriteAll(items []Item) error
+}
+
+// AtomicChangeStore can write several items and delete others so that either all the changes or none of them are
+// stored
+type AtomicChangeStore interface {
+	ChangeAll(items []Item, deleted []ID) error
+}
+
+// WriteAll writes all the items in all the stores, or none of them
+// Stores that cannot write atomically, and all stores if one of them fails, are rolled back
+// by writing back the previous version of each item, or a deletion if the item did not exist
+func WriteAll(stores []Store, items []Item) error {
+	var done []Store
+	var previous [][]Item
+	for _, store := range stores {
+		if store == nil {
+			continue
+		}
+		prev := make([]Item, len(items))
+		var err error
+		for i, it := range items {
+			prev[i], err = store.Read(it.ID)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = writeAll(store, items, prev)
+		}
+		if err != nil {
+			for i, st := range done {
+				rollback(st, items, previous[i])
+			}
+			return err
+		}
+		done = append(done, store)
+		previous = append(previous, prev)
+	}
+	return nil
+}
+
+func writeAll(store Store, items []Item, prev []Item) error {
+	if as, ok := store.(AtomicStore); ok {
+		return as.WriteAll(items)
+	}
+	var errs []string
+	for _, err := range WriteBatch(store, items) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		rollback(store, items, prev)
+	}
+	return NewMultipleItemErrors(errs)
+}
+
+// rollback writes back the previous version of items, logging errors since there is nothing more we can do
+func rollback(store Store, items []Item, prev []Item) {
+	for i, it := range items {
+		var err error
+		if prev[i].IsEmpty() {
+			err = store.Delete(it.ID)
+		} else {
+			err = store.Write(prev[i])
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// TimeTravelStore can read an item as it was at a given time
+// The returned status is empty if the item did not exist at that time
+type TimeTravelStore interface {
+	ReadAt(id ID, at time.Time) (Status, error)
+}
+
 // SearchStore can provide full text search
 type SearchStore interface {
 	Search(query *Query) (SearchResult, error)
@@ -179,11 +514,22 @@ type SearchStore interface {
 
 // DeleteTree deletes an item and all its children
 func DeleteTree(id ID, stores []Store, searchStore SearchStore) error {
+	return deleteTree(id, stores, searchStore, true)
+}
+
+// DeleteChildren deletes all the children of an item, but not the item itself
+func DeleteChildren(id ID, stores []Store, searchStore SearchStore) error {
+	return deleteTree(id, stores, searchStore, false)
+}
+
+func deleteTree(id ID, stores []Store, searchStore SearchStore, withRoot bool) error {
 
 	errorC := make(chan error)
 	go func() {
 		defer close(errorC)
-		deleteMultiple(id, stores, errorC)
+		if withRoot {
+			deleteMultiple(id, stores, errorC)
+		}
 		scoreC := make(chan Score)
 
 		go searchStore.Scroll(fmt.Sprintf("item.id:%s/*", IDToString(id)), scoreC, errorC)
@@ -2,8 +2,11 @@ package item
 
 import (
 	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -48,6 +51,24 @@ func DoTestStoreErrors(store Store, t *testing.T) {
 	require.True(strings.HasPrefix(err.Error(), "EMPTY_ITEM"))
 }
 
+func TestStatusJSON(t *testing.T) {
+	require := require.New(t)
+	updated := time.Date(2018, 11, 24, 15, 14, 48, 0, time.UTC)
+	st := Status{Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{}}, "ALIVE", "version1", updated}
+	b, err := json.Marshal(st)
+	require.NoError(err)
+	require.Equal(`{"item":{"id":["Team","Team1"],"type":"Team","name":"Team1","contents":{}},"status":"ALIVE","version":"version1","updated":"2018-11-24T15:14:48Z"}`, string(b))
+}
+
+// withoutVersions keeps only the items and statuses, to compare with expected values
+func withoutVersions(sts []Status) []Status {
+	res := make([]Status, len(sts))
+	for i, st := range sts {
+		res[i] = Status{Item: st.Item, Status: st.Status}
+	}
+	return res
+}
+
 func TestAllNamespaces(t *testing.T) {
 	require := require.New(t)
 	id := []string{"Organization", "Org1", "Team", "Team1"}
@@ -55,3 +76,668 @@ func TestAllNamespaces(t *testing.T) {
 	exp := []string{"Organization", "Organization/Org1", "Organization/Org1/Team"}
 	require.Equal(exp, ns)
 }
+
+func DoTestSearchStore(store Store, ss SearchStore, t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Organization", "Org1"}, "Organization", "Org1", map[string]interface{}{
+		"field1": "value1",
+		"field2": "value2",
+	}}
+	item2 := Item{[]string{"Organization", "Org1", "Team", "Team1"}, "Team", "Team1", map[string]interface{}{
+		"field1": "value1",
+		"field2": "value4",
+	}}
+	item3 := Item{[]string{"Organization", "Org2"}, "Organization", "Org2", map[string]interface{}{
+		"field1": "Other Value",
+	}}
+	for _, it := range []Item{item1, item2, item3} {
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+	}
+
+	rs, err := ss.Search(NewQuery("value1").AddAllFacets())
+	require.NoError(err)
+	require.Equal(2, len(rs.Scores))
+	require.Equal(item1, rs.Scores[0].Item)
+	require.Equal(item2, rs.Scores[1].Item)
+	exp := map[string]map[string]uint64{
+		"item.name": {
+			"Org1":  1,
+			"Team1": 1,
+		},
+		"item.type": {
+			"Organization": 1,
+			"Team":         1,
+		},
+		"item.ns": {
+			"Organization":           2,
+			"Organization/Org1":      1,
+			"Organization/Org1/Team": 1,
+		},
+	}
+	require.Equal(exp, rs.Facets)
+
+	rs, err = ss.Search(NewQuery("value1").Page(1, 10))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(item2, rs.Scores[0].Item)
+	require.Empty(rs.Facets)
+
+	rs, err = ss.Search(NewQuery("value"))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(item3, rs.Scores[0].Item)
+
+	rs, err = ss.Search(NewQuery("item.id:Organization/Org1/*"))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(item2, rs.Scores[0].Item)
+
+	rs, err = ss.Search(NewQuery("item.idlength:2 and item.type:Organization and item.name:Org2"))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(item3, rs.Scores[0].Item)
+
+	rs, err = ss.Search(NewQuery("field2:value4 or item.name:Org2"))
+	require.NoError(err)
+	require.Equal(2, len(rs.Scores))
+	require.Equal(item2, rs.Scores[0].Item)
+	require.Equal(item3, rs.Scores[1].Item)
+
+	rs, err = ss.Search(NewQuery("item.type:Organization and not field1:value1"))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(item3, rs.Scores[0].Item)
+
+	_, err = ss.Search(NewQuery("(item.type:Organization"))
+	require.Error(err)
+	require.True(strings.HasPrefix(err.Error(), "QUERY_PARSE"))
+
+	item4 := Item{[]string{"Lab", "Alpha"}, "Lab", "Research Alpha", map[string]interface{}{}}
+	require.NoError(store.Write(item4))
+	defer store.Delete(item4.ID)
+	rs, err = ss.Search(NewQuery("alpha"))
+	require.NoError(err)
+	require.Equal(1, len(rs.Scores))
+	require.Equal(item4, rs.Scores[0].Item)
+
+	scoreC := make(chan Score)
+	errorC := make(chan error, 1)
+	go ss.Scroll("item.id:Organization/*", scoreC, errorC)
+	var ids []ID
+	for sc := range scoreC {
+		ids = append(ids, sc.Item.ID)
+	}
+	require.Equal([]ID{item1.ID, item2.ID, item3.ID}, ids)
+	require.Empty(errorC)
+}
+
+func DoTestTimeTravelStore(store Store, tts TimeTravelStore, t *testing.T) {
+	require := require.New(t)
+	// unique id so that versions from previous runs do not interfere
+	id := []string{"Team", fmt.Sprintf("Team%d", time.Now().UnixNano())}
+	item1 := Item{id, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{id, "Team", "Team1", map[string]interface{}{"field1": "value2"}}
+
+	t0 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(store.Write(item1))
+	time.Sleep(10 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(store.Write(item2))
+	time.Sleep(10 * time.Millisecond)
+	t2 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(store.Delete(item1.ID))
+	time.Sleep(10 * time.Millisecond)
+	t3 := time.Now()
+
+	st, err := tts.ReadAt(item1.ID, t0)
+	require.NoError(err)
+	require.Equal(Status{}, st)
+	st, err = tts.ReadAt(item1.ID, t1)
+	require.NoError(err)
+	require.Equal(item1, st.Item)
+	require.Equal("ALIVE", st.Status)
+	require.True(st.Updated.After(t0) && st.Updated.Before(t1))
+	st, err = tts.ReadAt(item1.ID, t2)
+	require.NoError(err)
+	require.Equal(item2, st.Item)
+	require.Equal("ALIVE", st.Status)
+	sts, err := store.(HistoryStore).History(item1.ID, 2)
+	require.NoError(err)
+	require.Equal(sts[1], st)
+	st, err = tts.ReadAt(item1.ID, t3)
+	require.NoError(err)
+	require.Equal("DELETED", st.Status)
+}
+
+func DoTestConditionalStore(store Store, cs ConditionalStore, t *testing.T) {
+	require := require.New(t)
+	id := []string{"Team", fmt.Sprintf("Team%d", time.Now().UnixNano())}
+	item1 := Item{id, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{id, "Team", "Team1", map[string]interface{}{"field1": "value2"}}
+
+	err := cs.WriteIf(item1, AnyVersion)
+	require.True(IsVersionConflict(err))
+	require.NoError(store.Write(item1))
+	st1, err := ReadStatus(store, id)
+	require.NoError(err)
+	require.NotEmpty(st1.Version)
+
+	require.NoError(cs.WriteIf(item2, st1.Version))
+	err = cs.WriteIf(item1, st1.Version)
+	require.True(IsVersionConflict(err))
+	require.True(strings.HasPrefix(err.Error(), "VERSION_CONFLICT"))
+	it, err := store.Read(id)
+	require.NoError(err)
+	require.Equal(item2, it)
+
+	require.NoError(cs.WriteIf(item1, AnyVersion))
+	err = cs.DeleteIf(id, st1.Version)
+	require.True(IsVersionConflict(err))
+	st2, err := ReadStatus(store, id)
+	require.NoError(err)
+	require.Equal(item1, st2.Item)
+	require.NoError(cs.DeleteIf(id, st2.Version))
+	it, err = store.Read(id)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+
+	err = cs.DeleteIf(id, AnyVersion)
+	require.True(IsVersionConflict(err))
+	err = cs.WriteIf(item1, st2.Version)
+	require.True(IsVersionConflict(err))
+
+	// a deleted item can be created again, once
+	require.NoError(cs.WriteIf(item1, NoVersion))
+	err = cs.WriteIf(item2, NoVersion)
+	require.True(IsVersionConflict(err))
+	it, err = store.Read(id)
+	require.NoError(err)
+	require.Equal(item1, it)
+	require.NoError(store.Delete(id))
+	item3 := Item{[]string{"Team", fmt.Sprintf("Team%d", time.Now().UnixNano())}, "Team", "Team3", map[string]interface{}{}}
+	require.NoError(cs.WriteIf(item3, NoVersion))
+	defer store.Delete(item3.ID)
+	err = cs.WriteIf(item3, NoVersion)
+	require.True(IsVersionConflict(err))
+	err = cs.DeleteIf(item3.ID, NoVersion)
+	require.True(IsVersionConflict(err))
+}
+
+func DoTestWriteBatch(store Store, t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{"field1": "value2"}}
+	errs := WriteBatch(store, []Item{item1, {}, item2})
+	require.Equal(3, len(errs))
+	require.NoError(errs[0])
+	require.Error(errs[1])
+	require.NoError(errs[2])
+	for _, it := range []Item{item1, item2} {
+		it2, err := store.Read(it.ID)
+		require.NoError(err)
+		require.Equal(it, it2)
+		require.NoError(store.Delete(it.ID))
+	}
+}
+
+func DoTestAtomicStore(store Store, as AtomicStore, t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team1", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{}}
+	require.Error(as.WriteAll([]Item{item1, {}}))
+	it, err := store.Read(item1.ID)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+
+	require.NoError(as.WriteAll([]Item{item1, item2}))
+	for _, it := range []Item{item1, item2} {
+		it2, err := store.Read(it.ID)
+		require.NoError(err)
+		require.Equal(it, it2)
+		require.NoError(store.Delete(it.ID))
+	}
+
+	if cs, ok := as.(AtomicChangeStore); ok {
+		require.NoError(store.Write(item2))
+		require.Error(cs.ChangeAll([]Item{item1, {}}, []ID{item2.ID}))
+		it, err = store.Read(item2.ID)
+		require.NoError(err)
+		require.Equal(item2, it)
+		require.NoError(cs.ChangeAll([]Item{item1}, []ID{item2.ID}))
+		it, err = store.Read(item2.ID)
+		require.NoError(err)
+		require.True(it.IsEmpty())
+		it, err = store.Read(item1.ID)
+		require.NoError(err)
+		require.Equal(item1, it)
+		require.NoError(store.Delete(item1.ID))
+	}
+}
+
+// failingStore fails to write a given item, and can only write items one by one
+type failingStore struct {
+	Store
+	failID string
+}
+
+func (s *failingStore) Write(item Item) error {
+	if IDToString(item.ID) == s.failID {
+		return NewStoreInternalError(fmt.Errorf("failure"))
+	}
+	return s.Store.Write(item)
+}
+
+func TestWriteAllRollback(t *testing.T) {
+	require := require.New(t)
+	primary := NewLocalStore()
+	secondary := &failingStore{NewLocalStore(), "Team/Team2"}
+	old := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value2"}}
+	item2 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{}}
+	require.NoError(primary.Write(old))
+
+	require.Error(WriteAll([]Store{primary, nil, secondary}, []Item{item1, item2}))
+	it, err := primary.Read(item1.ID)
+	require.NoError(err)
+	require.Equal(old, it)
+	for _, s := range []Store{primary, secondary} {
+		it, err = s.Read(item2.ID)
+		require.NoError(err)
+		require.True(it.IsEmpty())
+	}
+	it, err = secondary.Read(item1.ID)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+	sts, err := primary.History(item2.ID, 10)
+	require.NoError(err)
+	require.Equal("DELETED", sts[0].Status)
+
+	secondary.failID = ""
+	require.NoError(WriteAll([]Store{primary, secondary}, []Item{item1, item2}))
+	for _, s := range []Store{primary, secondary} {
+		it, err = s.Read(item1.ID)
+		require.NoError(err)
+		require.Equal(item1, it)
+	}
+}
+
+func DoTestScanItems(store Store, ss ScanStore, t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{"field1": "value2"}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Write(item2))
+	require.NoError(store.Delete(item2.ID))
+	defer store.Delete(item1.ID)
+
+	itemC := make(chan Item)
+	errorC := make(chan error, 1)
+	go ss.ScanItems(itemC, errorC)
+	var found []Item
+	for it := range itemC {
+		if it.Type == "Team" {
+			found = append(found, it)
+		}
+	}
+	require.Equal(0, len(errorC))
+	require.Equal([]Item{item1}, found)
+
+	statusC := make(chan Status)
+	go ss.ScanStatuses(statusC, errorC)
+	var foundSts []Status
+	for st := range statusC {
+		if st.Item.Type == "Team" {
+			foundSts = append(foundSts, st)
+		}
+	}
+	require.Equal(0, len(errorC))
+	require.Equal(1, len(foundSts))
+	require.Equal(item1, foundSts[0].Item)
+	require.Equal("ALIVE", foundSts[0].Status)
+	require.False(foundSts[0].Updated.IsZero())
+	if hs, ok := store.(HistoryStore); ok {
+		sts, err := hs.History(item1.ID, 1)
+		require.NoError(err)
+		require.Equal(sts[0].Version, foundSts[0].Version)
+	}
+}
+
+func DoTestListStore(store Store, ls ListStore, t *testing.T) {
+	require := require.New(t)
+	org := Item{[]string{"Org", "ListOrg"}, "Org", "ListOrg", map[string]interface{}{"field1": "value1"}}
+	team1 := Item{[]string{"Org", "ListOrg", "Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	team2 := Item{[]string{"Org", "ListOrg", "Team", "Team2"}, "Team", "Team2", map[string]interface{}{"field1": "value2"}}
+	team3 := Item{[]string{"Org", "ListOrg", "Team", "Team3"}, "Team", "Team3", map[string]interface{}{"field1": "value3"}}
+	member := Item{[]string{"Org", "ListOrg", "Team", "Team1", "Member", "Member1"}, "Member", "Member1", map[string]interface{}{"field1": "value4"}}
+	other := Item{[]string{"Org", "ListOrg2"}, "Org", "ListOrg2", map[string]interface{}{"field1": "value5"}}
+	for _, it := range []Item{team3, org, member, team1, team2, other} {
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+	}
+	require.NoError(store.Delete(team3.ID))
+
+	its, next, err := ls.Children(org.ID, "", 10)
+	require.NoError(err)
+	require.Equal([]Item{team1, team2}, its)
+	require.Empty(next)
+
+	its, next, err = ls.Children(org.ID, "", 1)
+	require.NoError(err)
+	require.Equal([]Item{team1}, its)
+	require.NotEmpty(next)
+	its, next, err = ls.Children(org.ID, next, 1)
+	require.NoError(err)
+	require.Equal([]Item{team2}, its)
+	if len(next) > 0 {
+		its, next, err = ls.Children(org.ID, next, 1)
+		require.NoError(err)
+		require.Empty(its)
+		require.Empty(next)
+	}
+
+	its, next, err = ls.Descendants(org.ID, "", 10)
+	require.NoError(err)
+	require.Equal([]Item{team1, member, team2}, its)
+	require.Empty(next)
+
+	its, _, err = ls.Descendants(team2.ID, "", 10)
+	require.NoError(err)
+	require.Empty(its)
+
+	_, _, err = ls.Children(org.ID, "not a cursor!", 10)
+	require.True(IsInvalidCursor(err))
+}
+
+func DoTestClauseSearch(store Store, ss SearchStore, t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Clause", "C1"}, "Clause", "First", map[string]interface{}{
+		"status": "open",
+		"rank":   1.0,
+	}}
+	item2 := Item{[]string{"Clause", "C2"}, "Clause", "Second", map[string]interface{}{
+		"status": "closed",
+		"rank":   5.0,
+	}}
+	item3 := Item{[]string{"Clause", "C3"}, "Clause", "Third", map[string]interface{}{
+		"status": "open",
+		"name":   "attribute",
+	}}
+	for _, it := range []Item{item1, item2, item3} {
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+	}
+	search := func(clause Clause) []Item {
+		ns := Clause{Term: &TermClause{Field: "namespace", Value: "Clause"}}
+		rs, err := ss.Search(NewClauseQuery(Clause{Bool: &BoolClause{Must: []Clause{ns, clause}}}))
+		require.NoError(err)
+		var its []Item
+		for _, sc := range rs.Scores {
+			its = append(its, sc.Item)
+		}
+		sort.Slice(its, func(i, j int) bool { return its[i].Name < its[j].Name })
+		return its
+	}
+
+	require.Equal([]Item{item1, item3}, search(Clause{Term: &TermClause{Field: "status", Value: "open"}}))
+	require.Equal([]Item{item2}, search(Clause{Term: &TermClause{Field: "name", Value: "Second"}}))
+	require.Equal([]Item{item3}, search(Clause{Term: &TermClause{Field: "contents.name", Value: "attribute"}}))
+	require.Equal([]Item{item2}, search(Clause{Term: &TermClause{Field: "rank", Value: 5.0}}))
+	require.Equal([]Item{item2}, search(Clause{Prefix: &PrefixClause{Field: "name", Value: "S"}}))
+	require.Equal([]Item{item1, item3}, search(Clause{Prefix: &PrefixClause{Field: "status", Value: "op"}}))
+	require.Equal([]Item{item2}, search(Clause{Range: &RangeClause{Field: "rank", Gt: 1.0}}))
+	require.Equal([]Item{item1, item2}, search(Clause{Range: &RangeClause{Field: "rank", Gte: 1.0, Lte: 5.0}}))
+	require.Equal([]Item{item2}, search(Clause{Range: &RangeClause{Field: "status", Lt: "d"}}))
+	require.Equal([]Item{item1, item2}, search(Clause{Exists: &ExistsClause{Field: "rank"}}))
+	require.Equal([]Item{item3}, search(Clause{Bool: &BoolClause{
+		Should:  []Clause{{Term: &TermClause{Field: "id", Value: "Clause/C1"}}, {Term: &TermClause{Field: "id", Value: "Clause/C3"}}},
+		MustNot: []Clause{{Exists: &ExistsClause{Field: "rank"}}},
+	}}))
+
+	for _, c := range []Clause{
+		{},
+		{Term: &TermClause{Field: "status", Value: "open"}, Exists: &ExistsClause{Field: "status"}},
+		{Term: &TermClause{Value: "open"}},
+		{Term: &TermClause{Field: "status"}},
+		{Prefix: &PrefixClause{Field: "status"}},
+		{Range: &RangeClause{Field: "rank"}},
+		{Range: &RangeClause{Field: "rank", Gt: 1.0, Lt: "z"}},
+		{Bool: &BoolClause{}},
+		{Bool: &BoolClause{Must: []Clause{{Exists: &ExistsClause{}}}}},
+	} {
+		_, err := ss.Search(NewClauseQuery(c))
+		require.True(IsInvalidQuery(err), "%v", err)
+	}
+}
+
+func DoTestSortSearch(store Store, ss SearchStore, t *testing.T) {
+	require := require.New(t)
+	item1 := Item{[]string{"Sorted", "S1"}, "Sorted", "Charlie", map[string]interface{}{"rank": 2.0, "label": "b"}}
+	item2 := Item{[]string{"Sorted", "S2"}, "Sorted", "Alpha", map[string]interface{}{"rank": 10.0}}
+	item3 := Item{[]string{"Sorted", "S3"}, "Sorted", "Bravo", map[string]interface{}{"rank": 2.0, "label": "a"}}
+	for _, it := range []Item{item1, item2, item3} {
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+	}
+	names := func(sorts ...Sort) []string {
+		rs, err := ss.Search(NewQuery("item.type:Sorted").SortBy(sorts...))
+		require.NoError(err)
+		var ns []string
+		for _, sc := range rs.Scores {
+			ns = append(ns, sc.Item.Name)
+		}
+		return ns
+	}
+
+	require.Equal([]string{"Alpha", "Bravo", "Charlie"}, names(Sort{Field: "item.name", Text: true}))
+	require.Equal([]string{"Charlie", "Bravo", "Alpha"}, names(Sort{Field: "item.name", Descending: true, Text: true}))
+	// numbers are not sorted as text, and ties are broken by ID
+	require.Equal([]string{"Charlie", "Bravo", "Alpha"}, names(Sort{Field: "rank"}))
+	require.Equal([]string{"Alpha", "Bravo", "Charlie"}, names(Sort{Field: "rank", Descending: true}, Sort{Field: "label", Text: true}))
+	// items without the field come last
+	require.Equal([]string{"Charlie", "Bravo", "Alpha"}, names(Sort{Field: "label", Descending: true, Text: true}))
+	require.Equal([]string{"Bravo", "Alpha", "Charlie"}, names(Sort{Field: "item.updated", Descending: true}))
+}
+
+func TestParseSort(t *testing.T) {
+	require := require.New(t)
+	model := EmptyModel()
+	_, err := AddItem(Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"size": 3.0, "name": "x"}}, model)
+	require.NoError(err)
+
+	sorts, err := ParseSort("name, -updated,size,-contents.name", model)
+	require.NoError(err)
+	require.Equal([]Sort{{"item.name", false, true}, {"item.updated", true, false}, {"size", false, false}, {"name", true, true}}, sorts)
+
+	sorts, err = ParseSort("", model)
+	require.NoError(err)
+	require.Empty(sorts)
+
+	_, err = ParseSort("unknown", model)
+	require.True(IsInvalidQuery(err))
+}
+
+func DoTestSearchCursor(store Store, ss SearchStore, t *testing.T) {
+	require := require.New(t)
+	var items []Item
+	for i := 0; i < 5; i++ {
+		it := Item{[]string{"Paged", fmt.Sprintf("P%d", i)}, "Paged", fmt.Sprintf("Paged%d", 4-i), map[string]interface{}{"rank": float64(i % 2)}}
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+		items = append(items, it)
+	}
+	pages := func(sorts ...Sort) [][]string {
+		var pages [][]string
+		after := ""
+		for {
+			rs, err := ss.Search(NewQuery("item.type:Paged").SortBy(sorts...).PageAfter(after, 2))
+			require.NoError(err)
+			var names []string
+			for _, sc := range rs.Scores {
+				names = append(names, sc.Item.Name)
+				require.NotEmpty(sc.Cursor)
+			}
+			pages = append(pages, names)
+			if len(rs.Next) == 0 {
+				return pages
+			}
+			require.Equal(rs.Scores[len(rs.Scores)-1].Cursor, rs.Next)
+			require.True(len(pages) < 5)
+			after = rs.Next
+		}
+	}
+
+	require.Equal([][]string{{"Paged0", "Paged1"}, {"Paged2", "Paged3"}, {"Paged4"}}, pages(Sort{Field: "item.name", Text: true}))
+	// ties on rank are broken by ID
+	require.Equal([][]string{{"Paged3", "Paged1"}, {"Paged4", "Paged2"}, {"Paged0"}}, pages(Sort{Field: "rank", Descending: true}))
+	var all []string
+	for _, p := range pages() {
+		all = append(all, p...)
+	}
+	require.Equal(5, len(all))
+
+	_, err := ss.Search(NewQuery("item.type:Paged").PageAfter("invalid!", 2))
+	require.True(IsInvalidCursor(err))
+	rs, err := ss.Search(NewQuery("item.type:Paged").SortBy(Sort{Field: "item.name", Text: true}).Page(0, 2))
+	require.NoError(err)
+	_, err = ss.Search(NewQuery("item.type:Paged").SortBy(Sort{Field: "item.name", Text: true}, Sort{Field: "rank"}).PageAfter(rs.Next, 2))
+	require.True(IsInvalidCursor(err))
+	q := NewQuery("item.type:Paged").PageAfter(rs.Next, 2)
+	q.From = 2
+	_, err = ss.Search(q)
+	require.True(IsInvalidQuery(err))
+	_, err = ss.Search(NewQuery("item.type:Paged").Page(0, 0))
+	require.True(IsInvalidQuery(err))
+}
+
+func DoTestFacetSizes(store Store, ss SearchStore, t *testing.T) {
+	require := require.New(t)
+	for i, name := range []string{"Common", "Common", "Common", "Rare", "Unique", "Other"} {
+		it := Item{[]string{"Faceted", fmt.Sprintf("F%d", i)}, "Faceted", name, map[string]interface{}{"field1": "value1"}}
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+	}
+	rs, err := ss.Search(NewQuery("item.type:Faceted").Page(0, 2).AddAllFacets().SetFacetSize(FacetName, 2))
+	require.NoError(err)
+	require.Equal(2, len(rs.Scores))
+	require.Equal(int64(6), rs.Total)
+	require.True(rs.Took >= 0)
+	require.Equal(map[string]uint64{"Common": 3, "Other": 1}, rs.Facets["item.name"])
+	require.Equal(FacetInfo{Truncated: true, Other: 2}, rs.FacetInfo["item.name"])
+	require.Equal(map[string]uint64{"Faceted": 6}, rs.Facets["item.type"])
+	require.Equal(FacetInfo{}, rs.FacetInfo["item.type"])
+}
+
+func DoTestAttributeFacets(store Store, ss SearchStore, t *testing.T) {
+	require := require.New(t)
+	for i, price := range []float64{5, 12, 18, 25, 40} {
+		it := Item{[]string{"Gadget", fmt.Sprintf("G%d", i)}, "Gadget", fmt.Sprintf("Gadget%d", i),
+			map[string]interface{}{"price": price, "color": []string{"red", "blue"}[i%2], "sold": i < 2}}
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+	}
+	ten, twenty := 10.0, 20.0
+	rs, err := ss.Search(NewQuery("item.type:Gadget").
+		AddAttributeFacet(AttributeFacet{Attribute: "color", Kind: FacetKindTerms, Size: 1, Text: true}).
+		AddAttributeFacet(AttributeFacet{Attribute: "sold", Kind: FacetKindTerms}).
+		AddAttributeFacet(AttributeFacet{Attribute: "price", Kind: FacetKindRange,
+			Ranges: []FacetRange{{To: &ten}, {From: &ten, To: &twenty}, {From: &twenty}}}))
+	require.NoError(err)
+	require.Equal(int64(5), rs.Total)
+	require.Equal([]Bucket{{Key: "red", Count: 3}}, rs.AttributeFacets["color"])
+	require.Equal(FacetInfo{Truncated: true, Other: 2}, rs.FacetInfo["color"])
+	require.Equal([]Bucket{{Key: "false", Count: 3}, {Key: "true", Count: 2}}, rs.AttributeFacets["sold"])
+	require.Equal([]Bucket{{Key: "*-10", To: &ten, Count: 1}, {Key: "10-20", From: &ten, To: &twenty, Count: 2},
+		{Key: "20-*", From: &twenty, Count: 2}}, rs.AttributeFacets["price"])
+
+	rs, err = ss.Search(NewQuery("item.type:Gadget").
+		AddAttributeFacet(AttributeFacet{Attribute: "price", Kind: FacetKindHistogram, Interval: 10}))
+	require.NoError(err)
+	var keys []string
+	var counts []uint64
+	for _, b := range rs.AttributeFacets["price"] {
+		keys = append(keys, b.Key)
+		counts = append(counts, b.Count)
+		require.Equal(10.0, *b.To-*b.From)
+	}
+	require.Equal([]string{"0", "10", "20", "40"}, keys)
+	require.Equal([]uint64{1, 2, 1, 1}, counts)
+
+	_, err = ss.Search(NewQuery("item.type:Gadget").
+		AddAttributeFacet(AttributeFacet{Attribute: "price", Kind: FacetKindHistogram}))
+	require.True(IsInvalidQuery(err))
+	_, err = ss.Search(NewQuery("item.type:Gadget").
+		AddAttributeFacet(AttributeFacet{Attribute: "price", Kind: FacetKindHistogram, Interval: 10}).
+		AddAttributeFacet(AttributeFacet{Attribute: "price", Kind: FacetKindRange, Ranges: []FacetRange{{To: &twenty}}}))
+	require.True(IsInvalidQuery(err))
+}
+
+func TestParseAttributeFacet(t *testing.T) {
+	require := require.New(t)
+	model := EmptyModel()
+	_, err := AddItem(Item{[]string{"Gadget", "G1"}, "Gadget", "G1", map[string]interface{}{"price": 3.0, "color": "red", "sold": true}}, model)
+	require.NoError(err)
+
+	f, err := ParseAttributeFacet("color", model)
+	require.NoError(err)
+	require.Equal(AttributeFacet{Attribute: "color", Kind: FacetKindTerms, Text: true}, f)
+
+	f, err = ParseAttributeFacet("sold:terms:5", model)
+	require.NoError(err)
+	require.Equal(AttributeFacet{Attribute: "sold", Kind: FacetKindTerms, Size: 5}, f)
+
+	f, err = ParseAttributeFacet("contents.price:histogram:2.5", model)
+	require.NoError(err)
+	require.Equal(AttributeFacet{Attribute: "price", Kind: FacetKindHistogram, Interval: 2.5}, f)
+
+	f, err = ParseAttributeFacet("price:range:*--1,-1-5,5-*", model)
+	require.NoError(err)
+	minusOne, five := -1.0, 5.0
+	require.Equal([]FacetRange{{To: &minusOne}, {From: &minusOne, To: &five}, {From: &five}}, f.Ranges)
+	require.Equal(FacetKindRange, f.Kind)
+
+	for _, bad := range []string{"unknown", "price", "price:terms:3", "color:histogram:2", "price:range:5-1", "price:range:x", "color:other"} {
+		_, err = ParseAttributeFacet(bad, model)
+		require.True(IsInvalidQuery(err), bad)
+	}
+}
+
+func DoTestSuggestStore(store Store, ss SuggestStore, t *testing.T) {
+	require := require.New(t)
+	items := []Item{
+		{[]string{"Organization", "Org1"}, "Organization", "Acme Corporation", map[string]interface{}{}},
+		{[]string{"Organization", "Org1", "Team", "T1"}, "Team", "Team Alpha", map[string]interface{}{}},
+		{[]string{"Organization", "Org1", "Team", "T2"}, "Team", "Alpine Team", map[string]interface{}{}},
+		{[]string{"Organization", "Org2"}, "Organization", "Alphabet", map[string]interface{}{}},
+		{[]string{"Organization", "Org2", "Team", "T3"}, "Team", "Team Alps", map[string]interface{}{}},
+	}
+	for _, it := range items {
+		require.NoError(store.Write(it))
+		defer store.Delete(it.ID)
+	}
+	names := func(prefix string, itemType string, namespace string, size int) []string {
+		suggestions, err := ss.Suggest(prefix, itemType, namespace, size)
+		require.NoError(err)
+		var names []string
+		for _, s := range suggestions {
+			names = append(names, s.Name)
+		}
+		return names
+	}
+	require.Equal([]string{"Alphabet", "Alpine Team", "Team Alpha", "Team Alps"}, names("alp", "", "", 0))
+	require.Equal([]string{"Alphabet", "Alpine Team"}, names("Alp", "", "", 2))
+	require.Equal([]string{"Alpine Team", "Team Alpha", "Team Alps"}, names("alp", "Team", "", 0))
+	require.Equal([]string{"Alpine Team", "Team Alpha"}, names("alp", "", "Organization/Org1", 0))
+	require.Equal([]string{"Team Alpha", "Team Alps"}, names("team al", "", "", 0))
+	require.Empty(names("corp", "Team", "", 0))
+
+	suggestions, err := ss.Suggest("acme", "", "", 0)
+	require.NoError(err)
+	require.Equal([]Suggestion{{items[0].ID, "Acme Corporation", "Organization"}}, suggestions)
+
+	_, err = ss.Suggest(" ", "", "", 0)
+	require.True(IsInvalidQuery(err))
+}
@@ -0,0 +1,79 @@
+package item
+
+import (
+	"encoding/base64"
+	"sort"
+)
+
+// ListStore can list the current items under a given item, sorted by ID, one page at a time
+// The cursor is empty to get the first page, the returned cursor is empty after the last page
+// Children are the items directly under the given item, an empty ID giving the top level items
+// Descendants are all the items in the namespace of the given item, which cannot be empty
+type ListStore interface {
+	Children(id ID, cursor string, limit int) ([]Item, string, error)
+	Descendants(id ID, cursor string, limit int) ([]Item, string, error)
+}
+
+// ParentID returns the ID of the item containing the given one, empty for top level items
+func ParentID(id ID) ID {
+	if len(id) < 2 {
+		return ID{}
+	}
+	return id[:len(id)-2]
+}
+
+// isUnder checks if an item is a child of the given parent, or any descendant if recursive is true
+func isUnder(id ID, parent ID, recursive bool) bool {
+	if len(id) <= len(parent) || len(id)%2 != 0 {
+		return false
+	}
+	if !recursive && len(id) != len(parent)+2 {
+		return false
+	}
+	for i, c := range parent {
+		if id[i] != c {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeCursor makes an opaque cursor from the ID of the last item of a page
+func encodeCursor(last ID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(IDToString(last)))
+}
+
+// decodeCursor gives the ID string after which the next page starts
+func decodeCursor(cursor string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", NewInvalidCursorError(cursor)
+	}
+	return string(b), nil
+}
+
+// listItems selects a page of children or descendants from a list of items
+func listItems(items []Item, id ID, recursive bool, cursor string, limit int) ([]Item, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return []Item{}, "", err
+	}
+	var keys []string
+	byKey := make(map[string]Item)
+	for _, it := range items {
+		k := IDToString(it.ID)
+		if isUnder(it.ID, id, recursive) && (len(cursor) == 0 || k > after) {
+			keys = append(keys, k)
+			byKey[k] = it
+		}
+	}
+	sort.Strings(keys)
+	page := []Item{}
+	for _, k := range keys {
+		if len(page) == limit {
+			return page, encodeCursor(page[len(page)-1].ID), nil
+		}
+		page = append(page, byKey[k])
+	}
+	return page, "", nil
+}
@@ -2,24 +2,32 @@ package item
 
 import (
 	"sync"
+	"time"
 )
 
-// LocalStore does the job of a key value store
+// LocalStore does the job of a key value store, keeping all versions of items in memory
 type LocalStore struct {
 	mux   sync.Mutex
-	items map[string]Item
+	items map[string][]Status
 }
 
 // NewLocalStore creates a new empty store
 func NewLocalStore() *LocalStore {
-	return &LocalStore{items: make(map[string]Item)}
+	return &LocalStore{items: make(map[string][]Status)}
 }
 
 // Read gets an item from the store, returning an empty Item if not present
 func (s *LocalStore) Read(id ID) (Item, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	return s.items[IDToString(id)], nil
+	return s.current(IDToString(id)), nil
+}
+
+func (s *LocalStore) current(k string) Item {
+	if st := s.latest(k); st.Status == "ALIVE" {
+		return st.Item
+	}
+	return Item{}
 }
 
 // Write stores an item in the store
@@ -29,22 +37,189 @@ func (s *LocalStore) Write(item Item) error {
 	}
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	s.items[IDToString(item.ID)] = item
+	s.add(Status{Item: item, Status: "ALIVE"})
 	return nil
 }
 
-// Delete removes an item from the store if present
+// Delete marks an item as deleted
 func (s *LocalStore) Delete(id ID) error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	delete(s.items, IDToString(id))
+	s.add(Status{Item: Item{ID: id}, Status: "DELETED"})
 	return nil
 }
 
+// WriteAll stores all items, or none of them if one is empty
+func (s *LocalStore) WriteAll(items []Item) error {
+	return s.ChangeAll(items, nil)
+}
+
+// ChangeAll stores all items and marks the others as deleted, or does nothing if one item is empty
+func (s *LocalStore) ChangeAll(items []Item, deleted []ID) error {
+	for _, item := range items {
+		if item.IsEmpty() {
+			return NewEmptyItemError()
+		}
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, item := range items {
+		s.add(Status{Item: item, Status: "ALIVE"})
+	}
+	for _, id := range deleted {
+		s.add(Status{Item: Item{ID: id}, Status: "DELETED"})
+	}
+	return nil
+}
+
+// WriteIf stores an item in the store if its current version is the given one
+func (s *LocalStore) WriteIf(item Item, version string) error {
+	if item.IsEmpty() {
+		return NewEmptyItemError()
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if !isExpectedVersion(s.latest(IDToString(item.ID)), version) {
+		return NewVersionConflictError(item.ID, version)
+	}
+	s.add(Status{Item: item, Status: "ALIVE"})
+	return nil
+}
+
+// DeleteIf marks an item as deleted if its current version is the given one
+func (s *LocalStore) DeleteIf(id ID, version string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if version == NoVersion || !isExpectedVersion(s.latest(IDToString(id)), version) {
+		return NewVersionConflictError(id, version)
+	}
+	s.add(Status{Item: Item{ID: id}, Status: "DELETED"})
+	return nil
+}
+
+func (s *LocalStore) latest(k string) Status {
+	sts := s.items[k]
+	if len(sts) > 0 {
+		return sts[len(sts)-1]
+	}
+	return Status{}
+}
+
+func (s *LocalStore) add(st Status) {
+	st.Version, st.Updated = newVersion()
+	k := IDToString(st.Item.ID)
+	s.items[k] = append(s.items[k], st)
+}
+
+// History reads the history of a given item, latest version first
+func (s *LocalStore) History(id ID, limit int) ([]Status, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var items []Status
+	sts := s.items[IDToString(id)]
+	for i := len(sts) - 1; i >= 0 && len(items) < limit; i-- {
+		items = append(items, sts[i])
+	}
+	return items, nil
+}
+
+// ReadAt reads the version of an item that was current at the given time
+func (s *LocalStore) ReadAt(id ID, at time.Time) (Status, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sts := s.items[IDToString(id)]
+	for i := len(sts) - 1; i >= 0; i-- {
+		if !sts[i].Updated.After(at) {
+			return sts[i], nil
+		}
+	}
+	return Status{}, nil
+}
+
+// currentStatuses gives the latest version of the items that are not deleted
+func (s *LocalStore) currentStatuses() []Status {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	sts := make([]Status, 0, len(s.items))
+	for k := range s.items {
+		if st := s.latest(k); st.Status == "ALIVE" {
+			sts = append(sts, st)
+		}
+	}
+	return sts
+}
+
+func (s *LocalStore) currentItems() []Item {
+	return statusItems(s.currentStatuses())
+}
+
+// Search the current versions of the items
+func (s *LocalStore) Search(query *Query) (SearchResult, error) {
+	return searchItems(s.currentStatuses(), query)
+}
+
+// Suggest items from the beginning of their name
+func (s *LocalStore) Suggest(prefix string, itemType string, namespace string, size int) ([]Suggestion, error) {
+	return suggestItems(s.currentStatuses(), prefix, itemType, namespace, size)
+}
+
+// Scroll through all the current items matching the query
+func (s *LocalStore) Scroll(query string, scoreChannel chan Score, errorChannel chan error) {
+	scrollItems(s.currentStatuses(), query, scoreChannel, errorChannel)
+}
+
+// ScanIDs sends the IDs of all the items in the store, including deleted ones
+func (s *LocalStore) ScanIDs(idChannel chan ID, errorChannel chan error) {
+	defer close(idChannel)
+	s.mux.Lock()
+	ids := make([]ID, 0, len(s.items))
+	for k := range s.items {
+		ids = append(ids, StringToID(k))
+	}
+	s.mux.Unlock()
+	for _, id := range ids {
+		idChannel <- id
+	}
+}
+
+// ScanItems sends the current version of all the items that are not deleted
+func (s *LocalStore) ScanItems(itemChannel chan Item, errorChannel chan error) {
+	scanItems(s, itemChannel, errorChannel)
+}
+
+// ScanStatuses sends the current status of all the items that are not deleted
+func (s *LocalStore) ScanStatuses(statusChannel chan Status, errorChannel chan error) {
+	defer close(statusChannel)
+	for _, st := range s.currentStatuses() {
+		statusChannel <- st
+	}
+}
+
+// Children returns a page of the current items directly under the given item
+func (s *LocalStore) Children(id ID, cursor string, limit int) ([]Item, string, error) {
+	return listItems(s.currentItems(), id, false, cursor, limit)
+}
+
+// Descendants returns a page of the current items in the namespace of the given item
+func (s *LocalStore) Descendants(id ID, cursor string, limit int) ([]Item, string, error) {
+	return listItems(s.currentItems(), id, true, cursor, limit)
+}
+
+// SubtreeIDs returns the IDs of all the items ever stored under the given item
+func (s *LocalStore) SubtreeIDs(id ID) ([]ID, error) {
+	s.mux.Lock()
+	keys := make([]string, 0, len(s.items))
+	for k := range s.items {
+		keys = append(keys, k)
+	}
+	s.mux.Unlock()
+	return subtreeIDs(keys, id), nil
+}
+
 // Close the store
 func (s *LocalStore) Close() error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
-	s.items = make(map[string]Item)
+	s.items = make(map[string][]Status)
 	return nil
 }
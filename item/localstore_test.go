@@ -2,6 +2,8 @@ package item
 
 import (
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestLocalStore(t *testing.T) {
@@ -13,3 +15,96 @@ func TestLocaleStoreErrors(t *testing.T) {
 	store := NewLocalStore()
 	DoTestStoreErrors(store, t)
 }
+
+func TestLocalStoreHistory(t *testing.T) {
+	require := require.New(t)
+	store := NewLocalStore()
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value2"}}
+	require.NoError(store.Write(item1))
+	require.NoError(store.Write(item2))
+	require.NoError(store.Delete(item1.ID))
+
+	sts, err := store.History(item1.ID, 10)
+	require.NoError(err)
+	require.Equal([]Status{{Item: Item{ID: item1.ID}, Status: "DELETED"}, {Item: item2, Status: "ALIVE"}, {Item: item1, Status: "ALIVE"}}, withoutVersions(sts))
+	require.NotEmpty(sts[0].Version)
+	require.NotEqual(sts[0].Version, sts[1].Version)
+	require.False(sts[0].Updated.Before(sts[1].Updated))
+	sts, err = store.History(item1.ID, 2)
+	require.NoError(err)
+	require.Equal(2, len(sts))
+	sts, err = store.History([]string{"Team", "Team2"}, 10)
+	require.NoError(err)
+	require.Empty(sts)
+}
+
+func TestLocalStoreSearch(t *testing.T) {
+	store := NewLocalStore()
+	DoTestSearchStore(store, store, t)
+}
+
+func TestLocalStoreReadAt(t *testing.T) {
+	store := NewLocalStore()
+	DoTestTimeTravelStore(store, store, t)
+}
+
+func TestLocalStoreConditional(t *testing.T) {
+	store := NewLocalStore()
+	DoTestConditionalStore(store, store, t)
+}
+
+func TestLocalStoreWriteBatch(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestWriteBatch(store, t)
+}
+
+func TestLocalStoreAtomic(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestAtomicStore(store, store, t)
+}
+
+func TestLocalStoreScanItems(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestScanItems(store, store, t)
+}
+
+func TestLocalStoreList(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestListStore(store, store, t)
+}
+
+func TestLocalStoreClauseSearch(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestClauseSearch(store, store, t)
+}
+
+func TestLocalStoreSortSearch(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestSortSearch(store, store, t)
+}
+
+func TestLocalStoreSearchCursor(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestSearchCursor(store, store, t)
+}
+
+func TestLocalStoreFacetSizes(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestFacetSizes(store, store, t)
+	DoTestAttributeFacets(store, store, t)
+}
+
+func TestLocalStoreSuggest(t *testing.T) {
+	store := NewLocalStore()
+	defer store.Close()
+	DoTestSuggestStore(store, store, t)
+}
@@ -0,0 +1,196 @@
+package item
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MappingStore keeps typed mappings of the attributes of the items, that have to follow the changes of the model
+type MappingStore interface {
+	UpdateMapping(model *Model) error
+}
+
+// modelESTypes maps the types recorded in the model to Elastic field types
+var modelESTypes = map[string]string{
+	"float64":   "double",
+	"float32":   "float",
+	"int":       "long",
+	"int64":     "long",
+	"int32":     "integer",
+	"bool":      "boolean",
+	"time.Time": "date",
+}
+
+// PrefixAnalyzer is the analyzer of the configuration that indexes the beginnings of words, so that words are found
+// from their first letters
+const PrefixAnalyzer = "prefix"
+
+// esPrefixAnalyzer is the name of the analyzer defined in the index settings for PrefixAnalyzer
+const esPrefixAnalyzer = "nsrep_prefix"
+
+// Default lengths of the beginnings of words indexed by PrefixAnalyzer
+const (
+	defaultMinGram = 2
+	defaultMaxGram = 20
+)
+
+// gramLengths gives the lengths of the beginnings of words indexed by the prefix analyzer, with their defaults
+func gramLengths(conf Elastic) (int, int) {
+	minGram, maxGram := conf.MinGram, conf.MaxGram
+	if minGram <= 0 {
+		minGram = defaultMinGram
+	}
+	if maxGram <= 0 {
+		maxGram = defaultMaxGram
+	}
+	return minGram, maxGram
+}
+
+// validateAnalysis checks that the prefix analyzer indexes at least one length of beginnings of words
+func validateAnalysis(conf Elastic) error {
+	if conf.Analyzer != PrefixAnalyzer {
+		return nil
+	}
+	if minGram, maxGram := gramLengths(conf); minGram > maxGram {
+		return fmt.Errorf("mingram %d cannot be greater than maxgram %d", minGram, maxGram)
+	}
+	return nil
+}
+
+// esAnalysis gives the analysis settings of a new index, nil if the configured analyzer is built in Elastic
+func esAnalysis(conf Elastic) map[string]interface{} {
+	if conf.Analyzer != PrefixAnalyzer {
+		return nil
+	}
+	minGram, maxGram := gramLengths(conf)
+	return map[string]interface{}{
+		"filter": map[string]interface{}{
+			esPrefixAnalyzer: map[string]interface{}{
+				"type":     "edge_ngram",
+				"min_gram": minGram,
+				"max_gram": maxGram,
+			},
+		},
+		"analyzer": map[string]interface{}{
+			esPrefixAnalyzer: map[string]interface{}{
+				"type":      "custom",
+				"tokenizer": "standard",
+				"filter":    []string{"lowercase", esPrefixAnalyzer},
+			},
+		},
+	}
+}
+
+// esTextMapping gives the mapping of an analyzed field with the configured analyzer
+// The prefix analyzer is only used when indexing, so that searched words are not cut into prefixes
+func esTextMapping(conf Elastic) map[string]interface{} {
+	switch conf.Analyzer {
+	case "":
+		return map[string]interface{}{"type": "text"}
+	case PrefixAnalyzer:
+		return map[string]interface{}{"type": "text", "analyzer": esPrefixAnalyzer, "search_analyzer": "standard"}
+	default:
+		return map[string]interface{}{"type": "text", "analyzer": conf.Analyzer}
+	}
+}
+
+// esStringMapping maps strings as analyzed text with a keyword sub field, like Elastic dynamic mapping does
+func esStringMapping(conf Elastic) map[string]interface{} {
+	mapping := esTextMapping(conf)
+	mapping["fields"] = map[string]interface{}{
+		"keyword": map[string]interface{}{
+			"type":         "keyword",
+			"ignore_above": 256,
+		},
+	}
+	return mapping
+}
+
+// esNameMapping maps the name of the items as a keyword for exact searches and facets, with an analyzed text sub field
+func esNameMapping(conf Elastic) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "keyword",
+		"fields": map[string]interface{}{
+			"text": esTextMapping(conf),
+		},
+	}
+}
+
+// esAttributeMappings gives the Elastic mapping of each attribute of the model, strings having the given mapping
+// An attribute that has different types in different item types is mapped as a string, or a double if all its types
+// are numbers, since Elastic has only one mapping per field
+// Attributes with types that have no mapping, like objects or arrays, are left to dynamic mapping
+func esAttributeMappings(model *Model, stringMapping map[string]interface{}) map[string]interface{} {
+	model.RLock()
+	types := make(map[string]map[string]bool)
+	for _, ats := range model.TypeAttributes {
+		for name, atype := range ats {
+			if types[name] == nil {
+				types[name] = make(map[string]bool)
+			}
+			types[name][atype] = true
+		}
+	}
+	model.RUnlock()
+	mappings := make(map[string]interface{})
+	for name, ats := range types {
+		if mapping := esAttributeMapping(ats, stringMapping); mapping != nil {
+			mappings[name] = mapping
+		}
+	}
+	return mappings
+}
+
+func esAttributeMapping(types map[string]bool, stringMapping map[string]interface{}) map[string]interface{} {
+	esTypes := make(map[string]bool)
+	for atype := range types {
+		if atype == "string" {
+			esTypes["text"] = true
+			continue
+		}
+		t, ok := modelESTypes[atype]
+		if !ok {
+			return nil
+		}
+		esTypes[t] = true
+	}
+	if esTypes["text"] {
+		return stringMapping
+	}
+	for t := range esTypes {
+		if len(esTypes) == 1 {
+			return map[string]interface{}{"type": t}
+		}
+		if !isNumberType(t) {
+			return stringMapping
+		}
+	}
+	return map[string]interface{}{"type": "double"}
+}
+
+// esMappingConflicts gives the sorted names of the attributes already mapped with a type that cannot index all their
+// values, like a number field receiving strings
+// Text fields index any value and numbers are coerced between number types, so they do not conflict
+func esMappingConflicts(mapped map[string]interface{}, attributes map[string]interface{}) []string {
+	var conflicts []string
+	for name, m := range attributes {
+		old, ok := mapped[name]
+		if !ok || old == "text" || old == "keyword" {
+			continue
+		}
+		esType := m.(map[string]interface{})["type"]
+		if old != esType && !(isNumberType(fmt.Sprint(old)) && isNumberType(fmt.Sprint(esType))) {
+			conflicts = append(conflicts, name)
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+func isNumberType(esType string) bool {
+	switch esType {
+	case "double", "float", "long", "integer":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,540 @@
+package item
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// matcher is a compiled query string, used by the stores that evaluate queries themselves
+type matcher interface {
+	match(item Item) bool
+}
+
+type andMatcher []matcher
+
+func (m andMatcher) match(item Item) bool {
+	for _, sub := range m {
+		if !sub.match(item) {
+			return false
+		}
+	}
+	return true
+}
+
+type orMatcher []matcher
+
+func (m orMatcher) match(item Item) bool {
+	for _, sub := range m {
+		if sub.match(item) {
+			return true
+		}
+	}
+	return false
+}
+
+type notMatcher struct {
+	sub matcher
+}
+
+func (m notMatcher) match(item Item) bool {
+	return !m.sub.match(item)
+}
+
+type allMatcher struct{}
+
+func (m allMatcher) match(item Item) bool {
+	return true
+}
+
+// existsMatcher matches items that have a value for the given field
+type existsMatcher struct {
+	field string
+}
+
+func (m existsMatcher) match(item Item) bool {
+	if strings.HasPrefix(m.field, "item.") {
+		return true
+	}
+	return len(contentValues(item.Contents, "", nil)[m.field]) > 0
+}
+
+// termMatcher matches a value, in a given field or in any field if field is empty
+type termMatcher struct {
+	field   string
+	pattern *regexp.Regexp
+}
+
+func (m termMatcher) match(item Item) bool {
+	switch m.field {
+	case "":
+		for _, v := range keywordValues(item) {
+			if m.pattern.MatchString(v) {
+				return true
+			}
+		}
+		// the name is also analyzed, so that one of its words is enough
+		return matchText(m.pattern, []string{item.Name}) || matchText(m.pattern, contentValues(item.Contents, "", nil))
+	case "item.id":
+		return m.pattern.MatchString(IDToString(item.ID))
+	case "item.type":
+		return m.pattern.MatchString(item.Type)
+	case "item.name":
+		return m.pattern.MatchString(item.Name)
+	case "item.idlength":
+		return m.pattern.MatchString(strconv.Itoa(len(item.ID)))
+	case "item.ns":
+		for _, ns := range AllNamespaces(item.ID) {
+			if m.pattern.MatchString(ns) {
+				return true
+			}
+		}
+		return false
+	default:
+		return matchText(m.pattern, contentValues(item.Contents, "", nil)[m.field])
+	}
+}
+
+// keywordValues returns the item fields that are matched as a whole
+func keywordValues(item Item) []string {
+	vals := []string{item.Name, item.Type}
+	if len(item.ID) > 0 {
+		vals = append(vals, IDToString(item.ID))
+	}
+	return vals
+}
+
+// contentValues flattens the contents into dotted field names and their string values
+func contentValues(cnts map[string]interface{}, prefix string, values map[string][]string) map[string][]string {
+	if values == nil {
+		values = make(map[string][]string)
+	}
+	for k, v := range cnts {
+		addContentValue(prefix+k, v, values)
+	}
+	return values
+}
+
+func addContentValue(field string, v interface{}, values map[string][]string) {
+	switch tv := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		contentValues(tv, field+".", values)
+	case []interface{}:
+		for _, e := range tv {
+			addContentValue(field, e, values)
+		}
+	case []string:
+		values[field] = append(values[field], tv...)
+	default:
+		values[field] = append(values[field], scalarString(tv))
+	}
+}
+
+// matchText matches analyzed content values: either the whole value or one of its words, ignoring case
+func matchText(pattern *regexp.Regexp, values interface{}) bool {
+	var vals []string
+	switch tv := values.(type) {
+	case []string:
+		vals = tv
+	case map[string][]string:
+		for _, vs := range tv {
+			vals = append(vals, vs...)
+		}
+	}
+	for _, v := range vals {
+		lv := strings.ToLower(v)
+		if pattern.MatchString(lv) {
+			return true
+		}
+		for _, w := range strings.FieldsFunc(lv, isSeparator) {
+			if pattern.MatchString(w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// globPattern compiles a value with * and ? wildcards, optionally ignoring case
+func globPattern(value string, ignoreCase bool) *regexp.Regexp {
+	var sb strings.Builder
+	if ignoreCase {
+		sb.WriteString("(?i)")
+	}
+	sb.WriteString("^")
+	for _, r := range value {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeQuery(queryString string) ([]queryToken, error) {
+	var tokens []queryToken
+	var current strings.Builder
+	var inToken, quoted, inQuotes, escaped bool
+	flush := func() {
+		if inToken {
+			tokens = append(tokens, queryToken{current.String(), quoted})
+		}
+		current.Reset()
+		inToken, quoted = false, false
+	}
+	for _, r := range queryString {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			inToken, escaped = true, false
+		case r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+			inToken, quoted = true, true
+		case inQuotes:
+			current.WriteRune(r)
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, queryToken{string(r), false})
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inQuotes {
+		return nil, NewQueryParseError(queryString, "unterminated quote")
+	}
+	flush()
+	return tokens, nil
+}
+
+type queryParser struct {
+	query  string
+	tokens []queryToken
+	pos    int
+}
+
+// parseQueryString compiles the subset of the query string syntax nsrep uses:
+// field:value terms with wildcards, free text, and/or/not, and parentheses.
+// Like Elastic, terms with no operator between them are or-ed together.
+func parseQueryString(queryString string) (matcher, error) {
+	tokens, err := tokenizeQuery(queryString)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return allMatcher{}, nil
+	}
+	p := &queryParser{query: queryString, tokens: tokens}
+	m, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, NewQueryParseError(queryString, fmt.Sprintf("unexpected %s", p.tokens[p.pos].text))
+	}
+	return m, nil
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return queryToken{}, false
+}
+
+func (p *queryParser) isOperator(names ...string) bool {
+	tok, ok := p.peek()
+	if !ok || tok.quoted {
+		return false
+	}
+	for _, n := range names {
+		if strings.EqualFold(tok.text, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *queryParser) parseOr() (matcher, error) {
+	var ms orMatcher
+	for {
+		m, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+		if p.isOperator("or", "||") {
+			p.pos++
+			continue
+		}
+		if tok, ok := p.peek(); !ok || (tok.text == ")" && !tok.quoted) {
+			break
+		}
+	}
+	if len(ms) == 1 {
+		return ms[0], nil
+	}
+	return ms, nil
+}
+
+func (p *queryParser) parseAnd() (matcher, error) {
+	var ms andMatcher
+	for {
+		m, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+		if !p.isOperator("and", "&&") {
+			break
+		}
+		p.pos++
+	}
+	if len(ms) == 1 {
+		return ms[0], nil
+	}
+	return ms, nil
+}
+
+func (p *queryParser) parseUnary() (matcher, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return nil, NewQueryParseError(p.query, "unexpected end of query")
+	}
+	if p.isOperator("not", "!") {
+		p.pos++
+		m, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notMatcher{m}, nil
+	}
+	p.pos++
+	if !tok.quoted && tok.text == "(" {
+		m, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if end, ok := p.peek(); !ok || end.text != ")" {
+			return nil, NewQueryParseError(p.query, "missing closing parenthesis")
+		}
+		p.pos++
+		return m, nil
+	}
+	if !tok.quoted && tok.text == ")" {
+		return nil, NewQueryParseError(p.query, "unexpected )")
+	}
+	text := tok.text
+	negate := false
+	if !tok.quoted && len(text) > 1 && (text[0] == '-' || text[0] == '+') {
+		negate = text[0] == '-'
+		text = text[1:]
+	}
+	m := termFromText(text, tok.quoted)
+	if negate {
+		return notMatcher{m}, nil
+	}
+	return m, nil
+}
+
+func termFromText(text string, quoted bool) matcher {
+	field := ""
+	if idx := strings.Index(text, ":"); idx > 0 && !quoted {
+		field, text = text[:idx], text[idx+1:]
+	}
+	if field == "*" {
+		field = ""
+	}
+	if field == "_exists_" {
+		return existsMatcher{text}
+	}
+	if field == "" && text == "*" {
+		return allMatcher{}
+	}
+	keyword := strings.HasPrefix(field, "item.")
+	return termMatcher{field, globPattern(text, !keyword)}
+}
+
+// searchable filters out the items that are not searchable, like the model, and sorts them by ID
+func searchable(sts []Status) []Status {
+	var res []Status
+	for _, st := range sts {
+		if !st.Item.IsEmpty() && !IsModelID(st.Item.ID) {
+			res = append(res, st)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return IDToString(res[i].Item.ID) < IDToString(res[j].Item.ID)
+	})
+	return res
+}
+
+// compileQuery gives the matcher for both the query string and the clause of a query
+func compileQuery(query *Query) (matcher, error) {
+	m, err := parseQueryString(query.QueryString)
+	if err != nil || query.Clause == nil {
+		return m, err
+	}
+	if err = query.Clause.Validate(); err != nil {
+		return nil, err
+	}
+	return andMatcher{m, clauseMatcher(*query.Clause)}, nil
+}
+
+// matchStatuses returns the searchable items accepted by the matcher
+func matchStatuses(sts []Status, m matcher) []Status {
+	var res []Status
+	for _, st := range searchable(sts) {
+		if m.match(st.Item) {
+			res = append(res, st)
+		}
+	}
+	return res
+}
+
+// searchItems runs a query over the current versions of items, computing facets the same way Elastic aggregations do
+// Without sort, results are ordered by ID since all items have the same score
+func searchItems(sts []Status, query *Query) (SearchResult, error) {
+	start := time.Now()
+	var scores []Score
+	facetMap := make(map[string]map[string]uint64)
+	if err := query.validatePage(); err != nil {
+		return SearchResult{Scores: scores, Facets: facetMap}, err
+	}
+	m, err := compileQuery(query)
+	if err != nil {
+		return SearchResult{Scores: scores, Facets: facetMap}, err
+	}
+	matches := matchStatuses(sts, m)
+	sortStatuses(matches, query.Sort)
+	facetInfo := make(map[string]FacetInfo)
+	for _, f := range query.Facets {
+		name, values := facetValues(f)
+		if values == nil {
+			continue
+		}
+		counts := make(map[string]uint64)
+		for _, st := range matches {
+			for _, v := range values(st.Item) {
+				counts[v]++
+			}
+		}
+		facetMap[name], facetInfo[name] = topCounts(counts, query.FacetSize(f))
+	}
+	if err := validateAttributeFacets(query.AttributeFacets); err != nil {
+		return SearchResult{Scores: scores, Facets: facetMap}, err
+	}
+	var attributeFacets map[string][]Bucket
+	for _, f := range query.AttributeFacets {
+		if attributeFacets == nil {
+			attributeFacets = make(map[string][]Bucket)
+		}
+		var info FacetInfo
+		attributeFacets[f.Attribute], info = attributeBuckets(matches, f)
+		if f.Kind == FacetKindTerms {
+			facetInfo[f.Attribute] = info
+		}
+	}
+	first := query.From
+	if len(query.After) > 0 {
+		after, err := decodeSearchCursor(query.After)
+		if err != nil {
+			return SearchResult{Scores: scores, Facets: facetMap}, err
+		}
+		if !validKey(after, query.Sort) {
+			return SearchResult{Scores: scores, Facets: facetMap}, NewInvalidCursorError(query.After)
+		}
+		first = sort.Search(len(matches), func(i int) bool {
+			return compareKeys(sortKey(matches[i], query.Sort), after, query.Sort) > 0
+		})
+	}
+	var next string
+	for i := first; i < len(matches) && i < first+query.Length; i++ {
+		cursor := encodeSearchCursor(sortKey(matches[i], query.Sort))
+		scores = append(scores, Score{Item: matches[i].Item, Score: 1, Cursor: cursor})
+		if i < len(matches)-1 {
+			next = cursor
+		} else {
+			next = ""
+		}
+	}
+	return SearchResult{Scores: scores, Facets: facetMap, Next: next, Total: int64(len(matches)),
+		Took: time.Since(start).Nanoseconds() / int64(time.Millisecond), FacetInfo: facetInfo,
+		AttributeFacets: attributeFacets}, nil
+}
+
+// topCounts keeps the most frequent values like Elastic terms aggregations: by descending count, then by value
+func topCounts(counts map[string]uint64, size int) (map[string]uint64, FacetInfo) {
+	if len(counts) <= size {
+		return counts, FacetInfo{}
+	}
+	values := make([]string, 0, len(counts))
+	for v := range counts {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		if counts[values[i]] != counts[values[j]] {
+			return counts[values[i]] > counts[values[j]]
+		}
+		return values[i] < values[j]
+	})
+	top := make(map[string]uint64, size)
+	info := FacetInfo{Truncated: true}
+	for i, v := range values {
+		if i < size {
+			top[v] = counts[v]
+		} else {
+			info.Other += counts[v]
+		}
+	}
+	return top, info
+}
+
+func facetValues(facet Facet) (string, func(item Item) []string) {
+	switch facet {
+	case FacetName:
+		return "item.name", func(item Item) []string { return []string{item.Name} }
+	case FacetType:
+		return "item.type", func(item Item) []string { return []string{item.Type} }
+	case FacetNamespace:
+		return "item.ns", func(item Item) []string { return AllNamespaces(item.ID) }
+	default:
+		return "", nil
+	}
+}
+
+// scrollItems sends all the matching items to the score channel
+func scrollItems(sts []Status, queryString string, scoreChannel chan Score, errorChannel chan error) {
+	defer close(scoreChannel)
+	m, err := parseQueryString(queryString)
+	if err != nil {
+		errorChannel <- err
+		return
+	}
+	for _, st := range matchStatuses(sts, m) {
+		scoreChannel <- Score{Item: st.Item, Score: 1}
+	}
+}
@@ -16,6 +16,8 @@ type Model struct {
 	sync.RWMutex
 	TypeAttributes map[string]map[string]string
 	typeChildren   map[string]map[string]struct{}
+	// version changes every time the model changes, so that what is derived from it knows when to rebuild
+	version uint64
 }
 
 type modelOperation interface {
@@ -92,21 +94,40 @@ func FromItem(item Item) *Model {
 	model := EmptyModel()
 	var ops []modelOperation
 	cnts := item.Contents
-	tc, ok := cnts["typeChildren"].(map[string][]string)
-	if ok {
+	switch tc := cnts["typeChildren"].(type) {
+	case map[string][]string:
 		for k, v := range tc {
 			for _, t := range v {
 				ops = append(ops, addChild{k, t})
 			}
 		}
+	case map[string]interface{}:
+		// contents read back from JSON
+		for k, v := range tc {
+			vs, _ := v.([]interface{})
+			for _, t := range vs {
+				if ts, ok := t.(string); ok {
+					ops = append(ops, addChild{k, ts})
+				}
+			}
+		}
 	}
-	ta, ok := cnts["typeAttributes"].(map[string]map[string]string)
-	if ok {
+	switch ta := cnts["typeAttributes"].(type) {
+	case map[string]map[string]string:
 		for k, v := range ta {
 			for a, vt := range v {
 				ops = append(ops, addAttribute{k, a, vt})
 			}
 		}
+	case map[string]interface{}:
+		for k, v := range ta {
+			vm, _ := v.(map[string]interface{})
+			for a, vt := range vm {
+				if vts, ok := vt.(string); ok {
+					ops = append(ops, addAttribute{k, a, vts})
+				}
+			}
+		}
 	}
 
 	for _, op := range ops {
@@ -115,15 +136,40 @@ func FromItem(item Item) *Model {
 	return model
 }
 
+// Clone returns a copy of the model that can be changed without affecting the original
+func (model *Model) Clone() *Model {
+	return FromItem(ToItem(model))
+}
+
 // AddItem registers the item model
 func AddItem(item Item, model *Model) (bool, error) {
+	ops, err := checkItem(item, model)
+	if len(ops) > 0 {
+		model.Lock()
+		for _, op := range ops {
+			op.apply(model)
+		}
+		model.version++
+		model.Unlock()
+	}
+	return len(ops) > 0, err
+}
+
+// CheckItem validates the item against the model without changing it
+// It returns true if adding the item would change the model
+func CheckItem(item Item, model *Model) (bool, error) {
+	ops, err := checkItem(item, model)
+	return len(ops) > 0, err
+}
+
+// checkItem returns the operations adding the item to the model, and the validation errors
+func checkItem(item Item, model *Model) ([]modelOperation, error) {
 	err := checkID(item)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	var errs []error
 	var ops []modelOperation
-	var changed bool
 	model.RLock()
 	m1 := model.TypeAttributes[item.Type]
 	if m1 == nil {
@@ -143,26 +189,18 @@ func AddItem(item Item, model *Model) (bool, error) {
 
 	ops = parentType(model, item.ID, item.Type, ops)
 	model.RUnlock()
-	if len(ops) > 0 {
-		model.Lock()
-		for _, op := range ops {
-			op.apply(model)
-		}
-		changed = true
-		model.Unlock()
-	}
 
 	if len(errs) == 0 {
-		return changed, nil
+		return ops, nil
 	}
 	if len(errs) == 1 {
-		return changed, errs[0]
+		return ops, errs[0]
 	}
 	var errStrings []string
 	for _, err := range errs {
 		errStrings = append(errStrings, err.Error())
 	}
-	return changed, errors.New(StoreError{"MODEL_MULTIPLE", strings.Join(errStrings, "\n")})
+	return ops, errors.New(StoreError{"MODEL_MULTIPLE", strings.Join(errStrings, "\n")})
 }
 
 // ModelError represents a modelling error
@@ -175,6 +213,17 @@ func (e ModelError) Error() string {
 	return fmt.Sprintf("%s: %s", e.code, e.message)
 }
 
+// IsModelError returns true if the error comes from an item not fitting the model
+func IsModelError(err error) bool {
+	if e, ok := err.(*errors.Error); ok {
+		err = e.Err
+	}
+	if _, ok := err.(ModelError); ok {
+		return true
+	}
+	return errorCode(err) == "MODEL_MULTIPLE"
+}
+
 func checkID(item Item) error {
 	if len(item.ID) < 2 {
 		return errors.New(ModelError{"SHORT_ID",
@@ -264,18 +313,24 @@ func (model *Model) getAttributes(typeName string) graphql.Fields {
 	return ats
 }
 
-func resolve(ss SearchStore, typeName string, nameQuery string, parentID ID) (interface{}, error) {
-	idLength := len(parentID) + 2
-
-	esQuery := fmt.Sprintf("item.idlength:%d and item.type:%s", idLength, typeName)
+// listQuery gives the query string for the items of the given type directly under the parent
+func listQuery(typeName string, nameQuery string, parentID ID) string {
+	esQuery := fmt.Sprintf("item.idlength:%d and item.type:%s", len(parentID)+2, typeName)
 	if len(nameQuery) > 0 {
 		esQuery += fmt.Sprintf(" and item.name:%s", nameQuery)
 	}
 	if len(parentID) > 0 {
 		esQuery += fmt.Sprintf(" and item.id:%s/*", IDToString(parentID))
 	}
+	return esQuery
+}
+
+func resolve(ss SearchStore, typeName string, nameQuery string, sorts []Sort, parentID ID) (interface{}, error) {
+	idLength := len(parentID) + 2
+
+	esQuery := listQuery(typeName, nameQuery, parentID)
 	// log.Printf("query: %s", esQuery)
-	rs, err := ss.Search(NewQuery(esQuery))
+	rs, err := ss.Search(NewQuery(esQuery).SortBy(sorts...))
 	if err != nil {
 		return make([]interface{}, 0), err
 	}
@@ -290,14 +345,127 @@ func resolve(ss SearchStore, typeName string, nameQuery string, parentID ID) (in
 	return its, nil
 }
 
-// GetSchema generates a graphql schema from the model
-func (model *Model) GetSchema(ss SearchStore) (graphql.Schema, error) {
+// resolveConnection returns a page of items as a connection, using the search cursors
+func resolveConnection(ss SearchStore, typeName string, params graphql.ResolveParams, sorts []Sort, parentID ID) (interface{}, error) {
+	nameQuery, _ := params.Args["name"].(string)
+	after, _ := params.Args["after"].(string)
+	first, ok := params.Args["first"].(int)
+	if !ok || first <= 0 {
+		first = 10
+	}
+	rs, err := ss.Search(NewQuery(listQuery(typeName, nameQuery, parentID)).SortBy(sorts...).PageAfter(after, first))
+	if err != nil {
+		return nil, err
+	}
+	edges := make([]interface{}, 0, len(rs.Scores))
+	endCursor := ""
+	for _, sc := range rs.Scores {
+		edges = append(edges, map[string]interface{}{"cursor": sc.Cursor, "node": sc.Item.Flatten()})
+		endCursor = sc.Cursor
+	}
+	return map[string]interface{}{
+		"edges":    edges,
+		"pageInfo": map[string]interface{}{"hasNextPage": len(rs.Next) > 0, "endCursor": endCursor},
+	}, nil
+}
 
-	fields := graphql.Fields{}
+// graphQLNames are the names used in a schema, generated names get underscores appended until they are not the name
+// of an item type or of another generated type
+type graphQLNames map[string]bool
+
+// newGraphQLNames starts the names of a schema with the item types, that keep their names
+func (model *Model) newGraphQLNames() graphQLNames {
+	names := graphQLNames{}
+	for typeName := range model.TypeAttributes {
+		names[typeName] = true
+	}
+	return names
+}
+
+// generate returns an unused name starting with the given one, and reserves it
+func (names graphQLNames) generate(name string) string {
+	for names[name] {
+		name += "_"
+	}
+	names[name] = true
+	return name
+}
+
+// pageInfoType builds the type describing the position of a page of a connection
+func pageInfoType(names graphQLNames) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: names.generate("PageInfo"),
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{Type: graphql.Boolean},
+			"endCursor":   &graphql.Field{Type: graphql.String},
+		},
+	})
+}
+
+// connectionType builds the type of the pages of items of a given type, each item being the node of an edge
+func connectionType(names graphQLNames, typeName string, node *graphql.Object, pageInfo *graphql.Object) *graphql.Object {
+	edge := graphql.NewObject(graphql.ObjectConfig{
+		Name: names.generate(typeName + "Edge"),
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.String},
+			"node":   &graphql.Field{Type: node},
+		},
+	})
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: names.generate(typeName + "Connection"),
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewList(edge)},
+			"pageInfo": &graphql.Field{Type: pageInfo},
+		},
+	})
+}
+
+// connectionArguments are the arguments of the connection fields: the list arguments and the page
+func connectionArguments() graphql.FieldConfigArgument {
+	args := listArguments()
+	args["first"] = &graphql.ArgumentConfig{
+		Type: graphql.Int,
+	}
+	args["after"] = &graphql.ArgumentConfig{
+		Type: graphql.String,
+	}
+	return args
+}
+
+// listArguments are the arguments of the fields listing items
+func listArguments() graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		"name": &graphql.ArgumentConfig{
+			Type: graphql.String,
+		},
+		"sort": &graphql.ArgumentConfig{
+			Type: graphql.String,
+		},
+	}
+}
+
+// sortArgument parses the sort argument of a list field, with the same syntax as the sort parameter of searches
+func (model *Model) sortArgument(params graphql.ResolveParams) ([]Sort, error) {
+	sortString, _ := params.Args["sort"].(string)
+	return ParseSort(sortString, model)
+}
+
+// GetSchema generates a graphql schema from the model
+// Queries use the search store, and if a writer is given there are mutations to create, update and delete items
+func (model *Model) GetSchema(ss SearchStore, writer ItemWriter) (graphql.Schema, error) {
 	model.RLock()
 	defer model.RUnlock()
+	return model.buildSchema(ss, writer)
+}
 
+// buildSchema generates the graphql schema, the caller holding the read lock of the model
+func (model *Model) buildSchema(ss SearchStore, writer ItemWriter) (graphql.Schema, error) {
+	fields := graphql.Fields{}
+	mutations := graphql.Fields{}
 	objects := make(map[string]*graphql.Object)
+	connections := make(map[string]*graphql.Object)
+	names := model.newGraphQLNames()
+	pageInfo := pageInfoType(names)
 	for typeName := range model.TypeAttributes {
 		typeName := typeName
 		ats := graphql.Fields{}
@@ -312,17 +480,40 @@ func (model *Model) GetSchema(ss SearchStore) (graphql.Schema, error) {
 			Fields: ats})
 
 		objects[typeName] = st
+		connections[typeName] = connectionType(names, typeName, st, pageInfo)
+		if writer != nil {
+			// the resolvers run after the lock is released, so they get their own copy of the attributes
+			attributes := make(map[string]string)
+			for an, at := range model.TypeAttributes[typeName] {
+				attributes[an] = at
+			}
+			for name, f := range mutationFields(typeName, names.generate(typeName+"Input"), st, attributes, writer) {
+				mutations[name] = f
+			}
+		}
 
+		// connection fields are named after their type, that may have been renamed
+		fields[connections[typeName].Name()] = &graphql.Field{
+			Type: connections[typeName],
+			Args: connectionArguments(),
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				sorts, err := model.sortArgument(params)
+				if err != nil {
+					return nil, err
+				}
+				return resolveConnection(ss, typeName, params, sorts, []string{})
+			},
+		}
 		fields[typeName] = &graphql.Field{
 			Type: graphql.NewList(st),
-			Args: graphql.FieldConfigArgument{
-				"name": &graphql.ArgumentConfig{
-					Type: graphql.String,
-				},
-			},
+			Args: listArguments(),
 			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
 				nameQuery, _ := params.Args["name"].(string)
-				return resolve(ss, typeName, nameQuery, []string{})
+				sorts, err := model.sortArgument(params)
+				if err != nil {
+					return nil, err
+				}
+				return resolve(ss, typeName, nameQuery, sorts, []string{})
 			},
 		}
 	}
@@ -334,27 +525,45 @@ func (model *Model) GetSchema(ss SearchStore) (graphql.Schema, error) {
 			childType := childType
 			parentObject.AddFieldConfig(childType, &graphql.Field{
 				Type: graphql.NewList(childObject),
-				Args: graphql.FieldConfigArgument{
-					"name": &graphql.ArgumentConfig{
-						Type: graphql.String,
-					},
-				},
+				Args: listArguments(),
 				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
 					nameQuery, _ := params.Args["name"].(string)
 					//log.Printf("resolve child: %s", nameQuery)
 					//log.Printf("source:%v", params.Source)
+					sorts, err := model.sortArgument(params)
+					if err != nil {
+						return nil, err
+					}
 					parentItem := params.Source.(map[string]interface{})
-					return resolve(ss, childType, nameQuery, parentItem["item.id"].([]string))
+					return resolve(ss, childType, nameQuery, sorts, parentItem["item.id"].([]string))
+				},
+			})
+			parentObject.AddFieldConfig(connections[childType].Name(), &graphql.Field{
+				Type: connections[childType],
+				Args: connectionArguments(),
+				Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+					sorts, err := model.sortArgument(params)
+					if err != nil {
+						return nil, err
+					}
+					parentItem := params.Source.(map[string]interface{})
+					return resolveConnection(ss, childType, params, sorts, parentItem["item.id"].([]string))
 				},
 			})
 		}
 	}
 
 	var rootQuery = graphql.NewObject(graphql.ObjectConfig{
-		Name:   "RootQuery",
+		Name:   names.generate("RootQuery"),
 		Fields: fields})
 
-	return graphql.NewSchema(graphql.SchemaConfig{
+	config := graphql.SchemaConfig{
 		Query: rootQuery,
-	})
+	}
+	if len(mutations) > 0 {
+		config.Mutation = graphql.NewObject(graphql.ObjectConfig{
+			Name:   names.generate("RootMutation"),
+			Fields: mutations})
+	}
+	return graphql.NewSchema(config)
 }
@@ -1,9 +1,13 @@
 package item
 
 import (
+	"encoding/json"
+	"fmt"
 	"strings"
+	"sync"
 	"testing"
 
+	"github.com/graphql-go/graphql"
 	"github.com/stretchr/testify/require"
 )
 
@@ -100,6 +104,122 @@ func TestModelAttributesAndParent(t *testing.T) {
 
 }
 
+func TestSchemaCache(t *testing.T) {
+	m0 := EmptyModel()
+	require := require.New(t)
+	_, err := AddItem(Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"attr1": "val1"}}, m0)
+	require.NoError(err)
+	cache := NewSchemaCache(NewLocalStore(), nil)
+	s1, err := cache.Schema(m0)
+	require.NoError(err)
+	require.NotNil(s1.QueryType().Fields()["Team"])
+	s2, err := cache.Schema(m0)
+	require.NoError(err)
+	require.True(s1.QueryType() == s2.QueryType())
+
+	// an item that fits the model does not change the schema
+	changed, err := AddItem(Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{"attr1": "val2"}}, m0)
+	require.False(changed)
+	require.NoError(err)
+	s2, err = cache.Schema(m0)
+	require.NoError(err)
+	require.True(s1.QueryType() == s2.QueryType())
+
+	changed, err = AddItem(Item{[]string{"Organization", "Org1"}, "Organization", "Org1", map[string]interface{}{"attr1": "val1"}}, m0)
+	require.True(changed)
+	require.NoError(err)
+	s2, err = cache.Schema(m0)
+	require.NoError(err)
+	require.False(s1.QueryType() == s2.QueryType())
+	require.NotNil(s2.QueryType().Fields()["Organization"])
+
+	// a replaced model gets its own schema
+	m1 := m0.Clone()
+	s3, err := cache.Schema(m1)
+	require.NoError(err)
+	require.False(s2.QueryType() == s3.QueryType())
+	require.NotNil(s3.QueryType().Fields()["Organization"])
+}
+
+func TestModelRegistry(t *testing.T) {
+	require := require.New(t)
+	m0 := EmptyModel()
+	registry := NewModelRegistry(m0)
+	var notified []*Model
+	registry.OnChange(func(model *Model) {
+		notified = append(notified, model)
+	})
+	require.True(m0 == registry.Model())
+	registry.Changed()
+	require.Equal([]*Model{m0}, notified)
+	m1 := EmptyModel()
+	require.NoError(registry.Update(func(current *Model) (*Model, error) {
+		return m1, nil
+	}, nil))
+	require.True(m1 == registry.Model())
+	require.Equal(2, len(notified))
+	require.True(m1 == notified[1])
+
+	// a new model that cannot be saved does not become current, nothing changed does not notify
+	m2 := EmptyModel()
+	err := registry.Update(func(current *Model) (*Model, error) {
+		return m2, nil
+	}, func(model *Model) error {
+		return fmt.Errorf("save failed")
+	})
+	require.Error(err)
+	require.True(m1 == registry.Model())
+	require.NoError(registry.Update(func(current *Model) (*Model, error) {
+		return nil, nil
+	}, nil))
+	require.Equal(2, len(notified))
+
+	// changes to the model that cannot be saved are not seen by readers
+	it := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{}}
+	err = registry.Update(func(current *Model) (*Model, error) {
+		require.False(current == m1)
+		AddItem(it, current)
+		return current, nil
+	}, func(model *Model) error {
+		return fmt.Errorf("save failed")
+	})
+	require.Error(err)
+	require.True(m1 == registry.Model())
+	require.Empty(m1.ChildTypes(""))
+	require.Equal(2, len(notified))
+}
+
+func TestModelRegistryConcurrentUpdates(t *testing.T) {
+	require := require.New(t)
+	registry := NewModelRegistry(EmptyModel())
+	var saved Item
+	save := func(model *Model) error {
+		saved = ToItem(model)
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			it := Item{[]string{fmt.Sprintf("Type%d", i), "1"}, fmt.Sprintf("Type%d", i), "1", map[string]interface{}{}}
+			registry.Update(func(current *Model) (*Model, error) {
+				AddItem(it, current)
+				return current, nil
+			}, save)
+		}(i)
+		go func() {
+			defer wg.Done()
+			registry.Update(func(current *Model) (*Model, error) {
+				return EmptyModel(), nil
+			}, save)
+		}()
+	}
+	wg.Wait()
+	// the saved model is always the current one
+	require.Equal(saved, ToItem(registry.Model()))
+}
+
 func TestItemSerialization(t *testing.T) {
 	m0 := EmptyModel()
 	require := require.New(t)
@@ -125,3 +245,87 @@ func TestEmptyItem(t *testing.T) {
 	m0 := FromItem(it)
 	require.NotNil(m0)
 }
+
+func TestItemJSONSerialization(t *testing.T) {
+	m0 := EmptyModel()
+	require := require.New(t)
+	item1 := Item{[]string{"Organization", "Org1", "Team", "Team1"}, "Team", "Team1", map[string]interface{}{
+		"attr1": "val1",
+		"attr2": 3.14,
+	}}
+	_, err := AddItem(item1, m0)
+	require.NoError(err)
+
+	b, err := json.Marshal(ToItem(m0))
+	require.NoError(err)
+	var itemm Item
+	require.NoError(json.Unmarshal(b, &itemm))
+	m1 := FromItem(itemm)
+	require.Equal(m0.TypeAttributes, m1.TypeAttributes)
+	require.Equal(m0.ChildTypes(""), m1.ChildTypes(""))
+	require.Equal(m0.ChildTypes("Organization"), m1.ChildTypes("Organization"))
+}
+
+func TestCheckItem(t *testing.T) {
+	require := require.New(t)
+	m0 := EmptyModel()
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"attr1": "val1"}}
+	changed, err := CheckItem(item1, m0)
+	require.NoError(err)
+	require.True(changed)
+	require.Equal(0, len(m0.TypeAttributes))
+	_, err = AddItem(item1, m0)
+	require.NoError(err)
+	changed, err = CheckItem(item1, m0)
+	require.NoError(err)
+	require.False(changed)
+	changed, err = CheckItem(Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"attr1": 1.0}}, m0)
+	require.True(IsModelError(err))
+	require.False(changed)
+}
+
+// storeWriter writes items straight to a local store, for GraphQL mutations
+type storeWriter struct {
+	*LocalStore
+}
+
+func (w storeWriter) Write(item Item, version string) error {
+	return w.WriteIf(item, version)
+}
+
+func (w storeWriter) Delete(id ID, version string) error {
+	return w.DeleteIf(id, version)
+}
+
+func (w storeWriter) Conditional() bool {
+	return true
+}
+
+func TestSchemaGeneratedNames(t *testing.T) {
+	require := require.New(t)
+	m0 := EmptyModel()
+	// item types named like the types generated for other item types
+	for _, typeName := range []string{"Order", "OrderEdge", "OrderConnection", "OrderInput", "PageInfo", "RootQuery"} {
+		_, err := AddItem(Item{[]string{typeName, "1"}, typeName, "1", map[string]interface{}{"size": 1.0}}, m0)
+		require.NoError(err)
+	}
+	store := NewLocalStore()
+	schema, err := m0.GetSchema(store, storeWriter{store})
+	require.NoError(err)
+	fields := schema.QueryType().Fields()
+	require.Equal("Order", fields["Order"].Type.(*graphql.List).OfType.Name())
+	require.Equal("OrderConnection", fields["OrderConnection"].Type.(*graphql.List).OfType.Name())
+	require.Equal("OrderConnection_", fields["OrderConnection_"].Type.Name())
+	require.NotNil(schema.Type("OrderEdge").(*graphql.Object).Fields()["size"])
+	require.NotNil(schema.Type("OrderEdge_"))
+	require.NotNil(schema.Type("OrderInput_"))
+	require.NotNil(schema.Type("PageInfo_"))
+	require.NotEqual("RootQuery", schema.QueryType().Name())
+
+	require.NoError(store.Write(Item{[]string{"OrderEdge", "1"}, "OrderEdge", "1", map[string]interface{}{"size": 1.0}}))
+	result := graphql.Do(graphql.Params{Schema: schema, RequestString: `{OrderEdge {size}}`})
+	require.Empty(result.Errors)
+	b, err := json.Marshal(result.Data)
+	require.NoError(err)
+	require.Equal(`{"OrderEdge":[{"size":1}]}`, string(b))
+}
@@ -0,0 +1,184 @@
+package item
+
+import (
+	"fmt"
+
+	"github.com/graphql-go/graphql"
+)
+
+// ItemWriter applies the changes of GraphQL mutations, with the same validation and replication as the other writes
+// Versions are the ones of conditional writes, empty to write whatever the current version
+// Conditional tells if versions can be given, otherwise they are always empty and items cannot be created, since
+// nothing could check that they do not exist when written
+type ItemWriter interface {
+	Read(id ID) (Item, error)
+	Write(item Item, version string) error
+	Delete(id ID, version string) error
+	Conditional() bool
+}
+
+// graphQLInputType gives the input type of an attribute, the same scalar as its output type
+func graphQLInputType(atype string) graphql.Input {
+	return graphQLType(atype).(graphql.Input)
+}
+
+// inputValue converts a GraphQL input value to the type the model records for the attribute
+// GraphQL gives int for Int and float64 for Float, while attributes read from JSON are float64
+func inputValue(v interface{}, atype string) interface{} {
+	i, ok := v.(int)
+	if !ok {
+		return v
+	}
+	switch atype {
+	case "float64":
+		return float64(i)
+	case "int64":
+		return int64(i)
+	}
+	return v
+}
+
+// mutationArguments are the arguments identifying an item in mutations: the ID of its parent, empty for top level
+// items, and its own key under the parent
+func mutationArguments() graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		"parent": &graphql.ArgumentConfig{
+			Type: graphql.String,
+		},
+		"id": &graphql.ArgumentConfig{
+			Type: graphql.NewNonNull(graphql.String),
+		},
+	}
+}
+
+// mutationID builds the ID of the item of the given type a mutation is about
+func mutationID(typeName string, params graphql.ResolveParams) ID {
+	parent, _ := params.Args["parent"].(string)
+	key, _ := params.Args["id"].(string)
+	var id ID
+	if len(parent) > 0 {
+		id = StringToID(parent)
+	}
+	return append(id, typeName, key)
+}
+
+// mutationContents sets the attributes given in the contents argument of a mutation
+func mutationContents(contents map[string]interface{}, attributes map[string]string, params graphql.ResolveParams) {
+	input, _ := params.Args["contents"].(map[string]interface{})
+	for k, v := range input {
+		contents[k] = inputValue(v, attributes[k])
+	}
+}
+
+// mutationFields generates the create, update and delete mutations of an item type
+// Create fails if the item exists, update changes the name and the given attributes of an existing item
+// Update and delete take an optional version, to only change the item if it is still at that version, when the writer
+// supports conditional writes
+func mutationFields(typeName string, inputName string, object *graphql.Object, attributes map[string]string, writer ItemWriter) graphql.Fields {
+	inputFields := graphql.InputObjectConfigFieldMap{}
+	for an, at := range attributes {
+		inputFields[an] = &graphql.InputObjectFieldConfig{
+			Type: graphQLInputType(at),
+		}
+	}
+	input := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:   inputName,
+		Fields: inputFields,
+	})
+	createArgs := mutationArguments()
+	createArgs["name"] = &graphql.ArgumentConfig{
+		Type: graphql.NewNonNull(graphql.String),
+	}
+	updateArgs := mutationArguments()
+	updateArgs["name"] = &graphql.ArgumentConfig{
+		Type: graphql.String,
+	}
+	// an input object needs at least one field
+	if len(inputFields) > 0 {
+		createArgs["contents"] = &graphql.ArgumentConfig{
+			Type: input,
+		}
+		updateArgs["contents"] = &graphql.ArgumentConfig{
+			Type: input,
+		}
+	}
+	deleteArgs := mutationArguments()
+	conditional := writer.Conditional()
+	if conditional {
+		updateArgs["version"] = &graphql.ArgumentConfig{
+			Type: graphql.String,
+		}
+		deleteArgs["version"] = &graphql.ArgumentConfig{
+			Type: graphql.String,
+		}
+	}
+
+	return graphql.Fields{
+		"create" + typeName: &graphql.Field{
+			Type: object,
+			Args: createArgs,
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				id := mutationID(typeName, params)
+				if !conditional {
+					return nil, fmt.Errorf("cannot create %s: the store does not support conditional writes", IDToString(id))
+				}
+				old, err := writer.Read(id)
+				if err != nil {
+					return nil, err
+				}
+				if !old.IsEmpty() {
+					return nil, fmt.Errorf("%s already exists", IDToString(id))
+				}
+				name, _ := params.Args["name"].(string)
+				it := Item{ID: id, Type: typeName, Name: name, Contents: make(map[string]interface{})}
+				mutationContents(it.Contents, attributes, params)
+				// the item may have been created since it was read
+				if err = writer.Write(it, NoVersion); err != nil {
+					return nil, err
+				}
+				return it.Flatten(), nil
+			},
+		},
+		"update" + typeName: &graphql.Field{
+			Type: object,
+			Args: updateArgs,
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				id := mutationID(typeName, params)
+				it, err := writer.Read(id)
+				if err != nil {
+					return nil, err
+				}
+				if it.IsEmpty() {
+					return nil, fmt.Errorf("%s does not exist", IDToString(id))
+				}
+				if name, ok := params.Args["name"].(string); ok {
+					it.Name = name
+				}
+				if it.Contents == nil {
+					it.Contents = make(map[string]interface{})
+				}
+				mutationContents(it.Contents, attributes, params)
+				version, _ := params.Args["version"].(string)
+				if len(version) == 0 && conditional {
+					// the item may have been deleted since it was read
+					version = AnyVersion
+				}
+				if err = writer.Write(it, version); err != nil {
+					return nil, err
+				}
+				return it.Flatten(), nil
+			},
+		},
+		"delete" + typeName: &graphql.Field{
+			Type: graphql.Boolean,
+			Args: deleteArgs,
+			Resolve: func(params graphql.ResolveParams) (interface{}, error) {
+				version, _ := params.Args["version"].(string)
+				if err := writer.Delete(mutationID(typeName, params), version); err != nil {
+					return false, err
+				}
+				return true, nil
+			},
+		},
+	}
+}
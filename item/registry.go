@@ -0,0 +1,67 @@
+package item
+
+import "sync"
+
+// ModelRegistry holds the current model shared by everything that depends on it, and notifies listeners when it
+// changes, whether items add types and attributes to it or the whole model is replaced
+type ModelRegistry struct {
+	sync.RWMutex
+	model     *Model
+	listeners []func(model *Model)
+	// updates serializes the changes of the model with their saving
+	updates sync.Mutex
+}
+
+// NewModelRegistry creates a registry starting with the given model
+func NewModelRegistry(model *Model) *ModelRegistry {
+	return &ModelRegistry{model: model}
+}
+
+// Model returns the current model
+func (r *ModelRegistry) Model() *Model {
+	r.RLock()
+	defer r.RUnlock()
+	return r.model
+}
+
+// OnChange registers a function called with the current model every time it changes
+func (r *ModelRegistry) OnChange(listener func(model *Model)) {
+	r.Lock()
+	defer r.Unlock()
+	r.listeners = append(r.listeners, listener)
+}
+
+// Update changes the model, saves it and notifies the listeners, one update at a time so that a model is never saved
+// over a newer one
+// change gets a copy of the current model and returns the model to make current, either the copy changed or a new
+// one, or nil if nothing changed
+// The model only becomes current once saved, so that readers never see it half changed or unsaved
+func (r *ModelRegistry) Update(change func(current *Model) (*Model, error), save func(model *Model) error) error {
+	r.updates.Lock()
+	defer r.updates.Unlock()
+	model, err := change(r.Model().Clone())
+	if model == nil || err != nil {
+		return err
+	}
+	if save != nil {
+		if err = save(model); err != nil {
+			return err
+		}
+	}
+	r.Lock()
+	r.model = model
+	r.Unlock()
+	r.Changed()
+	return nil
+}
+
+// Changed notifies the listeners that the current model changed, after items added to it
+func (r *ModelRegistry) Changed() {
+	r.RLock()
+	model := r.model
+	listeners := r.listeners
+	r.RUnlock()
+	for _, listener := range listeners {
+		listener(model)
+	}
+}
@@ -0,0 +1,20 @@
+package item
+
+// maxReportedFailures is the maximum number of failure messages kept in a reindex report
+const maxReportedFailures = 100
+
+// ReindexReport describes the outcome of rebuilding an index
+type ReindexReport struct {
+	Index    string   `json:"index"`
+	Previous []string `json:"previous"`
+	Scanned  int      `json:"scanned"`
+	Indexed  int      `json:"indexed"`
+	Failed   int      `json:"failed"`
+	Failures []string `json:"failures"`
+	Took     int64    `json:"tookMillis"`
+}
+
+// Reindexer can rebuild its index from all the current items of another store
+type Reindexer interface {
+	Reindex(source ScanStore) (ReindexReport, error)
+}
@@ -0,0 +1,361 @@
+package item
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Replication configuration for the copy of items from the primary store to the secondary store
+type Replication struct {
+	// Interval between two polls of the outbox when no change is notified
+	Interval time.Duration
+	// BatchSize is the maximum number of outbox entries processed in one go
+	BatchSize int
+	// MinBackoff and MaxBackoff bound the delay before retrying an item that failed to replicate
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// OutboxEntry records that an item changed and has to be replicated
+type OutboxEntry struct {
+	ID       ID        `json:"id"`
+	Seq      string    `json:"seq"`
+	Enqueued time.Time `json:"enqueued"`
+}
+
+// OutboxStore durably keeps the IDs of the items whose changes still have to be replicated
+// Only IDs are kept: replicating an item copies its current state, so entries can be replayed safely
+type OutboxStore interface {
+	Enqueue(id ID) error
+	// Pending returns the oldest entries first, starting after the given sequence, or from the start if it is empty
+	Pending(after string, limit int) ([]OutboxEntry, error)
+	Ack(entries []OutboxEntry) error
+	Size() (int, error)
+}
+
+// JournalStore is an outbox store that can record the change of an item in its outbox together with the change
+// itself, so that no change is lost if the process stops in between
+// Journal is called once before any change, when the changes start being replicated
+type JournalStore interface {
+	OutboxStore
+	Journal()
+}
+
+// VersionedStore applies the statuses of items read from the primary store, ignoring the ones older than the status
+// it has, so that a copy read before a more recent one cannot overwrite it
+type VersionedStore interface {
+	Apply(id ID, st Status) error
+}
+
+// MemoryOutbox is an outbox for stores that cannot keep one, changes not yet replicated are lost on restart
+type MemoryOutbox struct {
+	mux     sync.Mutex
+	entries []OutboxEntry
+	// seq is the sequence of the last entry, entries are numbered so that they can be compared
+	seq uint64
+}
+
+// NewMemoryOutbox creates an empty in memory outbox
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// Enqueue adds an entry for the given item
+func (o *MemoryOutbox) Enqueue(id ID) error {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.seq++
+	o.entries = append(o.entries, OutboxEntry{id, fmt.Sprintf("%020d", o.seq), time.Now()})
+	return nil
+}
+
+// Pending returns the oldest entries after the given sequence
+func (o *MemoryOutbox) Pending(after string, limit int) ([]OutboxEntry, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	entries := []OutboxEntry{}
+	for _, e := range o.entries {
+		if len(entries) == limit {
+			break
+		}
+		if e.Seq > after {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Ack removes replicated entries
+func (o *MemoryOutbox) Ack(entries []OutboxEntry) error {
+	acked := make(map[string]bool)
+	for _, e := range entries {
+		acked[e.Seq] = true
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	kept := o.entries[:0]
+	for _, e := range o.entries {
+		if !acked[e.Seq] {
+			kept = append(kept, e)
+		}
+	}
+	o.entries = kept
+	return nil
+}
+
+// Size returns the number of entries
+func (o *MemoryOutbox) Size() (int, error) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	return len(o.entries), nil
+}
+
+// ReplicationMetrics describes the state of the replication
+type ReplicationMetrics struct {
+	Pending     int       `json:"pending"`
+	Retrying    int       `json:"retrying"`
+	Oldest      time.Time `json:"oldest"`
+	LagSeconds  float64   `json:"lagSeconds"`
+	Replicated  uint64    `json:"replicated"`
+	Failures    uint64    `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess"`
+}
+
+// retry is the backoff state of an item that failed to replicate
+type retry struct {
+	attempts int
+	next     time.Time
+}
+
+// Replicator copies the items listed in an outbox from the primary store to the secondary store
+// Items are copied one at a time in the order of the outbox, an item that fails is retried with an exponential
+// backoff without blocking the others
+type Replicator struct {
+	mux       sync.Mutex
+	primary   Store
+	secondary Store
+	outbox    OutboxStore
+	config    Replication
+	retries   map[string]retry
+	journaled bool
+	metrics   ReplicationMetrics
+	notify    chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewReplicator creates a replicator, using the outbox of the primary store if it has one, an in memory one otherwise
+func NewReplicator(primary Store, secondary Store, config Replication) *Replicator {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff < config.MinBackoff {
+		config.MaxBackoff = time.Minute
+	}
+	outbox, ok := primary.(OutboxStore)
+	if !ok {
+		outbox = NewMemoryOutbox()
+	}
+	js, journaled := primary.(JournalStore)
+	if journaled {
+		js.Journal()
+	}
+	return &Replicator{primary: primary, secondary: secondary, outbox: outbox, config: config,
+		retries: make(map[string]retry), journaled: journaled, notify: make(chan struct{}, 1)}
+}
+
+// Enqueue adds an entry for an item to the outbox, even if it did not change, like to repair the secondary store
+func (r *Replicator) Enqueue(id ID) error {
+	err := r.outbox.Enqueue(id)
+	if err != nil {
+		return err
+	}
+	r.wake()
+	return nil
+}
+
+// Changed records that items changed in the primary store
+// It must be called after the changes are written, so that the replication reads the new state
+// A primary store that journals its changes already has the outbox entries, so the replication is only woken up
+func (r *Replicator) Changed(ids ...ID) error {
+	if r.journaled {
+		r.wake()
+		return nil
+	}
+	for _, id := range ids {
+		if err := r.Enqueue(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wake starts a replication without waiting for the next poll
+func (r *Replicator) wake() {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Start replicating in the background
+func (r *Replicator) Start() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(r.stop, r.done)
+}
+
+// Stop replicating, waiting for the current batch to finish
+func (r *Replicator) Stop() {
+	r.mux.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mux.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (r *Replicator) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		r.Replicate()
+		select {
+		case <-stop:
+			return
+		case <-r.notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Replicate processes the pending entries of the outbox once
+// The outbox is read page by page past the entries of the items waiting to be retried, until a batch of items is
+// copied or the outbox is exhausted, so that failing items do not hold back the others
+func (r *Replicator) Replicate() {
+	now := time.Now()
+	var after string
+	copied := 0
+	for copied < r.config.BatchSize {
+		entries, err := r.outbox.Pending(after, r.config.BatchSize)
+		if err != nil {
+			r.failed("", err)
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+		after = entries[len(entries)-1].Seq
+		// group entries per item, keeping the order of the first one, so that each item is copied once
+		byID := make(map[string][]OutboxEntry)
+		var order []string
+		for _, e := range entries {
+			k := IDToString(e.ID)
+			if _, ok := byID[k]; !ok {
+				order = append(order, k)
+			}
+			byID[k] = append(byID[k], e)
+		}
+		for _, k := range order {
+			r.mux.Lock()
+			rt, retrying := r.retries[k]
+			r.mux.Unlock()
+			if retrying && now.Before(rt.next) {
+				continue
+			}
+			copied++
+			err = r.copy(StringToID(k))
+			if err == nil {
+				err = r.outbox.Ack(byID[k])
+			}
+			if err != nil {
+				r.failed(k, err)
+				continue
+			}
+			r.mux.Lock()
+			delete(r.retries, k)
+			r.metrics.Replicated++
+			r.metrics.LastSuccess = time.Now()
+			r.mux.Unlock()
+		}
+		if len(entries) < r.config.BatchSize {
+			return
+		}
+	}
+}
+
+// copy makes the secondary store match the current state of the item in the primary store
+func (r *Replicator) copy(id ID) error {
+	if vs, ok := r.secondary.(VersionedStore); ok {
+		st, err := latestStatus(r.primary, id)
+		if err != nil {
+			return err
+		}
+		return vs.Apply(id, st)
+	}
+	it, err := r.primary.Read(id)
+	if err != nil {
+		return err
+	}
+	if it.IsEmpty() {
+		return r.secondary.Delete(id)
+	}
+	return r.secondary.Write(it)
+}
+
+func (r *Replicator) failed(k string, err error) {
+	log.Printf("Replication of %s failed: %v", k, err)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.metrics.Failures++
+	r.metrics.LastError = err.Error()
+	if len(k) > 0 {
+		rt := r.retries[k]
+		backoff := r.config.MinBackoff << uint(rt.attempts)
+		if backoff > r.config.MaxBackoff || backoff <= 0 {
+			backoff = r.config.MaxBackoff
+		}
+		rt.attempts++
+		rt.next = time.Now().Add(backoff)
+		r.retries[k] = rt
+	}
+}
+
+// Metrics returns the current state of the replication
+func (r *Replicator) Metrics() (ReplicationMetrics, error) {
+	size, err := r.outbox.Size()
+	if err != nil {
+		return ReplicationMetrics{}, err
+	}
+	oldest, err := r.outbox.Pending("", 1)
+	if err != nil {
+		return ReplicationMetrics{}, err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	m := r.metrics
+	m.Pending = size
+	m.Retrying = len(r.retries)
+	if len(oldest) > 0 {
+		m.Oldest = oldest[0].Enqueued
+		m.LagSeconds = time.Since(m.Oldest).Seconds()
+	}
+	return m, nil
+}
@@ -0,0 +1,228 @@
+package item
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func DoTestOutboxStore(o OutboxStore, t *testing.T) {
+	require := require.New(t)
+	// start from an empty outbox
+	entries, err := o.Pending("", 1000)
+	require.NoError(err)
+	require.NoError(o.Ack(entries))
+
+	id1 := []string{"Team", "Team1"}
+	id2 := []string{"Team", "Team2"}
+	require.NoError(o.Enqueue(id1))
+	require.NoError(o.Enqueue(id2))
+	require.NoError(o.Enqueue(id1))
+	size, err := o.Size()
+	require.NoError(err)
+	require.Equal(3, size)
+
+	entries, err = o.Pending("", 2)
+	require.NoError(err)
+	require.Equal(2, len(entries))
+	require.Equal(id1, entries[0].ID)
+	require.Equal(id2, entries[1].ID)
+	require.False(entries[1].Enqueued.Before(entries[0].Enqueued))
+	next, err := o.Pending(entries[0].Seq, 10)
+	require.NoError(err)
+	require.Equal(2, len(next))
+	require.Equal(entries[1], next[0])
+	require.Equal(id1, next[1].ID)
+
+	require.NoError(o.Ack(entries[:1]))
+	entries, err = o.Pending("", 10)
+	require.NoError(err)
+	require.Equal(2, len(entries))
+	require.Equal(id2, entries[0].ID)
+	require.Equal(id1, entries[1].ID)
+	require.NoError(o.Ack(entries))
+	size, err = o.Size()
+	require.NoError(err)
+	require.Equal(0, size)
+}
+
+func TestMemoryOutbox(t *testing.T) {
+	DoTestOutboxStore(NewMemoryOutbox(), t)
+}
+
+func TestReplicator(t *testing.T) {
+	require := require.New(t)
+	primary := NewLocalStore()
+	secondary := &failingStore{NewLocalStore(), "Team/Team2"}
+	r := NewReplicator(primary, secondary, Replication{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	item2 := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{}}
+	for _, it := range []Item{item1, item2} {
+		require.NoError(primary.Write(it))
+		require.NoError(r.Enqueue(it.ID))
+	}
+	require.NoError(primary.Delete(item1.ID))
+	require.NoError(secondary.Store.Write(item1))
+	require.NoError(r.Enqueue(item1.ID))
+
+	r.Replicate()
+	it, err := secondary.Read(item1.ID)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+	m, err := r.Metrics()
+	require.NoError(err)
+	require.Equal(1, m.Pending)
+	require.Equal(1, m.Retrying)
+	require.Equal(uint64(1), m.Replicated)
+	require.Equal(uint64(1), m.Failures)
+	require.NotEmpty(m.LastError)
+	require.True(m.LagSeconds >= 0)
+
+	secondary.failID = ""
+	time.Sleep(2 * time.Millisecond)
+	r.Replicate()
+	it, err = secondary.Read(item2.ID)
+	require.NoError(err)
+	require.Equal(item2, it)
+	m, err = r.Metrics()
+	require.NoError(err)
+	require.Equal(0, m.Pending)
+	require.Equal(0, m.Retrying)
+	require.Equal(uint64(2), m.Replicated)
+	require.Equal(0.0, m.LagSeconds)
+}
+
+// journalingStore adds an outbox entry with every write once it journals its changes, like the Cassandra store
+type journalingStore struct {
+	*LocalStore
+	*MemoryOutbox
+	journal bool
+}
+
+func (s *journalingStore) Journal() {
+	s.journal = true
+}
+
+func (s *journalingStore) Write(item Item) error {
+	err := s.LocalStore.Write(item)
+	if err == nil && s.journal {
+		err = s.MemoryOutbox.Enqueue(item.ID)
+	}
+	return err
+}
+
+func TestReplicatorJournal(t *testing.T) {
+	require := require.New(t)
+	primary := &journalingStore{NewLocalStore(), NewMemoryOutbox(), false}
+	secondary := NewLocalStore()
+	r := NewReplicator(primary, secondary, Replication{})
+	require.True(primary.journal)
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	require.NoError(primary.Write(item1))
+	// the store already has the entry
+	require.NoError(r.Changed(item1.ID))
+	size, err := primary.Size()
+	require.NoError(err)
+	require.Equal(1, size)
+	// a repair adds one
+	require.NoError(r.Enqueue(item1.ID))
+	size, err = primary.Size()
+	require.NoError(err)
+	require.Equal(2, size)
+
+	r.Replicate()
+	it, err := secondary.Read(item1.ID)
+	require.NoError(err)
+	require.Equal(item1, it)
+	size, err = primary.Size()
+	require.NoError(err)
+	require.Equal(0, size)
+}
+
+// poisonStore never accepts some items
+type poisonStore struct {
+	Store
+	poison map[string]bool
+}
+
+func (s *poisonStore) Write(item Item) error {
+	if s.poison[IDToString(item.ID)] {
+		return NewStoreInternalError(fmt.Errorf("poison"))
+	}
+	return s.Store.Write(item)
+}
+
+func TestReplicatorPoison(t *testing.T) {
+	require := require.New(t)
+	primary := NewLocalStore()
+	secondary := &poisonStore{NewLocalStore(), map[string]bool{"Team/Bad1": true, "Team/Bad2": true}}
+	r := NewReplicator(primary, secondary, Replication{BatchSize: 2, MinBackoff: time.Hour})
+	for _, name := range []string{"Bad1", "Bad2", "Good"} {
+		it := Item{[]string{"Team", name}, "Team", name, map[string]interface{}{}}
+		require.NoError(primary.Write(it))
+		require.NoError(r.Enqueue(it.ID))
+	}
+	// the first batch only has failing items
+	r.Replicate()
+	m, err := r.Metrics()
+	require.NoError(err)
+	require.Equal(3, m.Pending)
+	require.Equal(2, m.Retrying)
+	// the next one goes past them while they wait to be retried
+	r.Replicate()
+	it, err := secondary.Read([]string{"Team", "Good"})
+	require.NoError(err)
+	require.False(it.IsEmpty())
+	m, err = r.Metrics()
+	require.NoError(err)
+	require.Equal(2, m.Pending)
+	require.Equal(2, m.Retrying)
+	require.Equal(uint64(1), m.Replicated)
+}
+
+// versionedStore records the statuses it is given
+type versionedStore struct {
+	*LocalStore
+	applied []Status
+}
+
+func (s *versionedStore) Apply(id ID, st Status) error {
+	s.applied = append(s.applied, st)
+	return nil
+}
+
+func TestReplicatorVersioned(t *testing.T) {
+	require := require.New(t)
+	primary := NewLocalStore()
+	secondary := &versionedStore{LocalStore: NewLocalStore()}
+	r := NewReplicator(primary, secondary, Replication{})
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	require.NoError(primary.Write(item1))
+	require.NoError(primary.Delete(item1.ID))
+	require.NoError(r.Changed(item1.ID))
+	r.Replicate()
+	// the deletion is copied with the time it was written
+	sts, err := primary.History(item1.ID, 1)
+	require.NoError(err)
+	require.Equal([]Status{sts[0]}, secondary.applied)
+	require.Equal("DELETED", secondary.applied[0].Status)
+}
+
+func TestReplicatorStartStop(t *testing.T) {
+	require := require.New(t)
+	primary := NewLocalStore()
+	secondary := NewLocalStore()
+	r := NewReplicator(primary, secondary, Replication{Interval: time.Hour})
+	r.Start()
+	item1 := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	require.NoError(primary.Write(item1))
+	require.NoError(r.Enqueue(item1.ID))
+	require.Eventually(func() bool {
+		it, _ := secondary.Read(item1.ID)
+		return !it.IsEmpty()
+	}, time.Second, time.Millisecond)
+	r.Stop()
+	r.Stop()
+}
@@ -0,0 +1,68 @@
+package item
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/graphql-go/graphql"
+)
+
+// SchemaCache keeps the graphql schema generated from a model, and only generates it again when the model changes
+// or is replaced by another one
+type SchemaCache struct {
+	ss     SearchStore
+	writer ItemWriter
+	// current holds the last built *cachedSchema, so that requests read it without waiting for a rebuild
+	current atomic.Value
+	// building makes concurrent requests wait for a single rebuild
+	building sync.Mutex
+}
+
+// cachedSchema is a schema and the version of the model it was built from
+type cachedSchema struct {
+	model   *Model
+	version uint64
+	schema  graphql.Schema
+}
+
+// NewSchemaCache creates a cache of schemas with queries on the search store, and mutations if a writer is given
+func NewSchemaCache(ss SearchStore, writer ItemWriter) *SchemaCache {
+	return &SchemaCache{ss: ss, writer: writer}
+}
+
+// Schema returns the schema of the given model, built again only if the model changed since the last call
+func (sc *SchemaCache) Schema(model *Model) (graphql.Schema, error) {
+	if cs := sc.cached(model); cs != nil {
+		return cs.schema, nil
+	}
+	sc.building.Lock()
+	defer sc.building.Unlock()
+	// another request may have built it while we waited
+	if cs := sc.cached(model); cs != nil {
+		return cs.schema, nil
+	}
+	model.RLock()
+	version := model.version
+	schema, err := model.buildSchema(sc.ss, sc.writer)
+	model.RUnlock()
+	if err != nil {
+		return schema, err
+	}
+	sc.current.Store(&cachedSchema{model, version, schema})
+	return schema, nil
+}
+
+// cached returns the cached schema if it was built from the current version of the model, nil otherwise
+func (sc *SchemaCache) cached(model *Model) *cachedSchema {
+	cs, _ := sc.current.Load().(*cachedSchema)
+	if cs == nil || cs.model != model {
+		return nil
+	}
+	model.RLock()
+	version := model.version
+	model.RUnlock()
+	if cs.version != version {
+		return nil
+	}
+	return cs
+}
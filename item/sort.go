@@ -0,0 +1,212 @@
+package item
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sort orders search results on a field
+type Sort struct {
+	// Field is item.id, item.type, item.name, item.updated or an attribute of the contents
+	Field      string
+	Descending bool
+	// Text is true when the values are compared as strings
+	Text bool
+}
+
+// sortFields maps the names of the item fields that can be sorted on to their search field
+var sortFields = map[string]string{
+	"id":      "item.id",
+	"type":    "item.type",
+	"name":    "item.name",
+	"updated": "item.updated",
+}
+
+// ParseSort reads a comma separated list of fields, each prefixed with - to sort in descending order
+// Fields are id, type, name, updated or an attribute known to the model, prefixed with "contents." if it clashes with an
+// item field
+func ParseSort(sortString string, model *Model) ([]Sort, error) {
+	var sorts []Sort
+	for _, f := range strings.Split(sortString, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			continue
+		}
+		s := Sort{}
+		if strings.HasPrefix(f, "-") {
+			s.Descending = true
+			f = f[1:]
+		} else {
+			f = strings.TrimPrefix(f, "+")
+		}
+		if sf, ok := sortFields[f]; ok {
+			s.Field = sf
+			s.Text = sf != "item.updated"
+		} else {
+			s.Field = strings.TrimPrefix(f, "contents.")
+			atype, ok := model.attributeType(s.Field)
+			if !ok {
+				return nil, NewQueryValidationError(fmt.Sprintf("cannot sort on unknown field %s", f))
+			}
+			s.Text = atype == "string"
+		}
+		sorts = append(sorts, s)
+	}
+	return sorts, nil
+}
+
+// attributeType gives the type of an attribute in any item type, preferring string if the types disagree
+func (model *Model) attributeType(attribute string) (string, bool) {
+	model.RLock()
+	defer model.RUnlock()
+	var atype string
+	for _, ats := range model.TypeAttributes {
+		if t, ok := ats[attribute]; ok && (len(atype) == 0 || t == "string") {
+			atype = t
+		}
+	}
+	return atype, len(atype) > 0
+}
+
+// SortBy sets the order of the results of the query
+func (q *Query) SortBy(sorts ...Sort) *Query {
+	q.Sort = sorts
+	return q
+}
+
+// validatePage checks that the query asks for at least one result and uses either an offset or a cursor
+func (q *Query) validatePage() error {
+	if q.Length <= 0 {
+		return NewQueryValidationError("the page length must be positive")
+	}
+	if len(q.After) > 0 && q.From > 0 {
+		return NewQueryValidationError("a query cannot have both an offset and a cursor")
+	}
+	return nil
+}
+
+// sortStatuses orders the statuses using the given sorts, the ID breaking ties
+func sortStatuses(sts []Status, sorts []Sort) {
+	keys := make(map[string][]interface{}, len(sts))
+	for _, st := range sts {
+		keys[IDToString(st.Item.ID)] = sortKey(st, sorts)
+	}
+	sort.SliceStable(sts, func(i, j int) bool {
+		return compareKeys(keys[IDToString(sts[i].Item.ID)], keys[IDToString(sts[j].Item.ID)], sorts) < 0
+	})
+}
+
+// updatedLayout formats update times so that they sort as text
+const updatedLayout = "2006-01-02T15:04:05.000000000Z"
+
+// sortKey gives the values of the sort fields of an item followed by its ID, a missing value being nil
+func sortKey(st Status, sorts []Sort) []interface{} {
+	key := make([]interface{}, 0, len(sorts)+1)
+	for _, s := range sorts {
+		if s.Field == "item.updated" {
+			key = append(key, st.Updated.UTC().Format(updatedLayout))
+			continue
+		}
+		if vs := fieldValues(st.Item, s.Field); len(vs) > 0 {
+			key = append(key, vs[0])
+		} else {
+			key = append(key, nil)
+		}
+	}
+	return append(key, IDToString(st.Item.ID))
+}
+
+// compareKeys compares sort keys, items without a value for a field come last whatever the order
+func compareKeys(k1 []interface{}, k2 []interface{}, sorts []Sort) int {
+	for i, s := range sorts {
+		v1, ok1 := k1[i].(string)
+		v2, ok2 := k2[i].(string)
+		c := 0
+		switch {
+		case !ok1 && !ok2:
+		case !ok1:
+			return 1
+		case !ok2:
+			return -1
+		default:
+			c = compareValues(v1, v2, s.Text || s.Field == "item.updated")
+		}
+		if s.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(k1[len(sorts)].(string), k2[len(sorts)].(string))
+}
+
+// validKey checks that a key read from a cursor has the shape of the keys of the given sorts
+func validKey(key []interface{}, sorts []Sort) bool {
+	if len(key) != len(sorts)+1 {
+		return false
+	}
+	for i, v := range key {
+		if _, ok := v.(string); !ok && (v != nil || i == len(sorts)) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeSearchCursor makes an opaque cursor from the sort values of the last result of a page
+func encodeSearchCursor(values []interface{}) string {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeSearchCursor reads the sort values of a cursor, keeping numbers as they were written
+func decodeSearchCursor(cursor string) ([]interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, NewInvalidCursorError(cursor)
+	}
+	var values []interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err = dec.Decode(&values); err != nil || len(values) == 0 {
+		return nil, NewInvalidCursorError(cursor)
+	}
+	return values, nil
+}
+
+// compareValues compares values as numbers unless they are text or cannot be parsed
+func compareValues(v1 string, v2 string, text bool) int {
+	if !text {
+		f1, err1 := strconv.ParseFloat(v1, 64)
+		f2, err2 := strconv.ParseFloat(v2, 64)
+		if err1 == nil && err2 == nil {
+			switch {
+			case f1 < f2:
+				return -1
+			case f1 > f2:
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+	return strings.Compare(v1, v2)
+}
+
+// statusItems gives the items of the statuses
+func statusItems(sts []Status) []Item {
+	items := make([]Item, len(sts))
+	for i, st := range sts {
+		items[i] = st.Item
+	}
+	return items
+}
@@ -0,0 +1,74 @@
+package item
+
+import (
+	"sort"
+	"strings"
+)
+
+// Suggestion is an item whose name matches the beginning of what a user typed
+type Suggestion struct {
+	ID   ID     `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// SuggestStore can suggest items from the beginning of their name, optionally of a given type and in a given
+// namespace, like Organization/Org1 for all the items under Org1
+// A name matches if one of its words starts with the prefix, ignoring case, the prefix can span several words
+// Suggestions are sorted by name then by ID
+type SuggestStore interface {
+	Suggest(prefix string, itemType string, namespace string, size int) ([]Suggestion, error)
+}
+
+// DefaultSuggestSize is the number of suggestions returned if no size is given
+const DefaultSuggestSize = 10
+
+// validateSuggest checks the prefix and gives the number of suggestions to return
+func validateSuggest(prefix string, size int) (int, error) {
+	if len(strings.TrimSpace(prefix)) == 0 {
+		return 0, NewQueryValidationError("a suggestion needs a prefix")
+	}
+	if size <= 0 {
+		return DefaultSuggestSize, nil
+	}
+	return size, nil
+}
+
+// suggestItems selects the suggestions among the current items for the stores that match items themselves
+func suggestItems(sts []Status, prefix string, itemType string, namespace string, size int) ([]Suggestion, error) {
+	size, err := validateSuggest(prefix, size)
+	if err != nil {
+		return []Suggestion{}, err
+	}
+	lp := strings.ToLower(strings.TrimSpace(prefix))
+	suggestions := []Suggestion{}
+	for _, st := range searchable(sts) {
+		it := st.Item
+		if (len(itemType) > 0 && it.Type != itemType) || (len(namespace) > 0 && !containsString(AllNamespaces(it.ID), namespace)) {
+			continue
+		}
+		if nameHasPrefix(it.Name, lp) {
+			suggestions = append(suggestions, Suggestion{it.ID, it.Name, it.Type})
+		}
+	}
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Name < suggestions[j].Name
+	})
+	if len(suggestions) > size {
+		suggestions = suggestions[:size]
+	}
+	return suggestions, nil
+}
+
+// nameHasPrefix checks if the name, from the start of one of its words, starts with the lower case prefix
+func nameHasPrefix(name string, prefix string) bool {
+	ln := strings.ToLower(name)
+	previous := ' '
+	for i, r := range ln {
+		if isSeparator(previous) && !isSeparator(r) && strings.HasPrefix(ln[i:], prefix) {
+			return true
+		}
+		previous = r
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package item
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// VerifyReport lists the differences between the items of a primary store and the documents of a secondary store
+type VerifyReport struct {
+	// Primary is the number of current items in the primary store
+	Primary int `json:"primary"`
+	// Secondary is the number of documents in the secondary store
+	Secondary int `json:"secondary"`
+	// Missing items are in the primary store but not in the secondary store
+	Missing []ID `json:"missing"`
+	// Stale items are in both stores, but the secondary store does not have the current version
+	Stale []ID `json:"stale"`
+	// Orphaned items are in the secondary store but deleted or absent from the primary store
+	Orphaned []ID     `json:"orphaned"`
+	Repaired int      `json:"repaired"`
+	Failures []string `json:"failures"`
+	Took     int64    `json:"tookMillis"`
+}
+
+// Consistent is true when both stores have the same items
+func (r VerifyReport) Consistent() bool {
+	return len(r.Missing) == 0 && len(r.Stale) == 0 && len(r.Orphaned) == 0
+}
+
+// Verify compares the current items of the primary store with the documents of the secondary store
+// If repair is not nil, each difference is fixed by writing the primary item or deleting the orphaned document with it
+// Items changed while the stores are walked may be reported even if replication fixes them soon after
+// The model is not searchable so it is not compared
+func Verify(primary ScanStore, secondary SearchStore, repair Store) (VerifyReport, error) {
+	start := time.Now()
+	report := VerifyReport{Missing: []ID{}, Stale: []ID{}, Orphaned: []ID{}, Failures: []string{}}
+
+	docs := make(map[string]Item)
+	scoreC := make(chan Score)
+	errorC := make(chan error)
+	go secondary.Scroll("item.id:*", scoreC, errorC)
+	var errs []string
+	for scoreC != nil {
+		select {
+		case sc, ok := <-scoreC:
+			if !ok {
+				scoreC = nil
+				continue
+			}
+			if !IsModelID(sc.Item.ID) {
+				docs[IDToString(sc.Item.ID)] = sc.Item
+			}
+		case err := <-errorC:
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := NewMultipleItemErrors(errs); err != nil {
+		return report, err
+	}
+	report.Secondary = len(docs)
+
+	itemC := make(chan Item)
+	scanErrorC := make(chan error, 1)
+	go primary.ScanItems(itemC, scanErrorC)
+	for it := range itemC {
+		if IsModelID(it.ID) {
+			continue
+		}
+		report.Primary++
+		k := IDToString(it.ID)
+		doc, ok := docs[k]
+		delete(docs, k)
+		if !ok {
+			report.Missing = append(report.Missing, it.ID)
+		} else if !sameItem(it, doc) {
+			report.Stale = append(report.Stale, it.ID)
+		} else {
+			continue
+		}
+		if repair != nil {
+			report.repaired(it.ID, repair.Write(it))
+		}
+	}
+	select {
+	case err := <-scanErrorC:
+		return report, err
+	default:
+	}
+
+	for k := range docs {
+		report.Orphaned = append(report.Orphaned, StringToID(k))
+	}
+	sort.Slice(report.Orphaned, func(i, j int) bool {
+		return IDToString(report.Orphaned[i]) < IDToString(report.Orphaned[j])
+	})
+	if repair != nil {
+		for _, id := range report.Orphaned {
+			report.repaired(id, repair.Delete(id))
+		}
+	}
+	report.Took = time.Since(start).Nanoseconds() / int64(time.Millisecond)
+	return report, nil
+}
+
+func (r *VerifyReport) repaired(id ID, err error) {
+	if err != nil {
+		if len(r.Failures) < maxReportedFailures {
+			r.Failures = append(r.Failures, IDToString(id)+": "+err.Error())
+		}
+	} else {
+		r.Repaired++
+	}
+}
+
+// sameItem compares items through their JSON representation, since stores may not decode contents to the same types
+func sameItem(it1 Item, it2 Item) bool {
+	for _, it := range []*Item{&it1, &it2} {
+		if it.Contents == nil {
+			it.Contents = map[string]interface{}{}
+		}
+	}
+	b1, err1 := json.Marshal(it1)
+	b2, err2 := json.Marshal(it2)
+	return err1 == nil && err2 == nil && bytes.Equal(b1, b2)
+}
@@ -0,0 +1,46 @@
+package item
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	require := require.New(t)
+	primary := NewLocalStore()
+	secondary := NewLocalStore()
+	same := Item{[]string{"Team", "Team1"}, "Team", "Team1", map[string]interface{}{"field1": "value1"}}
+	missing := Item{[]string{"Team", "Team2"}, "Team", "Team2", map[string]interface{}{}}
+	stale := Item{[]string{"Team", "Team3"}, "Team", "Team3", map[string]interface{}{"field1": "value3"}}
+	old := Item{[]string{"Team", "Team3"}, "Team", "Team3", map[string]interface{}{"field1": "value2"}}
+	orphaned := Item{[]string{"Team", "Team4"}, "Team", "Team4", map[string]interface{}{}}
+	for _, it := range []Item{same, missing, stale, orphaned, ToItem(EmptyModel())} {
+		require.NoError(primary.Write(it))
+	}
+	require.NoError(primary.Delete(orphaned.ID))
+	for _, it := range []Item{same, old, orphaned} {
+		require.NoError(secondary.Write(it))
+	}
+
+	report, err := Verify(primary, secondary, nil)
+	require.NoError(err)
+	require.False(report.Consistent())
+	require.Equal(3, report.Primary)
+	require.Equal(3, report.Secondary)
+	require.Equal([]ID{missing.ID}, report.Missing)
+	require.Equal([]ID{stale.ID}, report.Stale)
+	require.Equal([]ID{orphaned.ID}, report.Orphaned)
+	require.Equal(0, report.Repaired)
+
+	report, err = Verify(primary, secondary, secondary)
+	require.NoError(err)
+	require.False(report.Consistent())
+	require.Equal(3, report.Repaired)
+	require.Empty(report.Failures)
+
+	report, err = Verify(primary, secondary, nil)
+	require.NoError(err)
+	require.True(report.Consistent())
+	require.Equal(3, report.Secondary)
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	item "github.com/JPMoresmau/nsrep/item"
 	"github.com/graphql-go/graphql"
@@ -21,6 +24,10 @@ func writeError(w http.ResponseWriter, err error) {
 	log.Println(err)
 	log.Println(err == nil)
 	resp := fmt.Sprintf(`{"error":"%s"}`, err.Error())
+	if item.IsConditionalWriteUnsupported(err) {
+		writeStatus(w, resp, http.StatusNotImplemented)
+		return
+	}
 	writeStatus(w, resp, http.StatusInternalServerError)
 }
 
@@ -34,11 +41,19 @@ func writeStatus(w http.ResponseWriter, content string, statusCode int) {
 	io.WriteString(w, content)
 }
 
+// writeVersionHeaders adds the version metadata of an item to the response headers
+func writeVersionHeaders(w http.ResponseWriter, st item.Status) {
+	if len(st.Version) > 0 {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, st.Version))
+		w.Header().Set("X-Item-Version", st.Version)
+		w.Header().Set("X-Item-Updated", st.Updated.UTC().Format(time.RFC3339Nano))
+		w.Header().Set("Last-Modified", st.Updated.UTC().Format(http.TimeFormat))
+	}
+}
+
 // StoreHandler is the handler with an item store
 type StoreHandler struct {
-	store     item.Store
-	secondary item.Store
-	model     *item.Model
+	service *ItemService
 }
 
 func (sh *StoreHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -49,11 +64,41 @@ func (sh *StoreHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		writeStatus(w, `{"error":"no id"}`, http.StatusBadRequest)
 		return
 	}
+	// item IDs have an even length, an extra component lists the items under the item
+	if len(id)%2 == 1 && req.Method == "GET" {
+		switch list := id[len(id)-1]; list {
+		case "children", "descendants":
+			sh.list(w, req, id[:len(id)-1], list == "descendants")
+			return
+		}
+	}
+	store := sh.service.store
+	version := ifMatch(req)
 	it := item.Item{}
+	var st item.Status
 	var err error
 	switch req.Method {
 	case "GET":
-		it, err = sh.store.Read(id)
+		if asOf := req.URL.Query().Get("asOf"); len(asOf) > 0 {
+			tts, ok := store.(item.TimeTravelStore)
+			if !ok {
+				writeStatus(w, `{"error":"asOf not supported by store"}`, http.StatusNotImplemented)
+				return
+			}
+			at, perr := time.Parse(time.RFC3339Nano, asOf)
+			if perr != nil {
+				writeStatus(w, `{"error":"asOf is not a RFC3339 timestamp"}`, http.StatusBadRequest)
+				return
+			}
+			st, err = tts.ReadAt(id, at)
+			if st.Status != "ALIVE" {
+				st = item.Status{}
+			}
+		} else {
+			st, err = item.ReadStatus(store, id)
+		}
+		it = st.Item
+		writeVersionHeaders(w, st)
 	case "POST":
 		err = json.NewDecoder(req.Body).Decode(&it)
 		if err != nil {
@@ -61,64 +106,37 @@ func (sh *StoreHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		it.ID = id
-		if !item.IsModelID(id) {
-			var changed bool
-			changed, err = item.AddItem(it, sh.model)
-			if err != nil {
-				writeStatus(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			if changed {
-				err = sh.store.Write(item.ToItem(sh.model))
-			}
-		}
-		if err == nil {
-			err = sh.store.Write(it)
-			if err != nil && item.IsModelID(id) {
-				sh.model = item.FromItem(it)
-			}
-			if err == nil && sh.secondary != nil {
-				go sh.secondary.Write(it)
-			}
+		err = sh.service.Write(it, version)
+		if item.IsModelError(err) {
+			writeStatus(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
 	case "DELETE":
-		if h2, ok2 := sh.store.(item.SearchStore); ok2 {
-			err = item.DeleteTree(id, []item.Store{sh.store, sh.secondary}, h2)
-			if err == nil {
-				writeStatus(w, "", http.StatusNoContent)
-				return
-			}
-		} else if h2, ok2 := sh.secondary.(item.SearchStore); ok2 {
-			err = item.DeleteTree(id, []item.Store{sh.store, sh.secondary}, h2)
-			if err == nil {
-				writeStatus(w, "", http.StatusNoContent)
-				return
-			}
-		} else {
-			err = sh.store.Delete(id)
-			if err == nil {
-				if item.IsModelID(id) {
-					sh.model = item.EmptyModel()
-				}
-				if sh.secondary != nil {
-					go sh.secondary.Delete(id)
-				}
-				if err == nil {
-					writeStatus(w, "", http.StatusNoContent)
-					return
-				}
-			}
+		err = sh.service.Delete(id, version)
+		if err == nil {
+			writeStatus(w, "", http.StatusNoContent)
+			return
 		}
 
 	default:
 		err = fmt.Errorf("Method %s not supported", req.Method)
 	}
+	if item.IsVersionConflict(err) {
+		writeStatus(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
 		writeError(w, err)
 		return
 	}
-	b, err := json.Marshal(it)
+	var b []byte
+	if req.Method == "GET" && !it.IsEmpty() && boolParam(req, "metadata") {
+		// the envelope carries the version metadata for clients that cannot read headers
+		b, err = json.Marshal(st)
+	} else {
+		b, err = json.Marshal(it)
+	}
 	if err != nil {
 		writeError(w, err)
 		return
@@ -132,9 +150,187 @@ func (sh *StoreHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// ListResponse is a page of items, next is the cursor to get the following page
+type ListResponse struct {
+	Items []item.Item `json:"items"`
+	Next  string      `json:"next,omitempty"`
+}
+
+// maxListLimit is the maximum number of items in a page
+const maxListLimit = 1000
+
+// list returns a page of the children or descendants of an item, an empty ID listing the top level items
+func (sh *StoreHandler) list(w http.ResponseWriter, req *http.Request, id item.ID, recursive bool) {
+	ls, ok := sh.service.store.(item.ListStore)
+	if !ok {
+		writeStatus(w, `{"error":"listing not supported by store"}`, http.StatusNotImplemented)
+		return
+	}
+	if recursive && len(id) == 0 {
+		writeStatus(w, `{"error":"no id"}`, http.StatusBadRequest)
+		return
+	}
+	limit := positiveIntParam(req, "limit", 100)
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+	cursor := req.URL.Query().Get("cursor")
+	var resp ListResponse
+	var err error
+	if recursive {
+		resp.Items, resp.Next, err = ls.Descendants(id, cursor, limit)
+	} else {
+		resp.Items, resp.Next, err = ls.Children(id, cursor, limit)
+	}
+	if item.IsInvalidCursor(err) {
+		writeStatus(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, fmt.Sprintf("%s", b))
+}
+
+// ifMatch returns the version required by the If-Match header, or an empty string
+func ifMatch(req *http.Request) string {
+	version := strings.TrimSpace(req.Header.Get("If-Match"))
+	version = strings.TrimPrefix(version, "W/")
+	return strings.Trim(version, `"`)
+}
+
+// BulkHandler writes many items in one request
+type BulkHandler struct {
+	service *ItemService
+}
+
+// BulkResult is the outcome of writing one item of a bulk request
+type BulkResult struct {
+	ID     item.ID `json:"id"`
+	Status int     `json:"status"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// BulkResponse lists the outcome of each item, in the request order
+type BulkResponse struct {
+	Errors bool         `json:"errors"`
+	Items  []BulkResult `json:"items"`
+}
+
+func (bh *BulkHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	its, err := decodeItems(req.Body)
+	if err != nil {
+		writeStatus(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	if boolParam(req, "atomic") {
+		bh.writeAll(w, its)
+		return
+	}
+	errs := bh.service.WriteBatch(its)
+	resp := BulkResponse{Items: make([]BulkResult, len(its))}
+	for i, err := range errs {
+		resp.Items[i] = BulkResult{ID: its[i].ID, Status: http.StatusOK}
+		if err != nil {
+			resp.Errors = true
+			resp.Items[i].Error = err.Error()
+			resp.Items[i].Status = http.StatusInternalServerError
+			if item.IsModelError(err) {
+				resp.Items[i].Status = http.StatusBadRequest
+			}
+		}
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, fmt.Sprintf("%s", b))
+}
+
+// writeAll writes all items or none of them
+// If some items are invalid, they are reported with their error and the others as not written
+func (bh *BulkHandler) writeAll(w http.ResponseWriter, its []item.Item) {
+	errs, err := bh.service.WriteAll(its)
+	resp := BulkResponse{Errors: err != nil, Items: make([]BulkResult, len(its))}
+	statusCode := http.StatusOK
+	for i, ierr := range errs {
+		resp.Items[i] = BulkResult{ID: its[i].ID, Status: http.StatusOK}
+		switch {
+		case ierr != nil:
+			resp.Items[i].Status = http.StatusBadRequest
+			resp.Items[i].Error = ierr.Error()
+			statusCode = http.StatusBadRequest
+		case item.IsModelError(err):
+			resp.Items[i].Status = http.StatusFailedDependency
+			resp.Items[i].Error = "not written because other items are invalid"
+		case err != nil:
+			resp.Items[i].Status = http.StatusInternalServerError
+			resp.Items[i].Error = err.Error()
+			statusCode = http.StatusInternalServerError
+		}
+	}
+	b, merr := json.Marshal(resp)
+	if merr != nil {
+		writeError(w, merr)
+		return
+	}
+	writeStatus(w, fmt.Sprintf("%s", b), statusCode)
+}
+
+// decodeItems reads either a JSON array of items or a stream of newline delimited JSON items
+func decodeItems(r io.Reader) ([]item.Item, error) {
+	its := []item.Item{}
+	br := bufio.NewReader(r)
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return its, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !unicode.IsSpace(rune(c)) {
+			br.UnreadByte()
+			break
+		}
+	}
+	array := false
+	if c, _ := br.Peek(1); c[0] == '[' {
+		array = true
+	}
+	dec := json.NewDecoder(br)
+	if array {
+		err := dec.Decode(&its)
+		return its, err
+	}
+	for {
+		var it item.Item
+		err := dec.Decode(&it)
+		if err == io.EOF {
+			return its, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		its = append(its, it)
+	}
+}
+
 // HistoryHandler is the handler with an history item store
 type HistoryHandler struct {
-	store item.HistoryStore
+	store   item.HistoryStore
+	service *ItemService
 }
 
 func (sh *HistoryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -145,6 +341,20 @@ func (sh *HistoryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		writeStatus(w, `{"error":"no id"}`, http.StatusBadRequest)
 		return
 	}
+	// item IDs have an even length, an extra component is an action on the item history
+	if len(id)%2 == 1 && len(id) > 1 {
+		action := id[len(id)-1]
+		id = id[:len(id)-1]
+		switch action {
+		case "restore":
+			sh.restore(w, req, id)
+		case "diff":
+			sh.diff(w, req, id)
+		default:
+			writeStatus(w, fmt.Sprintf(`{"error":"unknown action %s"}`, action), http.StatusNotFound)
+		}
+		return
+	}
 	limit := positiveIntParam(req, "limit", 100)
 	var its = []item.Status{}
 	var err error
@@ -169,9 +379,164 @@ func (sh *HistoryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	writeOK(w, resp)
 }
 
+func (sh *HistoryHandler) restore(w http.ResponseWriter, req *http.Request, id item.ID) {
+	if req.Method != "POST" {
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	version := req.URL.Query().Get("version")
+	if len(version) == 0 {
+		writeStatus(w, `{"error":"no version"}`, http.StatusBadRequest)
+		return
+	}
+	its, err := sh.service.Restore(id, version, boolParam(req, "recursive"))
+	if item.IsVersionNotFound(err) {
+		writeStatus(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusNotFound)
+		return
+	}
+	if item.IsModelError(err) {
+		writeStatus(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(its)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, fmt.Sprintf("%s", b))
+}
+
+func (sh *HistoryHandler) diff(w http.ResponseWriter, req *http.Request, id item.ID) {
+	if req.Method != "GET" {
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	from := req.URL.Query().Get("from")
+	if len(from) == 0 {
+		writeStatus(w, `{"error":"no from version"}`, http.StatusBadRequest)
+		return
+	}
+	d, err := item.DiffVersions(sh.store, id, from, req.URL.Query().Get("to"))
+	if item.IsVersionNotFound(err) {
+		writeStatus(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, fmt.Sprintf("%s", b))
+}
+
+// ReplicationHandler shows the state of the replication to the secondary store
+type ReplicationHandler struct {
+	replicator *item.Replicator
+}
+
+func (rh *ReplicationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	m, err := rh.replicator.Metrics()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, fmt.Sprintf("%s", b))
+}
+
+// ReindexHandler rebuilds the search index from the primary store
+type ReindexHandler struct {
+	source item.ScanStore
+	target item.Reindexer
+}
+
+// ReindexResponse is the report of a reindex, with the error that prevented the new index to be used
+type ReindexResponse struct {
+	item.ReindexReport
+	Error string `json:"error,omitempty"`
+}
+
+func (rh *ReindexHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	resp, err := reindex(rh.source, rh.target)
+	b, merr := json.Marshal(resp)
+	if merr != nil {
+		writeError(w, merr)
+		return
+	}
+	if err != nil {
+		writeStatus(w, fmt.Sprintf("%s", b), http.StatusInternalServerError)
+		return
+	}
+	writeOK(w, fmt.Sprintf("%s", b))
+}
+
+func reindex(source item.ScanStore, target item.Reindexer) (ReindexResponse, error) {
+	report, err := target.Reindex(source)
+	resp := ReindexResponse{ReindexReport: report}
+	if err != nil {
+		log.Printf("Reindex failed: %v", err)
+		resp.Error = err.Error()
+	} else {
+		log.Printf("Reindexed %d items into %s", report.Indexed, report.Index)
+	}
+	return resp, err
+}
+
+// VerifyHandler compares the primary and secondary stores
+// GET only reports the differences, POST also repairs them by queuing the items for replication
+type VerifyHandler struct {
+	primary   item.ScanStore
+	secondary item.SearchStore
+	service   *ItemService
+}
+
+func (vh *VerifyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var repair item.Store
+	switch req.Method {
+	case "GET":
+	case "POST":
+		repair = replicationQueue{vh.service, true}
+	default:
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := item.Verify(vh.primary, vh.secondary, repair)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, fmt.Sprintf("%s", b))
+}
+
 // SearchHandler is the handler with an history item store
 type SearchHandler struct {
-	store item.SearchStore
+	store  item.SearchStore
+	models *item.ModelRegistry
 }
 
 func positiveIntParam(req *http.Request, name string, def int) int {
@@ -186,21 +551,144 @@ func positiveIntParam(req *http.Request, name string, def int) int {
 	return val
 }
 
+func boolParam(req *http.Request, name string) bool {
+	val, _ := strconv.ParseBool(req.URL.Query().Get(name))
+	return val
+}
+
+// SearchRequest is the body of a structured search
+type SearchRequest struct {
+	Query  *item.Clause `json:"query"`
+	From   int          `json:"from"`
+	Length int          `json:"length"`
+	Sort   string       `json:"sort"`
+	After  string       `json:"after"`
+	// FacetSize limits the values of all facets, FacetSizes the values of the facets with the given names
+	FacetSize  int            `json:"facetSize"`
+	FacetSizes map[string]int `json:"facetSizes"`
+	// AttributeFacets are facets on attributes of the contents
+	AttributeFacets []item.AttributeFacet `json:"attributeFacets"`
+	Highlight       bool                  `json:"highlight"`
+}
+
+// maxFacetSize is the maximum number of values returned for a facet
+const maxFacetSize = 1000
+
+// setFacetSizes adds the facets to the query with their sizes, the facets are given by name
+func setFacetSizes(query *item.Query, size int, sizes map[string]int) error {
+	query.AddAllFacets()
+	for _, f := range query.Facets {
+		if size != 0 {
+			query.SetFacetSize(f, size)
+		}
+	}
+	for name, s := range sizes {
+		f, ok := item.FacetByName(name)
+		if !ok {
+			return fmt.Errorf("unknown facet %s", name)
+		}
+		query.SetFacetSize(f, s)
+	}
+	for _, f := range query.Facets {
+		if s := query.FacetSize(f); s > maxFacetSize || query.FacetSizes[f] < 0 {
+			return fmt.Errorf("facet size for %s must be between 1 and %d", f.Name(), maxFacetSize)
+		}
+	}
+	return nil
+}
+
 func (sh *SearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var resp string
-	var queries = req.URL.Query()["query"]
-	if len(queries) == 0 {
-		writeStatus(w, `{"error":"no query"}`, http.StatusBadRequest)
-		return
-	}
-	var query = queries[0]
-	var from = positiveIntParam(req, "from", 0)
-	var length = positiveIntParam(req, "length", 10)
-	var rs item.SearchResult
-	var err error
+	model := sh.models.Model()
+	var query *item.Query
+	var sortString string
+	var facetSize int
+	facetSizes := make(map[string]int)
+	var attributeFacets []item.AttributeFacet
 	switch req.Method {
 	case "GET":
-		rs, err = sh.store.Search(item.NewQuery(query).Page(from, length).AddAllFacets())
+		var queries = req.URL.Query()["query"]
+		if len(queries) == 0 {
+			writeStatus(w, `{"error":"no query"}`, http.StatusBadRequest)
+			return
+		}
+		var from = positiveIntParam(req, "from", 0)
+		var length = positiveIntParam(req, "length", 10)
+		query = item.NewQuery(queries[0]).Page(from, length)
+		query.After = req.URL.Query().Get("after")
+		query.Highlight = boolParam(req, "highlight")
+		sortString = req.URL.Query().Get("sort")
+		facetSize = positiveIntParam(req, "facetSize", 0)
+		for k := range req.URL.Query() {
+			if name := strings.TrimPrefix(k, "facetSize."); name != k {
+				facetSizes[name] = positiveIntParam(req, k, 0)
+			}
+		}
+		for _, f := range req.URL.Query()["facet"] {
+			af, err := item.ParseAttributeFacet(f, model)
+			if err != nil {
+				writeStatus(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+				return
+			}
+			attributeFacets = append(attributeFacets, af)
+		}
+	case "POST":
+		var sr SearchRequest
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&sr); err != nil {
+			writeStatus(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		if sr.Query == nil {
+			writeStatus(w, `{"error":"no query"}`, http.StatusBadRequest)
+			return
+		}
+		if sr.From < 0 || sr.Length < 0 {
+			writeStatus(w, `{"error":"from and length cannot be negative"}`, http.StatusBadRequest)
+			return
+		}
+		if sr.Length == 0 {
+			sr.Length = 10
+		}
+		query = item.NewClauseQuery(*sr.Query).Page(sr.From, sr.Length)
+		query.After = sr.After
+		query.Highlight = sr.Highlight
+		sortString = sr.Sort
+		facetSize, facetSizes = sr.FacetSize, sr.FacetSizes
+		for _, f := range sr.AttributeFacets {
+			af, err := model.ResolveAttributeFacet(f)
+			if err != nil {
+				writeStatus(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+				return
+			}
+			attributeFacets = append(attributeFacets, af)
+		}
+	default:
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	sorts, err := item.ParseSort(sortString, model)
+	if err != nil {
+		writeStatus(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err = setFacetSizes(query, facetSize, facetSizes); err != nil {
+		writeStatus(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	for _, f := range attributeFacets {
+		if f.Size > maxFacetSize {
+			msg := fmt.Sprintf("facet size for %s must be between 1 and %d", f.Attribute, maxFacetSize)
+			writeStatus(w, fmt.Sprintf(`{"error":%q}`, msg), http.StatusBadRequest)
+			return
+		}
+		query.AddAttributeFacet(f)
+	}
+	rs, err := sh.store.Search(query.SortBy(sorts...))
+	if item.IsInvalidQuery(err) || item.IsInvalidCursor(err) {
+		writeStatus(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
 	}
 	if err != nil {
 		writeError(w, err)
@@ -215,15 +703,50 @@ func (sh *SearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	writeOK(w, resp)
 }
 
-// GraphQLHandler to handle GraphQL queries
+// SuggestHandler proposes items from the beginning of their name
+type SuggestHandler struct {
+	store item.SuggestStore
+}
+
+// maxSuggestSize is the maximum number of suggestions returned
+const maxSuggestSize = 100
+
+func (sh *SuggestHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeStatus(w, fmt.Sprintf(`{"error":"Method %s not supported"}`, req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	params := req.URL.Query()
+	size := positiveIntParam(req, "size", item.DefaultSuggestSize)
+	if size > maxSuggestSize {
+		size = maxSuggestSize
+	}
+	suggestions, err := sh.store.Suggest(params.Get("prefix"), params.Get("type"), params.Get("ns"), size)
+	if item.IsInvalidQuery(err) {
+		writeStatus(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.Marshal(suggestions)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeOK(w, string(b))
+}
+
+// GraphQLHandler to handle GraphQL queries and mutations
 type GraphQLHandler struct {
-	store item.SearchStore
-	model *item.Model
+	models  *item.ModelRegistry
+	schemas *item.SchemaCache
 }
 
 func (gh *GraphQLHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var resp string
-	schema, err := gh.model.GetSchema(gh.store)
+	schema, err := gh.schemas.Schema(gh.models.Model())
 	if err != nil {
 		writeError(w, err)
 		return
@@ -246,34 +769,62 @@ func (gh *GraphQLHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	writeOK(w, resp)
 }
 
-func startServer(port int, store item.Store, secondary item.Store) (*http.Server, error) {
+func startServer(port int, store item.Store, secondary item.Store, replication item.Replication) (*http.Server, error) {
 	mux := http.NewServeMux()
 	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
 	modelItem, err := store.Read(item.ModelID)
 	if err != nil {
 		return srv, err
 	}
-	model := item.FromItem(modelItem)
-	mux.Handle("/items/", &StoreHandler{store, secondary, model})
+	// the same registry is shared by all the handlers, so that they all see the changes of the model
+	models := item.NewModelRegistry(item.FromItem(modelItem))
+	service := &ItemService{store: store, secondary: secondary, models: models}
+	service.updateMapping(models.Model())
+	models.OnChange(service.updateMapping)
+	if secondary != nil {
+		service.replicator = item.NewReplicator(store, secondary, replication)
+		service.replicator.Start()
+		srv.RegisterOnShutdown(service.replicator.Stop)
+		mux.Handle("/metrics/replication", &ReplicationHandler{service.replicator})
+		ss, ok := store.(item.ScanStore)
+		if r, ok2 := secondary.(item.Reindexer); ok && ok2 {
+			mux.Handle("/admin/reindex", &ReindexHandler{ss, r})
+		}
+		if h, ok2 := secondary.(item.SearchStore); ok && ok2 {
+			mux.Handle("/admin/verify", &VerifyHandler{ss, h, service})
+		}
+	}
+	mux.Handle("/items/", &StoreHandler{service})
+	mux.Handle("/items/_bulk", &BulkHandler{service})
 	if h, ok := store.(item.HistoryStore); ok {
-		mux.Handle("/history/", &HistoryHandler{h})
+		mux.Handle("/history/", &HistoryHandler{h, service})
 	} else if secondary != nil {
 		if h2, ok2 := secondary.(item.HistoryStore); ok2 {
-			mux.Handle("/history/", &HistoryHandler{h2})
+			mux.Handle("/history/", &HistoryHandler{h2, service})
 		}
 	}
 	if h, ok := store.(item.SearchStore); ok {
-		mux.Handle("/search", &SearchHandler{h})
-		mux.Handle("/graphql", &GraphQLHandler{h, model})
+		mux.Handle("/search", &SearchHandler{h, models})
+		mux.Handle("/graphql", &GraphQLHandler{models, item.NewSchemaCache(h, service)})
 	} else if secondary != nil {
 		if h2, ok2 := secondary.(item.SearchStore); ok2 {
-			mux.Handle("/search", &SearchHandler{h2})
-			mux.Handle("/graphql", &GraphQLHandler{h2, model})
+			mux.Handle("/search", &SearchHandler{h2, models})
+			mux.Handle("/graphql", &GraphQLHandler{models, item.NewSchemaCache(h2, service)})
 		}
 	}
+	if s, ok := store.(item.SuggestStore); ok {
+		mux.Handle("/suggest", &SuggestHandler{s})
+	} else if s2, ok2 := secondary.(item.SuggestStore); ok2 {
+		mux.Handle("/suggest", &SuggestHandler{s2})
+	}
 
+	// listen before returning so that the server accepts requests as soon as it is started
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return srv, err
+	}
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
 			// cannot panic, because this probably is an intentional close
 			log.Printf("Httpserver: ListenAndServe() error: %s", err)
 		}
@@ -305,32 +856,113 @@ func reallyWaitForStore(sc storeCreate, nb int, delay time.Duration) (item.Store
 	return reallyWaitForStore(sc, nb-1, delay*2)
 }
 
-func main() {
-	app := os.Getenv("NSREP_CONFIG_FILE")
-	if len(app) == 0 {
-		app = "application.yaml"
-	}
-	log.Printf("Reading configuration from %s\n", app)
-	c, err := ReadFileConfig(app)
-	if err != nil {
-		log.Panicf("Cannot parse application.yaml: %s \n%v", err.Error(), err)
-		return
+// openStores opens the embedded disk store if configured, otherwise Cassandra and Elastic
+func openStores(c Config) (item.Store, item.Store) {
+	if len(c.Disk.Path) > 0 {
+		store, err := item.NewDiskStore(c.Disk)
+		if err != nil {
+			log.Panicf("Cannot open disk store: %s \n%v", err.Error(), err)
+		}
+		log.Printf("Opened disk store in %s\n", c.Disk.Path)
+		return store, nil
 	}
 	var cqlCreate storeCreate = func() (item.Store, error) { return item.NewCqlStore(c.Cassandra) }
 	store, err := waitForStore(cqlCreate)
 	if err != nil {
 		log.Panicf("Cannot connect to cassandra: %s \n%v", err.Error(), err)
-		return
 	}
 	log.Println("Connected to Cassandra")
 	var esCreate storeCreate = func() (item.Store, error) { return item.NewElasticStore(c.Elastic) }
 	secondary, err := waitForStore(esCreate)
 	if err != nil {
 		log.Panicf("Cannot connect to elastic: %s \n%v", err.Error(), err)
-		return
 	}
 	log.Println("Connected to Elastic")
-	srv, err := startServer(c.Port, store, secondary)
+	return store, secondary
+}
+
+// reindexCommand rebuilds the search index from the primary store and prints the report
+// Writes done by a running server while the index is built are not copied, use the admin endpoint to reindex a live system
+func reindexCommand(c Config) int {
+	store, secondary := openStores(c)
+	defer store.Close()
+	ss, ok := store.(item.ScanStore)
+	r, ok2 := secondary.(item.Reindexer)
+	if !ok || !ok2 {
+		log.Println("The configured stores do not support reindexing")
+		return 1
+	}
+	defer secondary.Close()
+	if ms, ok := secondary.(item.MappingStore); ok {
+		modelItem, err := store.Read(item.ModelID)
+		if err == nil {
+			err = ms.UpdateMapping(item.FromItem(modelItem))
+		}
+		// the new index maps the conflicting attributes as the model says
+		if err != nil && !item.IsMappingConflict(err) {
+			log.Printf("Could not map the attributes of the model: %v", err)
+			return 1
+		}
+	}
+	resp, err := reindex(ss, r)
+	b, _ := json.MarshalIndent(resp, "", "  ")
+	fmt.Println(string(b))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// verifyCommand compares the primary and secondary stores and prints the report
+// It returns 0 if the stores are consistent or have been repaired, 2 if they differ, 1 on errors
+func verifyCommand(c Config, repair bool) int {
+	store, secondary := openStores(c)
+	defer store.Close()
+	ss, ok := store.(item.ScanStore)
+	h, ok2 := secondary.(item.SearchStore)
+	if !ok || !ok2 {
+		log.Println("The configured stores cannot be verified")
+		return 1
+	}
+	defer secondary.Close()
+	var repairStore item.Store
+	if repair {
+		repairStore = secondary
+	}
+	report, err := item.Verify(ss, h, repairStore)
+	if err != nil {
+		log.Printf("Verify failed: %v", err)
+		return 1
+	}
+	b, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(b))
+	if report.Consistent() || (repair && len(report.Failures) == 0) {
+		return 0
+	}
+	return 2
+}
+
+func main() {
+	app := os.Getenv("NSREP_CONFIG_FILE")
+	if len(app) == 0 {
+		app = "application.yaml"
+	}
+	log.Printf("Reading configuration from %s\n", app)
+	c, err := ReadFileConfig(app)
+	if err != nil {
+		log.Panicf("Cannot parse application.yaml: %s \n%v", err.Error(), err)
+		return
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reindex":
+			os.Exit(reindexCommand(c))
+		case "verify":
+			os.Exit(verifyCommand(c, len(os.Args) > 2 && os.Args[2] == "-repair"))
+		}
+	}
+	store, secondary := openStores(c)
+	srv, err := startServer(c.Port, store, secondary, c.Replication)
 	if err != nil {
 		log.Panicf("Could not start server: %s", err.Error())
 		if srv != nil {
@@ -349,4 +981,8 @@ func main() {
 		close(idleConnsClosed)
 	}()
 	<-idleConnsClosed
+	store.Close()
+	if secondary != nil {
+		secondary.Close()
+	}
 }
@@ -21,12 +21,19 @@ func TestCql(t *testing.T) {
 	store, err := item.NewCqlStore(config)
 	require.Nil(err)
 	require.NotNil(store)
-	srv, err := startServer(9999, store, nil)
+	srv, err := startServer(9999, store, nil, item.Replication{})
 	require.NoError(err)
 	defer stopServer(srv)
 
 	DoTestItem(t, []string{"Team", "team1"})
 	DoTestHistory(t, []string{"Team", "team1"})
+	DoTestHistoryVersions(t, []string{"Team", "team1"})
+	DoTestAsOf(t, []string{"Team", "team2"})
+	DoTestIfMatch(t, []string{"Team", "team3"})
+	DoTestRestore(t, []string{"Team", "team4"})
+	DoTestDiff(t, []string{"Team", "team5"})
+	DoTestAtomicBulk(t)
+	DoTestChildren(t)
 }
 
 func TestCqlEs(t *testing.T) {
@@ -37,15 +44,68 @@ func TestCqlEs(t *testing.T) {
 	es, err := item.NewElasticStore(elastic)
 	require.NoError(err)
 	require.NotNil(es)
-	srv, err := startServer(9999, store, es)
+	srv, err := startServer(9999, store, es, item.Replication{})
 	require.NoError(err)
 	defer stopServer(srv)
 
 	DoTestItem(t, []string{"Team", "team1"})
 	DoTestHistory(t, []string{"Team", "team1"})
+	DoTestHistoryVersions(t, []string{"Team", "team1"})
 	DoTestSearch(t)
+	DoTestStructuredSearch(t)
+	DoTestBulk(t)
+	DoTestReindex(t)
+	DoTestMappingConflict(t)
 	DoTestDeleteTree(t)
 	DoTestGraphQL(t)
+	DoTestGraphQLMutations(t)
+	DoTestGraphQLModelChanges(t)
+}
+
+func DoTestReindex(t *testing.T) {
+	require := require.New(t)
+
+	resp, err := http.Post("http://localhost:9999/admin/reindex", "application/json", nil)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var rr ReindexResponse
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rr))
+	require.Empty(rr.Error)
+	require.True(rr.Scanned > 0)
+	require.Equal(rr.Scanned, rr.Indexed)
+
+	resp, err = http.Get("http://localhost:9999/admin/reindex")
+	require.Nil(err)
+	require.Equal(405, resp.StatusCode)
+}
+
+// DoTestMappingConflict writes an attribute as a number then as a string in another type, the search index is rebuilt
+// so that both items can be found
+func DoTestMappingConflict(t *testing.T) {
+	require := require.New(t)
+	for _, it := range [][]string{
+		{"Organization/MC", `{"type":"Organization","name":"MC1","contents":{"conflicted":12}}`},
+		{"Organization/MC/Team/MC", `{"type":"Team","name":"MC2","contents":{"conflicted":"A12"}}`},
+	} {
+		url := "http://localhost:9999/items/" + it[0]
+		resp, err := http.Post(url, "application/json", strings.NewReader(it[1]))
+		require.Nil(err)
+		require.Equal(200, resp.StatusCode)
+		defer DoTestDelete(t, url)
+		time.Sleep(time.Second)
+	}
+	for _, name := range []string{"MC1", "MC2"} {
+		var rs item.SearchResult
+		for i := 0; i < 30 && len(rs.Scores) == 0; i++ {
+			time.Sleep(time.Second)
+			resp, err := http.Get("http://localhost:9999/search?query=item.name:" + name)
+			require.Nil(err)
+			require.Equal(200, resp.StatusCode)
+			rs = item.SearchResult{}
+			require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+		}
+		require.Equal(1, len(rs.Scores), name)
+	}
 }
 
 func DoTestHistory(t *testing.T, id item.ID) {
@@ -65,6 +125,23 @@ func DoTestHistory(t *testing.T, id item.ID) {
 	require.NotEmpty(its)
 }
 
+// DoTestHistoryVersions checks that the history of a deleted item starts with its deletion, with its version metadata
+func DoTestHistoryVersions(t *testing.T, id item.ID) {
+	require := require.New(t)
+
+	url := fmt.Sprintf("http://localhost:9999/history/%s?length=10", item.IDToString(id))
+	resp, err := http.Get(url)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var its = []item.Status{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&its))
+	require.NotEmpty(its)
+	require.Equal(id, its[0].Item.ID)
+	require.Equal("DELETED", its[0].Status)
+	require.NotEmpty(its[0].Version)
+	require.False(its[0].Updated.IsZero())
+}
+
 func DoTestSearch(t *testing.T) {
 	require := require.New(t)
 	id1 := "Organization/1"
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	item "github.com/JPMoresmau/nsrep/item"
 	"github.com/stretchr/testify/require"
@@ -40,6 +45,21 @@ func DoTestItem(t *testing.T, id item.ID) {
 	body, err = ioutil.ReadAll(resp.Body)
 	require.Nil(err)
 	require.Equal(data, string(body))
+	require.NotEmpty(resp.Header.Get("X-Item-Version"))
+	require.NotEmpty(resp.Header.Get("Last-Modified"))
+
+	resp, err = http.Get(url + "?metadata=true")
+	require.Nil(err)
+	require.NotNil(resp)
+	require.Equal(200, resp.StatusCode)
+	var st item.Status
+	require.Nil(json.NewDecoder(resp.Body).Decode(&st))
+	require.Equal("ALIVE", st.Status)
+	require.Equal(resp.Header.Get("X-Item-Version"), st.Version)
+	require.Equal(resp.Header.Get("X-Item-Updated"), st.Updated.UTC().Format(time.RFC3339Nano))
+	b, err := json.Marshal(st.Item)
+	require.Nil(err)
+	require.Equal(data, string(b))
 
 	DoTestDelete(t, url)
 
@@ -60,6 +80,565 @@ func DoTestItem(t *testing.T, id item.ID) {
 	require.Equal(`{"id":["Model"],"type":"Model","name":"Model","contents":{"typeAttributes":{},"typeChildren":{"":["Team"]}}}`, string(body))
 }
 
+func DoTestAsOf(t *testing.T, id item.ID) {
+	require := require.New(t)
+
+	s1 := `{"type":"Team","name":"Team1","contents":{"field1":"value1"}}`
+	s2 := `{"type":"Team","name":"Team1","contents":{"field1":"value2"}}`
+	data1 := fmt.Sprintf(`{"id":%s,"type":"Team","name":"Team1","contents":{"field1":"value1"}}`, "[\""+strings.Join(id, "\",\"")+"\"]")
+	url := fmt.Sprintf("http://localhost:9999/items/%s", item.IDToString(id))
+
+	t0 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	resp, err := http.Post(url, "application/json", strings.NewReader(s1))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	time.Sleep(10 * time.Millisecond)
+	t1 := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	resp, err = http.Post(url, "application/json", strings.NewReader(s2))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	DoTestDelete(t, url)
+
+	resp, err = http.Get(url + "?asOf=" + neturl.QueryEscape(t1.Format(time.RFC3339Nano)))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Equal(data1, string(body))
+
+	resp, err = http.Get(url + "?asOf=" + neturl.QueryEscape(t0.Format(time.RFC3339Nano)))
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+
+	resp, err = http.Get(url + "?asOf=" + neturl.QueryEscape(time.Now().Format(time.RFC3339Nano)))
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+
+	resp, err = http.Get(url + "?asOf=yesterday")
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+}
+
+func DoTestIfMatch(t *testing.T, id item.ID) {
+	require := require.New(t)
+
+	s1 := `{"type":"Team","name":"Team1","contents":{"field1":"value1"}}`
+	s2 := `{"type":"Team","name":"Team1","contents":{"field1":"value2"}}`
+	url := fmt.Sprintf("http://localhost:9999/items/%s", item.IDToString(id))
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(s1))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	resp, err = http.Get(url)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(etag)
+
+	doRequest := func(method string, body string, etag string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		require.Nil(err)
+		req.Header.Set("If-Match", etag)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(err)
+		return resp
+	}
+
+	resp = doRequest("POST", s2, etag)
+	require.Equal(200, resp.StatusCode)
+	// the first version is not current any more
+	resp = doRequest("POST", s1, etag)
+	require.Equal(412, resp.StatusCode)
+	resp = doRequest("DELETE", "", etag)
+	require.Equal(412, resp.StatusCode)
+	// a rejected write does not change the model
+	resp = doRequest("POST", `{"type":"Team","name":"Team1","contents":{"rejectedField":"value"}}`, etag)
+	require.Equal(412, resp.StatusCode)
+	resp, err = http.Get("http://localhost:9999/items/Model")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.NotContains(string(body), "rejectedField")
+
+	resp, err = http.Get(url)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Contains(string(body), "value2")
+	etag2 := resp.Header.Get("ETag")
+	require.NotEqual(etag, etag2)
+
+	resp = doRequest("DELETE", "", etag2)
+	require.Equal(204, resp.StatusCode)
+	resp = doRequest("POST", s1, "*")
+	require.Equal(412, resp.StatusCode)
+}
+
+func DoTestRestore(t *testing.T, id item.ID) {
+	require := require.New(t)
+
+	s1 := `{"type":"Team","name":"Team1","contents":{"field1":"value1"}}`
+	s2 := `{"type":"Team","name":"Team1","contents":{"field1":"value2"}}`
+	sc := `{"type":"Member","name":"Member1","contents":{"role":"lead"}}`
+	data1 := fmt.Sprintf(`{"id":%s,"type":"Team","name":"Team1","contents":{"field1":"value1"}}`, "[\""+strings.Join(id, "\",\"")+"\"]")
+	url := fmt.Sprintf("http://localhost:9999/items/%s", item.IDToString(id))
+	curl := url + "/Member/member1"
+	hurl := fmt.Sprintf("http://localhost:9999/history/%s/restore", item.IDToString(id))
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(s1))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	resp, err = http.Post(curl, "application/json", strings.NewReader(sc))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	resp, err = http.Get(url)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	version1 := resp.Header.Get("X-Item-Version")
+	require.NotEmpty(version1)
+
+	resp, err = http.Post(url, "application/json", strings.NewReader(s2))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	DoTestDelete(t, curl)
+
+	resp, err = http.Post(hurl, "application/json", nil)
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+	resp, err = http.Post(hurl+"?version=unknown", "application/json", nil)
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+	resp, err = http.Get(hurl + "?version=" + version1)
+	require.Nil(err)
+	require.Equal(405, resp.StatusCode)
+
+	resp, err = http.Post(hurl+"?version="+version1, "application/json", nil)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Equal("["+data1+"]", string(body))
+	resp, err = http.Get(url)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Equal(data1, string(body))
+	require.NotEqual(version1, resp.Header.Get("X-Item-Version"))
+	resp, err = http.Get(curl)
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+
+	// a child created after the restored version is deleted by a recursive restore
+	curl2 := url + "/Member/member2"
+	resp, err = http.Post(curl2, "application/json", strings.NewReader(`{"type":"Member","name":"Member2","contents":{"role":"dev"}}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	resp, err = http.Post(hurl+"?recursive=true&version="+version1, "application/json", nil)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var its []item.Item
+	require.Nil(json.NewDecoder(resp.Body).Decode(&its))
+	require.Equal(2, len(its))
+	require.Equal(append(id, "Member", "member1"), its[1].ID)
+	resp, err = http.Get(curl)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	resp, err = http.Get(curl2)
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+
+	DoTestDelete(t, url)
+}
+
+func DoTestDiff(t *testing.T, id item.ID) {
+	require := require.New(t)
+
+	s1 := `{"type":"Team","name":"Team1","contents":{"field1":"value1","details":{"a":"b"}}}`
+	s2 := `{"type":"Team","name":"Team1","contents":{"field1":"value2","details":{"a":"c"}}}`
+	url := fmt.Sprintf("http://localhost:9999/items/%s", item.IDToString(id))
+	hurl := fmt.Sprintf("http://localhost:9999/history/%s/diff", item.IDToString(id))
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(s1))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	resp, err = http.Get(url)
+	require.Nil(err)
+	version1 := resp.Header.Get("X-Item-Version")
+	resp, err = http.Post(url, "application/json", strings.NewReader(s2))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	resp, err = http.Get(url)
+	require.Nil(err)
+	version2 := resp.Header.Get("X-Item-Version")
+
+	resp, err = http.Get(hurl + "?from=" + version1 + "&to=" + version2)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	data := fmt.Sprintf(`{"id":%s,"from":"%s","to":"%s","added":[],"removed":[],"changed":[{"path":["contents","details","a"],"old":"b","new":"c"},{"path":["contents","field1"],"old":"value1","new":"value2"}]}`,
+		"[\""+strings.Join(id, "\",\"")+"\"]", version1, version2)
+	require.Equal(data, string(body))
+
+	resp, err = http.Get(hurl + "?from=" + version1)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body2, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Equal(string(body), string(body2))
+
+	resp, err = http.Get(hurl)
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+	resp, err = http.Get(hurl + "?from=unknown")
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+
+	DoTestDelete(t, url)
+}
+
+func DoTestBulk(t *testing.T) {
+	require := require.New(t)
+
+	data := `[{"id":["Team","bulk1"],"type":"Team","name":"Bulk1","contents":{"field1":"value1"}},
+	{"id":["Team","bulk2"],"type":"Team","name":"Bulk2","contents":{"field1":2}},
+	{"id":["Team"],"type":"Team","name":"Bulk3","contents":{}},
+	{"id":["Team","bulk1","Member","member1"],"type":"Member","name":"Member1","contents":{"role":"lead"}}]`
+	resp, err := http.Post("http://localhost:9999/items/_bulk", "application/json", strings.NewReader(data))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var br BulkResponse
+	require.Nil(json.NewDecoder(resp.Body).Decode(&br))
+	require.True(br.Errors)
+	require.Equal(4, len(br.Items))
+	require.Equal(BulkResult{ID: []string{"Team", "bulk1"}, Status: 200}, br.Items[0])
+	require.Equal(400, br.Items[1].Status)
+	require.NotEmpty(br.Items[1].Error)
+	require.Equal(400, br.Items[2].Status)
+	require.Equal(BulkResult{ID: []string{"Team", "bulk1", "Member", "member1"}, Status: 200}, br.Items[3])
+
+	resp, err = http.Get("http://localhost:9999/items/Team/bulk1/Member/member1")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	resp, err = http.Get("http://localhost:9999/items/Team/bulk2")
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+
+	data = `{"id":["Team","bulk2"],"type":"Team","name":"Bulk2","contents":{"field1":"value2"}}
+{"id":["Team","bulk3"],"type":"Team","name":"Bulk3","contents":{}}
+`
+	resp, err = http.Post("http://localhost:9999/items/_bulk", "application/x-ndjson", strings.NewReader(data))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	br = BulkResponse{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&br))
+	require.False(br.Errors)
+	require.Equal(2, len(br.Items))
+
+	// the search store may be updated asynchronously
+	require.Eventually(func() bool {
+		resp, err := http.Get("http://localhost:9999/search?query=item.name:Bulk*")
+		require.Nil(err)
+		require.Equal(200, resp.StatusCode)
+		var rs item.SearchResult
+		require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+		return len(rs.Scores) == 3
+	}, 5*time.Second, 100*time.Millisecond)
+
+	resp, err = http.Post("http://localhost:9999/items/_bulk", "application/json", strings.NewReader("[{"))
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+	resp, err = http.Get("http://localhost:9999/items/_bulk")
+	require.Nil(err)
+	require.Equal(405, resp.StatusCode)
+
+	for _, id := range []string{"bulk1", "bulk2", "bulk3"} {
+		DoTestDelete(t, "http://localhost:9999/items/Team/"+id)
+	}
+}
+
+func DoTestStructuredSearch(t *testing.T) {
+	require := require.New(t)
+
+	data := `[{"id":["Project","p1"],"type":"Project","name":"Apollo","contents":{"state":"active","priority":1}},
+	{"id":["Project","p2"],"type":"Project","name":"Gemini","contents":{"state":"active","priority":3}},
+	{"id":["Project","p3"],"type":"Project","name":"Mercury","contents":{"state":"done","priority":2}}]`
+	resp, err := http.Post("http://localhost:9999/items/_bulk", "application/json", strings.NewReader(data))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	query := `{"query":{"bool":{
+		"must":[{"term":{"field":"type","value":"Project"}},{"term":{"field":"state","value":"active"}}],
+		"mustNot":[{"range":{"field":"priority","gte":3}}]}}}`
+	// the search store may be updated asynchronously
+	require.Eventually(func() bool {
+		resp, err := http.Post("http://localhost:9999/search", "application/json", strings.NewReader(query))
+		require.Nil(err)
+		require.Equal(200, resp.StatusCode)
+		var rs item.SearchResult
+		require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+		return len(rs.Scores) == 1 && rs.Scores[0].Item.Name == "Apollo"
+	}, 5*time.Second, 100*time.Millisecond)
+
+	resp, err = http.Post("http://localhost:9999/search", "application/json",
+		strings.NewReader(`{"query":{"prefix":{"field":"name","value":"Ge"}},"length":5}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var rs item.SearchResult
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal(1, len(rs.Scores))
+	require.Equal("Gemini", rs.Scores[0].Item.Name)
+
+	resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&sort=-priority")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal(3, len(rs.Scores))
+	for i, name := range []string{"Gemini", "Mercury", "Apollo"} {
+		require.Equal(name, rs.Scores[i].Item.Name)
+	}
+
+	resp, err = http.Post("http://localhost:9999/search", "application/json",
+		strings.NewReader(`{"query":{"term":{"field":"state","value":"active"}},"sort":"-name"}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal(2, len(rs.Scores))
+	require.Equal("Gemini", rs.Scores[0].Item.Name)
+	require.Equal("Apollo", rs.Scores[1].Item.Name)
+
+	testGraphQL(require, `{Project(sort:"-priority"){priority}}`,
+		`{"data":{"Project":[{"priority":3},{"priority":2},{"priority":1}]}}`)
+
+	resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&sort=name&length=2")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal(2, len(rs.Scores))
+	require.NotEmpty(rs.Next)
+	resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&sort=name&length=2&after=" + rs.Next)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal(1, len(rs.Scores))
+	require.Equal("Mercury", rs.Scores[0].Item.Name)
+	require.Empty(rs.Next)
+	resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&after=invalid!")
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+
+	resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&length=1&facetSize.item.name=1")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal(1, len(rs.Scores))
+	require.Equal(int64(3), rs.Total)
+	require.Equal(1, len(rs.Facets["item.name"]))
+	require.Equal(item.FacetInfo{Truncated: true, Other: 2}, rs.FacetInfo["item.name"])
+	require.Equal(map[string]uint64{"Project": 3}, rs.Facets["item.type"])
+	resp, err = http.Post("http://localhost:9999/search", "application/json",
+		strings.NewReader(`{"query":{"exists":{"field":"state"}},"facetSizes":{"item.type":1,"item.unknown":2}}`))
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+
+	resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&facet=state&facet=priority:range:*-2,2-*")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal([]item.Bucket{{Key: "active", Count: 2}, {Key: "done", Count: 1}}, rs.AttributeFacets["state"])
+	two := 2.0
+	require.Equal([]item.Bucket{{Key: "*-2", To: &two, Count: 1}, {Key: "2-*", From: &two, Count: 2}}, rs.AttributeFacets["priority"])
+	resp, err = http.Post("http://localhost:9999/search", "application/json",
+		strings.NewReader(`{"query":{"exists":{"field":"state"}},"attributeFacets":[{"attribute":"priority","interval":2}]}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	four := 4.0
+	require.Equal([]item.Bucket{{Key: "0", From: new(float64), To: &two, Count: 1}, {Key: "2", From: &two, To: &four, Count: 2}},
+		rs.AttributeFacets["priority"])
+	resp, err = http.Get("http://localhost:9999/search?query=Apollo&highlight=true")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	rs = item.SearchResult{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&rs))
+	require.Equal(1, len(rs.Scores))
+	for _, f := range []string{"unknown", "state:histogram:2", "priority:terms:2", "priority:histogram:1&facet=priority:range:0-5"} {
+		resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&facet=" + f)
+		require.Nil(err)
+		require.Equal(400, resp.StatusCode, f)
+	}
+
+	var page struct {
+		Data struct {
+			ProjectConnection struct {
+				Edges []struct {
+					Cursor string
+					Node   map[string]interface{}
+				}
+				PageInfo struct {
+					HasNextPage bool
+					EndCursor   string
+				}
+			}
+		}
+	}
+	resp, err = http.Post("http://localhost:9999/graphql", "application/json",
+		strings.NewReader(`{ProjectConnection(sort:"-priority", first:2){edges{cursor node{priority}} pageInfo{hasNextPage endCursor}}}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	require.Nil(json.NewDecoder(resp.Body).Decode(&page))
+	require.Equal(2, len(page.Data.ProjectConnection.Edges))
+	require.Equal(3.0, page.Data.ProjectConnection.Edges[0].Node["priority"])
+	require.True(page.Data.ProjectConnection.PageInfo.HasNextPage)
+	require.Equal(page.Data.ProjectConnection.Edges[1].Cursor, page.Data.ProjectConnection.PageInfo.EndCursor)
+	resp, err = http.Post("http://localhost:9999/graphql", "application/json",
+		strings.NewReader(fmt.Sprintf(`{ProjectConnection(sort:"-priority", first:2, after:"%s"){edges{node{priority}} pageInfo{hasNextPage}}}`,
+			page.Data.ProjectConnection.PageInfo.EndCursor)))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	page.Data.ProjectConnection.Edges = nil
+	require.Nil(json.NewDecoder(resp.Body).Decode(&page))
+	require.Equal(1, len(page.Data.ProjectConnection.Edges))
+	require.Equal(1.0, page.Data.ProjectConnection.Edges[0].Node["priority"])
+	require.False(page.Data.ProjectConnection.PageInfo.HasNextPage)
+
+	resp, err = http.Get("http://localhost:9999/search?query=item.type:Project&sort=unknown")
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+
+	for _, invalid := range []string{
+		`{"query":{"range":{"field":"priority"}}}`,
+		`{"query":{"term":{"field":"state","value":"active"},"exists":{"field":"state"}}}`,
+		`{"query":{"match":{"field":"state"}}}`,
+		`{"from":2}`,
+		`{"query":`,
+	} {
+		resp, err = http.Post("http://localhost:9999/search", "application/json", strings.NewReader(invalid))
+		require.Nil(err)
+		require.Equal(400, resp.StatusCode, invalid)
+	}
+
+	resp, err = http.Get("http://localhost:9999/suggest?prefix=me&type=Project&ns=Project")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var suggestions []item.Suggestion
+	require.Nil(json.NewDecoder(resp.Body).Decode(&suggestions))
+	require.Equal([]item.Suggestion{{ID: []string{"Project", "p3"}, Name: "Mercury", Type: "Project"}}, suggestions)
+	resp, err = http.Get("http://localhost:9999/suggest?type=Project")
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+
+	for _, id := range []string{"p1", "p2", "p3"} {
+		DoTestDelete(t, "http://localhost:9999/items/Project/"+id)
+	}
+}
+
+func DoTestAtomicBulk(t *testing.T) {
+	require := require.New(t)
+
+	data := `[{"id":["Team","atomic1"],"type":"Team","name":"Atomic1","contents":{"field1":"value1"}},
+	{"id":["Team","atomic1","Member","member1"],"type":"Member","name":"Member1","contents":{"rank":"first"}},
+	{"id":["Team","atomic1","Member","member2"],"type":"Member","name":"Member2","contents":{"rank":2}}]`
+	resp, err := http.Post("http://localhost:9999/items/_bulk?atomic=true", "application/json", strings.NewReader(data))
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+	var br BulkResponse
+	require.Nil(json.NewDecoder(resp.Body).Decode(&br))
+	require.True(br.Errors)
+	require.Equal(424, br.Items[0].Status)
+	require.Equal(424, br.Items[1].Status)
+	require.Equal(400, br.Items[2].Status)
+	resp, err = http.Get("http://localhost:9999/items/Team/atomic1")
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+
+	data = `[{"id":["Team","atomic1"],"type":"Team","name":"Atomic1","contents":{"field1":"value1"}},
+	{"id":["Team","atomic1","Member","member1"],"type":"Member","name":"Member1","contents":{"role":"lead"}}]`
+	resp, err = http.Post("http://localhost:9999/items/_bulk?atomic=true", "application/json", strings.NewReader(data))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	br = BulkResponse{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&br))
+	require.False(br.Errors)
+	require.Equal([]BulkResult{{ID: []string{"Team", "atomic1"}, Status: 200}, {ID: []string{"Team", "atomic1", "Member", "member1"}, Status: 200}}, br.Items)
+	resp, err = http.Get("http://localhost:9999/items/Team/atomic1/Member/member1")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	DoTestDelete(t, "http://localhost:9999/items/Team/atomic1")
+}
+
+func DoTestChildren(t *testing.T) {
+	require := require.New(t)
+
+	data := `[{"id":["Team","parent1"],"type":"Team","name":"Parent1","contents":{"field1":"value1"}},
+	{"id":["Team","parent1","Member","member1"],"type":"Member","name":"Member1","contents":{"role":"lead"}},
+	{"id":["Team","parent1","Member","member2"],"type":"Member","name":"Member2","contents":{"role":"dev"}},
+	{"id":["Team","parent1","Member","member1","Member","member3"],"type":"Member","name":"Member3","contents":{"role":"dev"}}]`
+	resp, err := http.Post("http://localhost:9999/items/_bulk", "application/json", strings.NewReader(data))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	var names []string
+	url := "http://localhost:9999/items/Team/parent1/children?limit=1"
+	next := ""
+	for {
+		resp, err = http.Get(url + "&cursor=" + next)
+		require.Nil(err)
+		require.Equal(200, resp.StatusCode)
+		var lr ListResponse
+		require.Nil(json.NewDecoder(resp.Body).Decode(&lr))
+		for _, it := range lr.Items {
+			names = append(names, it.Name)
+		}
+		if len(lr.Next) == 0 {
+			break
+		}
+		require.True(len(names) < 3)
+		next = lr.Next
+	}
+	require.Equal([]string{"Member1", "Member2"}, names)
+
+	resp, err = http.Get("http://localhost:9999/items/Team/parent1/descendants")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var lr ListResponse
+	require.Nil(json.NewDecoder(resp.Body).Decode(&lr))
+	require.Equal(3, len(lr.Items))
+	require.Equal("Member3", lr.Items[1].Name)
+	require.Empty(lr.Next)
+
+	resp, err = http.Get("http://localhost:9999/items/children")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	lr = ListResponse{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&lr))
+	require.Contains(lr.Items, item.Item{ID: []string{"Team", "parent1"}, Type: "Team", Name: "Parent1", Contents: map[string]interface{}{"field1": "value1"}})
+
+	resp, err = http.Get("http://localhost:9999/items/Team/parent1/children?cursor=invalid!")
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+
+	resp, err = http.Get("http://localhost:9999/items/descendants")
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+
+	DoTestDelete(t, "http://localhost:9999/items/Team/parent1")
+}
+
 func DoTestDelete(t *testing.T, url string) {
 	require := require.New(t)
 	req, err := http.NewRequest("DELETE", url, nil)
@@ -82,7 +661,7 @@ func DoTestDelete(t *testing.T, url string) {
 func TestItemInvalidID(t *testing.T) {
 	require := require.New(t)
 	store := item.NewLocalStore()
-	srv, err := startServer(9999, store, nil)
+	srv, err := startServer(9999, store, nil, item.Replication{})
 	require.NoError(err)
 	defer stopServer(srv)
 	id := "123"
@@ -104,9 +683,372 @@ func TestItemInvalidID(t *testing.T) {
 
 func TestItemsSlashID(t *testing.T) {
 	store := item.NewLocalStore()
-	srv, err := startServer(9999, store, nil)
+	srv, err := startServer(9999, store, nil, item.Replication{})
 	require.NoError(t, err)
 	defer stopServer(srv)
 	DoTestItem(t, []string{"Team", "Team1"})
 
 }
+
+// failingAtomicStore rejects all the atomic writes
+type failingAtomicStore struct {
+	*item.LocalStore
+}
+
+func (s failingAtomicStore) WriteAll(items []item.Item) error {
+	return fmt.Errorf("write failed")
+}
+
+func TestAtomicBulkFailure(t *testing.T) {
+	require := require.New(t)
+	store := failingAtomicStore{item.NewLocalStore()}
+	srv, err := startServer(9999, store, nil, item.Replication{})
+	require.NoError(err)
+	defer stopServer(srv)
+
+	resp, err := http.Get("http://localhost:9999/items/Model")
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+	data := `[{"id":["Team","atomic1"],"type":"Team","name":"Atomic1","contents":{"field1":"value1"}}]`
+	resp, err = http.Post("http://localhost:9999/items/_bulk?atomic=true", "application/json", strings.NewReader(data))
+	require.Nil(err)
+	require.Equal(500, resp.StatusCode)
+	// the model is not saved with the types of items that were not written
+	resp, err = http.Get("http://localhost:9999/items/Model")
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+}
+
+func TestRestoreFailure(t *testing.T) {
+	require := require.New(t)
+	store := item.NewLocalStore()
+	service := &ItemService{store: store, models: item.NewModelRegistry(item.EmptyModel())}
+	parent := item.Item{ID: []string{"Team", "r1"}, Type: "Team", Name: "Team1", Contents: map[string]interface{}{"field1": "value1"}}
+	child := item.Item{ID: []string{"Team", "r1", "Member", "m1"}, Type: "Member", Name: "Member1",
+		Contents: map[string]interface{}{"size": 3.0}}
+	require.NoError(service.Write(parent, ""))
+	require.NoError(service.Write(child, ""))
+	st1, err := item.ReadStatus(store, parent.ID)
+	require.NoError(err)
+	parent2 := item.Item{ID: parent.ID, Type: "Team", Name: "Team1", Contents: map[string]interface{}{"field1": "value2"}}
+	require.NoError(service.Write(parent2, ""))
+	require.NoError(service.Delete(child.ID, ""))
+	child2 := item.Item{ID: []string{"Team", "r1", "Member", "m2"}, Type: "Member", Name: "Member2",
+		Contents: map[string]interface{}{"size": "big"}}
+	// the size of the members is now a string, the deleted child cannot be restored
+	model := item.EmptyModel()
+	_, err = item.AddItem(parent, model)
+	require.NoError(err)
+	_, err = item.AddItem(child2, model)
+	require.NoError(err)
+	require.NoError(service.Write(item.ToItem(model), ""))
+	require.NoError(service.Write(child2, ""))
+
+	_, err = service.Restore(parent.ID, st1.Version, true)
+	require.Error(err)
+	it, err := store.Read(parent.ID)
+	require.NoError(err)
+	require.Equal(parent2, it)
+	it, err = store.Read(child.ID)
+	require.NoError(err)
+	require.True(it.IsEmpty())
+	it, err = store.Read(child2.ID)
+	require.NoError(err)
+	require.Equal(child2, it)
+
+	// without atomic changes, the children are not restored
+	service.store = unconditionalStore{store, store}
+	_, err = service.Restore(parent.ID, st1.Version, true)
+	require.Error(err)
+}
+
+// conflictingStore refuses every mapping and counts the reindexes, that wait until released
+type conflictingStore struct {
+	*item.LocalStore
+	reindexes chan struct{}
+	release   chan struct{}
+}
+
+func (s conflictingStore) UpdateMapping(model *item.Model) error {
+	return item.NewMappingConflictError("test", []string{"size"})
+}
+
+func (s conflictingStore) Reindex(source item.ScanStore) (item.ReindexReport, error) {
+	s.reindexes <- struct{}{}
+	<-s.release
+	return item.ReindexReport{}, nil
+}
+
+func TestReindexOnConflict(t *testing.T) {
+	require := require.New(t)
+	secondary := conflictingStore{item.NewLocalStore(), make(chan struct{}, 10), make(chan struct{})}
+	service := &ItemService{store: item.NewLocalStore(), secondary: secondary, models: item.NewModelRegistry(item.EmptyModel())}
+	service.models.OnChange(service.updateMapping)
+	// two model changes in a row during a conflict only start one reindex
+	it1 := item.Item{ID: []string{"Shop", "c1"}, Type: "Shop", Name: "Shop1", Contents: map[string]interface{}{"size": 3.0}}
+	it2 := item.Item{ID: []string{"Order", "c2"}, Type: "Order", Name: "Order2", Contents: map[string]interface{}{"size": 3.0}}
+	require.NoError(service.Write(it1, ""))
+	require.NoError(service.Write(it2, ""))
+	<-secondary.reindexes
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(secondary.reindexes)
+	// a conflict once the reindex is done starts another one
+	close(secondary.release)
+	for i := 0; i < 50 && atomic.LoadInt32(&service.reindexing) == 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	service.updateMapping(service.models.Model())
+	<-secondary.reindexes
+}
+
+// unconditionalStore is a searchable store without conditional writes
+type unconditionalStore struct {
+	item.Store
+	item.SearchStore
+}
+
+func TestUnconditionalStore(t *testing.T) {
+	require := require.New(t)
+	local := item.NewLocalStore()
+	store := unconditionalStore{local, local}
+	srv, err := startServer(9999, store, nil, item.Replication{})
+	require.NoError(err)
+	defer stopServer(srv)
+
+	url1 := "http://localhost:9999/items/Shop/u1"
+	resp, err := http.Get(url1)
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+	resp, err = http.Post(url1, "application/json", strings.NewReader(`{"type":"Shop","name":"Shop1","contents":{"size":3}}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	defer DoTestDelete(t, url1)
+	// mutations have no version argument, and write without one
+	testGraphQL(require, `mutation {updateShop(id:"u1", contents:{size:5}){size}}`, `{"data":{"updateShop":{"size":5}}}`)
+	resp, err = http.Post("http://localhost:9999/graphql", "application/json",
+		strings.NewReader(`mutation {updateShop(id:"u1", version:"v1", contents:{size:6}){size}}`))
+	require.Nil(err)
+	var result struct {
+		Errors []interface{}
+	}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&result))
+	require.NotEmpty(result.Errors)
+	// creates cannot check that the item does not exist
+	resp, err = http.Post("http://localhost:9999/graphql", "application/json",
+		strings.NewReader(`mutation {createShop(id:"u2", name:"Shop2", contents:{size:1}){size}}`))
+	require.Nil(err)
+	result.Errors = nil
+	require.Nil(json.NewDecoder(resp.Body).Decode(&result))
+	require.NotEmpty(result.Errors)
+	resp, err = http.Get("http://localhost:9999/items/Shop/u2")
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+	// versions given to the store are not implemented
+	req, err := http.NewRequest("DELETE", url1, nil)
+	require.Nil(err)
+	req.Header.Set("If-Match", `"v1"`)
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(err)
+	require.Equal(501, resp.StatusCode)
+
+	service := &ItemService{store: store, models: item.NewModelRegistry(item.EmptyModel())}
+	require.False(service.Conditional())
+	it := item.Item{ID: []string{"Shop", "u3"}, Type: "Shop", Name: "Shop3", Contents: map[string]interface{}{}}
+	require.True(item.IsConditionalWriteUnsupported(service.Write(it, item.AnyVersion)))
+	require.True(item.IsConditionalWriteUnsupported(service.Delete(it.ID, item.AnyVersion)))
+}
+
+func TestLocal(t *testing.T) {
+	store := item.NewLocalStore()
+	srv, err := startServer(9999, store, nil, item.Replication{})
+	require.NoError(t, err)
+	defer stopServer(srv)
+
+	DoTestItem(t, []string{"Team", "team1"})
+	DoTestHistory(t, []string{"Team", "team1"})
+	DoTestHistoryVersions(t, []string{"Team", "team1"})
+	DoTestAsOf(t, []string{"Team", "team2"})
+	DoTestIfMatch(t, []string{"Team", "team3"})
+	DoTestRestore(t, []string{"Team", "team4"})
+	DoTestDiff(t, []string{"Team", "team5"})
+	DoTestBulk(t)
+	DoTestAtomicBulk(t)
+	DoTestChildren(t)
+	DoTestSearch(t)
+	DoTestStructuredSearch(t)
+	DoTestDeleteTree(t)
+	DoTestGraphQL(t)
+	DoTestGraphQLMutations(t)
+	DoTestGraphQLModelChanges(t)
+}
+
+func TestLocalReplication(t *testing.T) {
+	require := require.New(t)
+	store := item.NewLocalStore()
+	secondary := item.NewLocalStore()
+	srv, err := startServer(9999, store, secondary, item.Replication{})
+	require.NoError(err)
+	defer stopServer(srv)
+
+	id := []string{"Team", "team1"}
+	url := fmt.Sprintf("http://localhost:9999/items/%s", item.IDToString(id))
+	resp, err := http.Post(url, "application/json", strings.NewReader(`{"type":"Team","name":"Team1","contents":{}}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	require.Eventually(func() bool {
+		it, _ := secondary.Read(id)
+		return !it.IsEmpty()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	DoTestDelete(t, url)
+	require.Eventually(func() bool {
+		it, _ := secondary.Read(id)
+		return it.IsEmpty()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	resp, err = http.Get("http://localhost:9999/metrics/replication")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var m item.ReplicationMetrics
+	require.Nil(json.NewDecoder(resp.Body).Decode(&m))
+	require.Equal(0, m.Pending)
+	require.True(m.Replicated >= 2)
+}
+
+func TestLocalVerify(t *testing.T) {
+	require := require.New(t)
+	store := item.NewLocalStore()
+	secondary := item.NewLocalStore()
+	srv, err := startServer(9999, store, secondary, item.Replication{})
+	require.NoError(err)
+	defer stopServer(srv)
+
+	orphaned := item.Item{ID: []string{"Team", "team2"}, Type: "Team", Name: "Team2", Contents: map[string]interface{}{}}
+	require.NoError(secondary.Write(orphaned))
+
+	resp, err := http.Get("http://localhost:9999/admin/verify")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	var report item.VerifyReport
+	require.Nil(json.NewDecoder(resp.Body).Decode(&report))
+	require.Equal([]item.ID{orphaned.ID}, report.Orphaned)
+
+	resp, err = http.Post("http://localhost:9999/admin/verify", "application/json", nil)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	report = item.VerifyReport{}
+	require.Nil(json.NewDecoder(resp.Body).Decode(&report))
+	require.Equal(1, report.Repaired)
+	require.Eventually(func() bool {
+		report, err := item.Verify(store, secondary, nil)
+		return err == nil && report.Consistent()
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDiskItems(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "nsrep")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	store, err := item.NewDiskStore(item.Disk{Path: dir})
+	require.NoError(err)
+	defer store.Close()
+	srv, err := startServer(9999, store, nil, item.Replication{})
+	require.NoError(err)
+	defer stopServer(srv)
+	DoTestItem(t, []string{"Team", "Team1"})
+}
+
+func DoTestGraphQLMutations(t *testing.T) {
+	require := require.New(t)
+
+	url1 := "http://localhost:9999/items/Shop/s1"
+	resp, err := http.Post(url1, "application/json",
+		strings.NewReader(`{"type":"Shop","name":"Shop1","contents":{"city":"Paris","size":3}}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	defer DoTestDelete(t, url1)
+
+	testGraphQL(require, `mutation {createShop(id:"s2", name:"Shop2", contents:{city:"Lyon", size:2}){city size}}`,
+		`{"data":{"createShop":{"city":"Lyon","size":2}}}`)
+	url2 := "http://localhost:9999/items/Shop/s2"
+	resp, err = http.Get(url2)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Equal(`{"id":["Shop","s2"],"type":"Shop","name":"Shop2","contents":{"city":"Lyon","size":2}}`, string(body))
+
+	graphQLError := func(graphql string) {
+		resp, err := http.Post("http://localhost:9999/graphql", "application/json", strings.NewReader(graphql))
+		require.Nil(err)
+		require.Equal(200, resp.StatusCode)
+		var result struct {
+			Errors []interface{}
+		}
+		require.Nil(json.NewDecoder(resp.Body).Decode(&result))
+		require.NotEmpty(result.Errors, graphql)
+	}
+	graphQLError(`mutation {createShop(id:"s2", name:"Shop2"){city}}`)
+	graphQLError(`mutation {createShop(id:"s3", name:"Shop3", contents:{size:"big"}){city}}`)
+	graphQLError(`mutation {updateShop(id:"s3", name:"Shop3"){city}}`)
+	graphQLError(`mutation {updateShop(id:"s2", name:"Shop2", version:"unknown"){city}}`)
+
+	testGraphQL(require, `mutation {updateShop(id:"s2", contents:{size:5}){city size}}`,
+		`{"data":{"updateShop":{"city":"Lyon","size":5}}}`)
+	resp, err = http.Get(url2)
+	require.Nil(err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+	require.Equal(`{"id":["Shop","s2"],"type":"Shop","name":"Shop2","contents":{"city":"Lyon","size":5}}`, string(body))
+
+	testGraphQL(require, `mutation {deleteShop(id:"s2")}`, `{"data":{"deleteShop":true}}`)
+	resp, err = http.Get(url2)
+	require.Nil(err)
+	require.Equal(404, resp.StatusCode)
+}
+
+func DoTestGraphQLModelChanges(t *testing.T) {
+	require := require.New(t)
+
+	modelURL := "http://localhost:9999/items/Model"
+	resp, err := http.Get(modelURL)
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	model, err := ioutil.ReadAll(resp.Body)
+	require.Nil(err)
+
+	testGraphQL(require, `{__type(name:"Gizmo"){name}}`, `{"data":{"__type":null}}`)
+
+	url1 := "http://localhost:9999/items/Gizmo/g1"
+	resp, err = http.Post(url1, "application/json", strings.NewReader(`{"type":"Gizmo","name":"Gizmo1","contents":{"color":"red"}}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	defer DoTestDelete(t, url1)
+
+	// the new type is in the schema as soon as the first item is written
+	testGraphQL(require, `{__type(name:"Gizmo"){name}}`, `{"data":{"__type":{"name":"Gizmo"}}}`)
+	testGraphQL(require, `mutation {createGizmo(id:"g2", name:"Gizmo2", contents:{color:"blue"}){color}}`,
+		`{"data":{"createGizmo":{"color":"blue"}}}`)
+	defer DoTestDelete(t, "http://localhost:9999/items/Gizmo/g2")
+
+	// a new attribute too
+	resp, err = http.Post(url1, "application/json", strings.NewReader(`{"type":"Gizmo","name":"Gizmo1","contents":{"color":"red","weight":2.5}}`))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	testGraphQL(require, `mutation {updateGizmo(id:"g2", contents:{weight:1.5}){color weight}}`,
+		`{"data":{"updateGizmo":{"color":"blue","weight":1.5}}}`)
+
+	resp, err = http.Get("http://localhost:9999/search?query=*&facet=color")
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+
+	// writing the model item replaces the model everywhere
+	resp, err = http.Post(modelURL, "application/json", strings.NewReader(string(model)))
+	require.Nil(err)
+	require.Equal(200, resp.StatusCode)
+	testGraphQL(require, `{__type(name:"Gizmo"){name}}`, `{"data":{"__type":null}}`)
+	resp, err = http.Get("http://localhost:9999/search?query=*&facet=color")
+	require.Nil(err)
+	require.Equal(400, resp.StatusCode)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	item "github.com/JPMoresmau/nsrep/item"
+	"github.com/go-errors/errors"
+)
+
+// ItemService applies item changes to the primary store, keeping the model up to date
+// and queuing the changes for replication to the secondary store
+type ItemService struct {
+	store      item.Store
+	secondary  item.Store
+	models     *item.ModelRegistry
+	replicator *item.Replicator
+	// reindexing is 1 while the secondary store is rebuilt after a mapping conflict
+	reindexing int32
+}
+
+// replicate queues changed items for replication to the secondary store, if there is one
+func (is *ItemService) replicate(ids ...item.ID) error {
+	if is.replicator == nil {
+		return nil
+	}
+	return is.replicator.Changed(ids...)
+}
+
+// repair queues items for replication even if they did not change, so that the secondary store gets them again
+func (is *ItemService) repair(id item.ID) error {
+	if is.replicator == nil {
+		return nil
+	}
+	return is.replicator.Enqueue(id)
+}
+
+// updateMapping sends the model to the stores that map attributes, so that they are mapped before items using them
+// are replicated
+// It is called on every change of the model
+// Failures are only logged: the item is written and replication retries until the secondary store accepts it
+// When the secondary store maps attributes with types that do not fit the model anymore, it is rebuilt in the
+// background from the primary store, so that the items it refused can be replicated again
+func (is *ItemService) updateMapping(model *item.Model) {
+	for _, s := range []item.Store{is.store, is.secondary} {
+		if ms, ok := s.(item.MappingStore); ok {
+			err := ms.UpdateMapping(model)
+			if err == nil {
+				continue
+			}
+			log.Printf("Could not update the mapping: %v", err)
+			if item.IsMappingConflict(err) && s == is.secondary {
+				is.reindexSecondary()
+			}
+		}
+	}
+}
+
+// reindexSecondary rebuilds the index of the secondary store from the primary store in the background
+// Only one rebuild runs at a time, conflicts found while it runs do not start another one
+func (is *ItemService) reindexSecondary() {
+	ss, ok := is.store.(item.ScanStore)
+	r, ok2 := is.secondary.(item.Reindexer)
+	if !ok || !ok2 {
+		log.Println("The configured stores do not support reindexing, reindex to map the attributes as the model says")
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&is.reindexing, 0, 1) {
+		log.Println("The secondary store is already being reindexed")
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&is.reindexing, 0)
+		reindex(ss, r)
+	}()
+}
+
+// replicationQueue is a write only store that queues the changes for replication instead of applying them
+type replicationQueue struct {
+	service *ItemService
+	// repair queues the items even if they did not change in the primary store
+	repair bool
+}
+
+func (q replicationQueue) Read(id item.ID) (item.Item, error) {
+	return item.Item{}, nil
+}
+
+func (q replicationQueue) Write(it item.Item) error {
+	return q.queue(it.ID)
+}
+
+func (q replicationQueue) Delete(id item.ID) error {
+	return q.queue(id)
+}
+
+func (q replicationQueue) queue(id item.ID) error {
+	if q.repair {
+		return q.service.repair(id)
+	}
+	return q.service.replicate(id)
+}
+
+func (q replicationQueue) Close() error {
+	return nil
+}
+
+// Conditional tells if the primary store can write and delete items only at a given version
+func (is *ItemService) Conditional() bool {
+	_, ok := is.store.(item.ConditionalStore)
+	return ok
+}
+
+// Read reads the current version of an item from the primary store
+func (is *ItemService) Read(id item.ID) (item.Item, error) {
+	return is.store.Read(id)
+}
+
+// Write validates an item against the model and writes it, only if it is at the given version if one is provided
+// The model only gets the new types and attributes of the item once the item is written, so that a rejected
+// write leaves it untouched
+func (is *ItemService) Write(it item.Item, version string) error {
+	if item.IsModelID(it.ID) {
+		// the model item is written as a model update, so that items added to the model at the same time do not
+		// save the previous model over it
+		err := is.models.Update(func(current *item.Model) (*item.Model, error) {
+			return item.FromItem(it), nil
+		}, func(model *item.Model) error {
+			return is.writeItem(it, version)
+		})
+		if err != nil {
+			return err
+		}
+		return is.replicate(it.ID)
+	}
+	_, err := item.CheckItem(it, is.models.Model())
+	if err != nil {
+		return err
+	}
+	if err = is.writeItem(it, version); err != nil {
+		return err
+	}
+	err = is.addToModel(it)
+	if rerr := is.replicate(it.ID); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// writeItem writes an item to the primary store, only if it is at the given version if one is provided
+func (is *ItemService) writeItem(it item.Item, version string) error {
+	if len(version) == 0 {
+		return is.store.Write(it)
+	}
+	cs, ok := is.store.(item.ConditionalStore)
+	if !ok {
+		return item.NewConditionalWriteUnsupportedError()
+	}
+	return cs.WriteIf(it, version)
+}
+
+// addToModel adds the types and attributes of written items to the current model and saves it
+// The model may have been replaced since the items were validated, they are added to the one that is current now
+func (is *ItemService) addToModel(items ...item.Item) error {
+	return is.models.Update(func(model *item.Model) (*item.Model, error) {
+		var changed bool
+		for _, it := range items {
+			c, _ := item.AddItem(it, model)
+			changed = changed || c
+		}
+		if !changed {
+			return nil, nil
+		}
+		return model, nil
+	}, func(model *item.Model) error {
+		return is.store.Write(item.ToItem(model))
+	})
+}
+
+// WriteBatch validates items against the model and writes all the valid ones in one batch
+// The returned slice has one error per item, nil if the item was written
+func (is *ItemService) WriteBatch(items []item.Item) []error {
+	errs := make([]error, len(items))
+	var valid []item.Item
+	var idx []int
+	// validate on a copy so that only the items actually written change the model
+	model := is.models.Model().Clone()
+	for i, it := range items {
+		if item.IsModelID(it.ID) {
+			errs[i] = is.Write(it, "")
+			// the following items are validated against the new model
+			model = is.models.Model().Clone()
+			continue
+		}
+		_, err := item.AddItem(it, model)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		valid = append(valid, it)
+		idx = append(idx, i)
+	}
+	var written []item.Item
+	for j, err := range item.WriteBatch(is.store, valid) {
+		errs[idx[j]] = err
+		if err == nil {
+			written = append(written, valid[j])
+		}
+	}
+	modelErr := is.addToModel(written...)
+	for j, it := range valid {
+		if errs[idx[j]] == nil {
+			errs[idx[j]] = is.replicate(it.ID)
+		}
+		if errs[idx[j]] == nil {
+			errs[idx[j]] = modelErr
+		}
+	}
+	return errs
+}
+
+// WriteAll validates all items against the model and writes all of them, or none of them
+// The returned slice has the validation error of each item, the error is set if nothing was written
+func (is *ItemService) WriteAll(items []item.Item) ([]error, error) {
+	errs := make([]error, len(items))
+	var firstErr error
+	// validate on a copy so that a rejected request leaves the model untouched
+	model := is.models.Model().Clone()
+	for i, it := range items {
+		_, err := item.AddItem(it, model)
+		errs[i] = err
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return errs, firstErr
+	}
+	err := item.WriteAll([]item.Store{is.store}, items)
+	if err != nil {
+		return errs, err
+	}
+	// the model is only saved once the items are written, so that a failed request does not change it
+	modelErr := is.addToModel(items...)
+	ids := make([]item.ID, len(items))
+	for i, it := range items {
+		ids[i] = it.ID
+	}
+	if err = is.replicate(ids...); err != nil {
+		return errs, err
+	}
+	return errs, modelErr
+}
+
+// Delete deletes an item, only if it is at the given version if one is provided, and all its children
+func (is *ItemService) Delete(id item.ID, version string) error {
+	var err error
+	if item.IsModelID(id) {
+		err = is.models.Update(func(current *item.Model) (*item.Model, error) {
+			return item.EmptyModel(), nil
+		}, func(model *item.Model) error {
+			return is.deleteItem(id, version)
+		})
+	} else {
+		err = is.deleteItem(id, version)
+	}
+	if err != nil {
+		return err
+	}
+	err = is.replicate(id)
+	if err != nil {
+		return err
+	}
+	stores := []item.Store{is.store, replicationQueue{is, false}}
+	if h2, ok2 := is.store.(item.SearchStore); ok2 {
+		return item.DeleteChildren(id, stores, h2)
+	} else if h2, ok2 := is.secondary.(item.SearchStore); ok2 {
+		return item.DeleteChildren(id, stores, h2)
+	}
+	return nil
+}
+
+// deleteItem deletes an item from the primary store, only if it is at the given version if one is provided
+func (is *ItemService) deleteItem(id item.ID, version string) error {
+	if len(version) == 0 {
+		return is.store.Delete(id)
+	}
+	cs, ok := is.store.(item.ConditionalStore)
+	if !ok {
+		return item.NewConditionalWriteUnsupportedError()
+	}
+	return cs.DeleteIf(id, version)
+}
+
+// Restore writes a previous version of an item as its current version
+// If recursive is true, the children of the item are also restored as they were when that version was replaced, and
+// the children created since then are deleted, all in one atomic change so that a failure leaves the subtree untouched
+func (is *ItemService) Restore(id item.ID, version string, recursive bool) ([]item.Item, error) {
+	hs, ok := is.store.(item.HistoryStore)
+	if !ok {
+		return nil, errors.New("Store does not keep history")
+	}
+	st, next, err := item.FindVersion(hs, id, version)
+	if err != nil {
+		return nil, err
+	}
+	if st.Status != "ALIVE" {
+		return nil, item.NewVersionNotFoundError(id, version)
+	}
+	// the model has no children, writing it replaces the current model
+	if !recursive || item.IsModelID(id) {
+		if err = is.Write(st.Item, ""); err != nil {
+			return nil, err
+		}
+		return []item.Item{st.Item}, nil
+	}
+	cs, ok := is.store.(item.AtomicChangeStore)
+	if !ok {
+		return nil, errors.New("Store cannot restore children atomically")
+	}
+	its := []item.Item{st.Item}
+	var added []item.ID
+	if len(next.Version) > 0 {
+		ss, ok := is.store.(item.SubtreeStore)
+		tts, ok2 := is.store.(item.TimeTravelStore)
+		if !ok || !ok2 {
+			return nil, errors.New("Store cannot restore children")
+		}
+		// the children as they were just before the version was replaced
+		var children []item.Item
+		children, added, err = item.SubtreeAt(ss, tts, id, next.Updated.Add(-time.Nanosecond))
+		if err != nil {
+			return nil, err
+		}
+		its = append(its, children...)
+	}
+	// all the items are checked against the current model before anything is written, so that a failure leaves the
+	// subtree as it is
+	model := is.models.Model().Clone()
+	for _, it := range its {
+		if _, err = item.AddItem(it, model); err != nil {
+			return nil, err
+		}
+	}
+	// the children created since then are deleted in the same step
+	if err = cs.ChangeAll(its, added); err != nil {
+		return nil, err
+	}
+	modelErr := is.addToModel(its...)
+	ids := make([]item.ID, 0, len(its)+len(added))
+	for _, it := range its {
+		ids = append(ids, it.ID)
+	}
+	if err = is.replicate(append(ids, added...)...); err != nil {
+		return nil, err
+	}
+	if modelErr != nil {
+		return nil, modelErr
+	}
+	return its, nil
+}